@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/nats-io/nats-server/v2/server"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
@@ -58,6 +59,17 @@ func (s *EmbeddedNats) Shutdown() error {
 	return nil
 }
 
+// ClientURL returns the URL clients connect to, including the
+// authorization token if any, which is valid once started.
+func (s *EmbeddedNats) ClientURL() string {
+	url := s.ns.ClientURL()
+	if len(s.token) == 0 {
+		return url
+	}
+
+	return strings.Replace(url, "://", "://"+s.token+"@", 1)
+}
+
 func (s *EmbeddedNats) natsOptions() *server.Options {
 	opt := &server.Options{}
 
@@ -101,6 +113,16 @@ func WithPort(port int) Option {
 	}
 }
 
+// WithRandomPort makes the broker listen on a port chosen by
+// the system, see ClientURL, and disables the monitor, which
+// is useful to run brokers in tests.
+func WithRandomPort() Option {
+	return func(mq *EmbeddedNats) {
+		mq.port = server.RANDOM_PORT
+		mq.mPort = 0
+	}
+}
+
 // WithMonitorPort overrides default port 8222.
 func WithMonitorPort(port int) Option {
 	return func(mq *EmbeddedNats) {
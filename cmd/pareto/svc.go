@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/service"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// svcOptions holds flags shared by svc commands.
+type svcOptions struct {
+	registry string
+	domain   int
+	timeout  time.Duration
+	key      string
+	roles    []string
+	verbose  bool
+}
+
+var svcOpts = &svcOptions{}
+
+var svcCmd = &cobra.Command{
+	Use:   "svc",
+	Short: "service management",
+	Long:  `inspect and debug services registered to a registry`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// errors are printed by main
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+
+		if !svcOpts.verbose {
+			log.SetLevel(log.ErrorLevel)
+		}
+	},
+}
+
+// connect creates a client service attached to the registry,
+// which is not registered itself.
+func connect() (*service.MetaService, error) {
+	var opts []service.Option
+	if len(svcOpts.key) != 0 {
+		opts = append(opts, service.WithIdentity([]byte(svcOpts.key), svcOpts.roles...))
+	}
+
+	s := service.NewMetaService(&service.Descriptor{
+		Name:     "pareto-cli",
+		Domain:   svcOpts.domain,
+		Registry: svcOpts.registry,
+	}, opts...)
+	if s == nil {
+		return nil, fmt.Errorf("connect to registry %s failed", svcOpts.registry)
+	}
+
+	return s, nil
+}
+
+func svcCmdList() *cobra.Command {
+	var tags, labels []string
+	var output, sortBy, versions string
+	var desc bool
+	var cmd = &cobra.Command{
+		Use:   "list [NAME...]",
+		Short: "list service instances",
+		Long:  `list instances of services registered, all if no name is given`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filter := &service.QueryStatusListReq{Observed: args, Tags: tags, Version: versions, SortBy: sortBy, Desc: desc}
+			for _, label := range labels {
+				k, v, ok := strings.Cut(label, "=")
+				if !ok {
+					return fmt.Errorf("invalid label %q, expect key=value", label)
+				}
+
+				if filter.Labels == nil {
+					filter.Labels = make(map[string]string)
+				}
+				filter.Labels[k] = v
+			}
+
+			s, err := connect()
+			if err != nil {
+				return err
+			}
+
+			list := s.Registrar().Query(filter)
+			if list == nil {
+				return errors.New("query registry failed")
+			}
+
+			if output == "json" {
+				return printJSON(list)
+			}
+
+			printStatusTable(list.Services)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&tags, "tag", "t", nil, "select instances carrying all the tags")
+	cmd.Flags().StringSliceVarP(&labels, "label", "l", nil, "select instances carrying all the labels, as key=value")
+	cmd.Flags().StringVar(&versions, "version", "", "select instances whose version is in the range, e.g. ^1.2")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+	cmd.Flags().StringVarP(&sortBy, "sort", "s", service.SortByName, "sort instances by name, state, time or version")
+	cmd.Flags().BoolVar(&desc, "desc", false, "sort in descending order")
+
+	return cmd
+}
+
+func svcCmdStatus() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "status NAME",
+		Short: "show status of a service",
+		Long:  `show full status, including endpoints and metrics, of all instances of a service`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := connect()
+			if err != nil {
+				return err
+			}
+
+			list := s.Registrar().Query(&service.QueryStatusListReq{Observed: args})
+			if list == nil {
+				return errors.New("query registry failed")
+			}
+
+			if len(list.Services) == 0 {
+				return fmt.Errorf("service %s not found", args[0])
+			}
+
+			return printJSON(list.Services)
+		},
+	}
+
+	return cmd
+}
+
+func svcCmdWatch() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "watch [NAME...]",
+		Short: "watch state changes of services",
+		Long:  `stream state changes of services notified by the registry, until interrupted`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := connect()
+			if err != nil {
+				return err
+			}
+
+			watched := make(map[string]bool)
+			for _, name := range args {
+				watched[name] = true
+			}
+
+			err = s.Listen(service.EndpointServiceNotice, func(data []byte) {
+				status := &service.Status{}
+				if err := json.Unmarshal(data, status); err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, "malformed notice:", err)
+					return
+				}
+
+				if len(watched) != 0 && !watched[status.Name] {
+					return
+				}
+
+				fmt.Printf("%s  %-20s %-10s %-10s ready=%v\n",
+					time.UnixMilli(int64(status.Time)).Format(time.RFC3339),
+					status.Name, status.InstanceId(), status.State, status.Ready)
+			})
+			if err != nil {
+				return err
+			}
+
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func svcCmdCall() *cobra.Command {
+	var instance, versions string
+	var cmd = &cobra.Command{
+		Use:   "call [SERVICE]/CHANNEL METHOD [JSON]",
+		Short: "call a JSON-RPC method",
+		Long: `call a JSON-RPC method routed on a channel, and print the result.
+
+The channel is called on any instance exposing it if the target starts
+with /, e.g. /registry-center/service/info, or else on a healthy instance
+of the service named by the first segment, e.g. echo/echo/rpc calls
+channel /echo/rpc of service echo.`,
+		Args: cobra.RangeArgs(2, 3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts []service.CallOption
+			channel := args[0]
+			if !strings.HasPrefix(channel, "/") {
+				name, rest, ok := strings.Cut(channel, "/")
+				if !ok || len(rest) == 0 {
+					return fmt.Errorf("invalid target %q, expect SERVICE/CHANNEL", channel)
+				}
+
+				channel = "/" + rest
+				opts = append(opts, service.ToAnyInstance(name, service.RoundRobin))
+			}
+
+			if len(instance) != 0 {
+				opts = append(opts, service.ToInstance(instance))
+			}
+
+			if len(versions) != 0 {
+				opts = append(opts, service.WithVersion(versions))
+			}
+
+			params := json.RawMessage("{}")
+			if len(args) == 3 {
+				params = json.RawMessage(args[2])
+				if !json.Valid(params) {
+					return fmt.Errorf("invalid JSON params %q", args[2])
+				}
+			}
+
+			s, err := connect()
+			if err != nil {
+				return err
+			}
+
+			method := service.NewMethod[json.RawMessage, json.RawMessage](channel, args[1])
+			rsp, err := method.Invoke(s, &params, svcOpts.timeout, opts...)
+			if err != nil {
+				return err
+			}
+
+			return printJSON(rsp)
+		},
+	}
+
+	cmd.Flags().StringVarP(&instance, "instance", "i", "", "call the given instance")
+	cmd.Flags().StringVar(&versions, "version", "", "call an instance whose version is in the range, e.g. ^1.2")
+
+	return cmd
+}
+
+func svcCmdSplit() *cobra.Command {
+	var remove bool
+	var cmd = &cobra.Command{
+		Use:   "split NAME [RANGE=WEIGHT...]",
+		Short: "split calls of a service between versions",
+		Long: `show or set the traffic split of a service, which routes calls balanced
+over its instances to versions by weight, e.g.
+
+  pareto svc split echo 1.4.0-rc.1=5 ^1.3=95
+
+routes 5% of calls to the canary 1.4.0-rc.1, and the rest to ^1.3.
+An instance belongs to the first range containing its version.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			split := &service.TrafficSplit{Service: args[0]}
+			for _, arg := range args[1:] {
+				// ranges may contain =, e.g. >=1.2=5
+				i := strings.LastIndex(arg, "=")
+				if i <= 0 {
+					return fmt.Errorf("invalid weight %q, expect RANGE=WEIGHT", arg)
+				}
+
+				weight, err := strconv.ParseUint(arg[i+1:], 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid weight %q, expect RANGE=WEIGHT", arg)
+				}
+
+				split.Weights = append(split.Weights, &service.VersionWeight{Range: arg[:i], Weight: uint32(weight)})
+			}
+
+			s, err := connect()
+			if err != nil {
+				return err
+			}
+
+			if len(split.Weights) == 0 && !remove {
+				split, err = s.Registrar().QueryTrafficSplit(s.Domain(), args[0])
+			} else {
+				split, err = s.Registrar().SetTrafficSplit(split)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if split == nil {
+				fmt.Printf("calls of %s are not split\n", args[0])
+				return nil
+			}
+
+			return printJSON(split)
+		},
+	}
+
+	cmd.Flags().BoolVar(&remove, "clear", false, "remove the traffic split")
+
+	return cmd
+}
+
+func printJSON(v any) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(buf))
+	return nil
+}
+
+// printStatusTable prints instances in the order returned by the registry.
+func printStatusTable(list []*service.Status) {
+	now := box.TimeNowMs()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tINSTANCE\tDOMAIN\tSTATE\tREADY\tVERSION\tRESTARTS\tLAST SEEN")
+	for _, st := range list {
+		seen := "-"
+		if st.Time != 0 && now >= st.Time {
+			seen = (time.Duration(now-st.Time) * time.Millisecond).Round(time.Second).String() + " ago"
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%v\t%s\t%d\t%s\n",
+			st.Name, st.InstanceId(), st.Domain, st.State, st.Ready, st.Version, st.Restarts, seen)
+	}
+
+	_ = w.Flush()
+}
+
+func init() {
+	flags := svcCmd.PersistentFlags()
+	flags.StringVarP(&svcOpts.registry, "registry", "r", "nats://127.0.0.1:4222", "address of the registry broker")
+	flags.IntVarP(&svcOpts.domain, "domain", "d", 0, "domain of services")
+	flags.DurationVar(&svcOpts.timeout, "timeout", 2*time.Second, "timeout of calls")
+	flags.StringVar(&svcOpts.key, "key", "", "identity key signing calls, if access is restricted")
+	flags.StringSliceVar(&svcOpts.roles, "role", nil, "roles claimed by the identity")
+	flags.BoolVarP(&svcOpts.verbose, "verbose", "v", false, "print logs of the service framework")
+
+	svcCmd.AddCommand(svcCmdList(), svcCmdStatus(), svcCmdWatch(), svcCmdCall(), svcCmdSplit())
+	rootCmd.AddCommand(svcCmd)
+}
@@ -1,6 +1,7 @@
 package jsonrpc2
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	log "github.com/sirupsen/logrus"
@@ -15,9 +16,28 @@ type Invoker interface {
 	Call(channel string, data []byte, to time.Duration) ([]byte, error)
 }
 
+// ContextInvoker is optionally implemented by an Invoker
+// to receive the context passed to Client.InvokeContext.
+type ContextInvoker interface {
+	CallContext(ctx context.Context, channel string, data []byte, to time.Duration) ([]byte, error)
+}
+
+// CallHook is called by the client before a request is sent, and
+// may add metadata to the request. The returned function, if not
+// nil, is called with the result of the call.
+type CallHook = func(ctx context.Context, channel string, req *RPCRequest) func(rsp *RPCResponse, err error)
+
 // Client defines a general JSON-RPC method caller.
 type Client struct {
 	invoker Invoker
+	hooks   []CallHook
+}
+
+// AddHooks appends hooks applied to each call, in order.
+//
+// Note: hooks must be added before any call is made.
+func (i *Client) AddHooks(hooks ...CallHook) {
+	i.hooks = append(i.hooks, hooks...)
 }
 
 func (i *Client) getId() int {
@@ -29,14 +49,35 @@ func (i *Client) getId() int {
 //		e.g.: Invoke("test.string", 1*time.Second, "hello", "json-rpc")
 //	       Invoke("test.struct", 2*time.Second, someStruct)
 func (i *Client) Invoke(channel, method string, timeout time.Duration, params ...any) (*RPCResponse, error) {
+	return i.InvokeContext(context.Background(), channel, method, timeout, params...)
+}
+
+// InvokeContext is like Invoke, and passes ctx to the hooks
+// of the client, and to the invoker if it's a ContextInvoker.
+func (i *Client) InvokeContext(ctx context.Context, channel, method string,
+	timeout time.Duration, params ...any) (rsp *RPCResponse, err error) {
 	req := NewRequest(i.getId(), method, params...)
+	for _, hook := range i.hooks {
+		if done := hook(ctx, channel, req); done != nil {
+			defer func() { done(rsp, err) }()
+		}
+	}
 
+	return i.invoke(ctx, channel, req, timeout)
+}
+
+func (i *Client) invoke(ctx context.Context, channel string, req *RPCRequest, timeout time.Duration) (*RPCResponse, error) {
 	reqBuf, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	rspBuf, err := i.invoker.Call(channel, reqBuf, timeout)
+	var rspBuf []byte
+	if ci, ok := i.invoker.(ContextInvoker); ok {
+		rspBuf, err = ci.CallContext(ctx, channel, reqBuf, timeout)
+	} else {
+		rspBuf, err = i.invoker.Call(channel, reqBuf, timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
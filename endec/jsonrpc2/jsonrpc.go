@@ -1,6 +1,7 @@
 package jsonrpc2
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -19,12 +20,42 @@ const (
 //	ID: message id used to identify request and response pairs.
 //	    Should be unique for every request in a batch request.
 //	Version: must always be set to "2.0" for JSON-RPC version 2.0
+//	Meta: optional metadata, e.g. trace context, as an extension
 //	See: http://www.jsonrpc.org/specification#request_object
 type RPCRequest struct {
-	ID      int    `json:"id"`
-	Method  string `json:"method"`
-	Version string `json:"jsonrpc"`
-	Params  any    `json:"params,omitempty"`
+	ID      int               `json:"id"`
+	Method  string            `json:"method"`
+	Version string            `json:"jsonrpc"`
+	Params  any               `json:"params,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+
+	ctx context.Context
+}
+
+// Context returns the context of the request, which is set by
+// ServeHooks on the server side, or context.Background.
+func (r *RPCRequest) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of the request with ctx.
+func (r *RPCRequest) WithContext(ctx context.Context) *RPCRequest {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// SetMeta sets a metadata field of the request.
+func (r *RPCRequest) SetMeta(key, value string) {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+
+	r.Meta[key] = value
 }
 
 func (r *RPCRequest) Marshal() ([]byte, error) {
@@ -271,6 +302,7 @@ func ParseResponse(data []byte) (*RPCResponse, error) {
 type RPCError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
 }
 
 // Error function is provided to be used as error object.
@@ -292,6 +324,32 @@ func NewErrorWithMsg(code int, msg string) *RPCError {
 	}
 }
 
+// NewErrorWithData creates an error carrying additional data,
+// which can be decoded by the caller using GetData.
+func NewErrorWithData(code int, msg string, data any) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: msg,
+		Data:    data,
+	}
+}
+
+// GetData converts the additional data of the error to the type
+// instance passed-in, as json.Unmarshal does.
+func (e *RPCError) GetData(toType any) error {
+	js, err := json.Marshal(e.Data)
+	if err != nil {
+		return NewError(ErrServerInvalidParameters)
+	}
+
+	err = json.Unmarshal(js, toType)
+	if err != nil {
+		return NewError(ErrServerInvalidParameters)
+	}
+
+	return nil
+}
+
 func parseParams(params ...any) any {
 	if params == nil {
 		return nil
@@ -357,6 +415,8 @@ const (
 	ErrServerInvalidParameters       = 32602
 	ErrServerInternal                = 32603
 	ErrServerInvalidMessageId        = 32604
+	ErrServerAccessDenied            = 32605
+	ErrServerBusy                    = 32606
 	ErrApplicationError              = 32500 //application side(caller side) error
 	ErrSystemError                   = 32400
 	ErrTransportError                = 32300
@@ -371,6 +431,8 @@ var ErrCodeString = map[int]string{
 	ErrServerInvalidParameters:       "server error: invalid method parameters",
 	ErrServerInternal:                "server error: internal rpc error",
 	ErrServerInvalidMessageId:        "server error: invalid message id",
+	ErrServerAccessDenied:            "server error: access denied",
+	ErrServerBusy:                    "server error: busy",
 	ErrApplicationError:              "application error",
 	ErrSystemError:                   "system error",
 	ErrTransportError:                "transport error",
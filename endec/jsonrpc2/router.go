@@ -1,10 +1,12 @@
 package jsonrpc2
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"runtime/debug"
+	"sort"
 	"sync"
 )
 
@@ -23,6 +25,24 @@ type Interceptor = func(*RPCRequest) *RPCResponse
 // PostHandler defines post-handling interceptors for rpc method.
 type PostHandler = func(*RPCRequest, *RPCResponse)
 
+// ServeHook is called by the router before a request is passed
+// to interceptors and the handler, and may return a context set
+// to the request, see RPCRequest.Context. The returned function,
+// if not nil, is called with the response of the handler.
+type ServeHook = func(req *RPCRequest) (context.Context, func(rsp *RPCResponse))
+
+// Authorizer is called by the router after serve hooks and before
+// interceptors, with the channel the request is routed on. It may
+// return a context set to the request, and rejects the request if
+// a non-nil RPCResponse is returned.
+type Authorizer = func(channel string, req *RPCRequest) (context.Context, *RPCResponse)
+
+// Admitter is called by the router after authorizers and before
+// interceptors, to admit requests under load, e.g. by rate limits.
+// It rejects the request if a non-nil RPCResponse is returned, or
+// else may return a function called once the request is handled.
+type Admitter = func(channel string, req *RPCRequest) (release func(), rsp *RPCResponse)
+
 // Dispatcher defines underlying channel message dispatcher for rpc.
 type Dispatcher = func(req []byte) (rsp []byte, err error)
 
@@ -45,6 +65,9 @@ type Router interface {
 	// Channel returns the channel identified by name.
 	Channel(name string) RouterChannel
 
+	// Channels returns endpoints of all channels, sorted.
+	Channels() []string
+
 	// Group returns or creates a routing group identified
 	// by the group name and the channel bounded to.
 	//Group(channel, group string) RouterGroup
@@ -62,6 +85,18 @@ type Router interface {
 	// Set clipLimit <= 0 means using the default, which is 1024.
 	EnableTrace(on bool, clipLimit int)
 
+	// AddServeHooks appends hooks applied to each request
+	// dispatched by the default method dispatcher, in order.
+	AddServeHooks(hooks ...ServeHook)
+
+	// AddAuthorizers appends authorizers applied to each request
+	// dispatched by the default method dispatcher, in order.
+	AddAuthorizers(authorizers ...Authorizer)
+
+	// AddAdmitters appends admitters applied to each request
+	// dispatched by the default method dispatcher, in order.
+	AddAdmitters(admitters ...Admitter)
+
 	// genMethodDispatcher generates a default dispatcher for the given channel.
 	//genMethodDispatcher(channel string) Dispatcher
 
@@ -111,6 +146,9 @@ type RouterChannel interface {
 	// or nil if not exist.
 	Handler(method string) Handler
 
+	// Methods returns names of all registered methods, sorted.
+	Methods() []string
+
 	// AddInterceptors adds interceptors chained before invoking handler.
 	AddInterceptors(interceptors ...Interceptor) RouterChannel
 
@@ -151,6 +189,9 @@ type router struct {
 	channelBearer ChannelBinder
 	channels      map[string]*routerChannel
 	dispatchers   map[string]Dispatcher
+	serveHooks    []ServeHook
+	authorizers   []Authorizer
+	admitters     []Admitter
 
 	trace     bool
 	traceClip int
@@ -194,6 +235,20 @@ func (r *router) Channel(name string) RouterChannel {
 	return r.getChannel(name)
 }
 
+func (r *router) Channels() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var channels []string
+	for endpoint := range r.channels {
+		channels = append(channels, endpoint)
+	}
+
+	sort.Strings(channels)
+
+	return channels
+}
+
 func (r *router) GetHandler(channel, method string) (Handler, error) {
 	r.Lock()
 	defer r.Unlock()
@@ -283,6 +338,23 @@ func (r *router) genMethodDispatcher(channel string) MethodDispatcher {
 			return req, NewErrorResponse(ErrServerInternal, "channel:"+channel+" not found")
 		}
 
+		for _, done := range r.applyServeHooks(req) {
+			defer func(done func(*RPCResponse)) { done(rsp) }(done)
+		}
+
+		if denied := r.applyAuthorizers(channel, req); denied != nil {
+			return req, denied
+		}
+
+		releases, busy := r.applyAdmitters(channel, req)
+		if busy != nil {
+			return req, busy
+		}
+
+		for _, release := range releases {
+			defer release()
+		}
+
 		// invoke before-interceptors
 		if bail := r.applyInterceptors(ch.Interceptors(req.Method), req); bail != nil {
 			return req, bail
@@ -294,6 +366,96 @@ func (r *router) genMethodDispatcher(channel string) MethodDispatcher {
 	}
 }
 
+func (r *router) AddServeHooks(hooks ...ServeHook) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.serveHooks = append(r.serveHooks, hooks...)
+}
+
+// applyServeHooks applies serve hooks to the request, and
+// returns the functions to call with the response.
+func (r *router) applyServeHooks(req *RPCRequest) []func(*RPCResponse) {
+	r.Lock()
+	hooks := r.serveHooks
+	r.Unlock()
+
+	var done []func(*RPCResponse)
+	for _, hook := range hooks {
+		ctx, fn := hook(req)
+		if ctx != nil {
+			req.ctx = ctx
+		}
+
+		if fn != nil {
+			done = append(done, fn)
+		}
+	}
+
+	return done
+}
+
+func (r *router) AddAuthorizers(authorizers ...Authorizer) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.authorizers = append(r.authorizers, authorizers...)
+}
+
+// applyAuthorizers returns non-nil if the request is rejected.
+func (r *router) applyAuthorizers(channel string, req *RPCRequest) *RPCResponse {
+	r.Lock()
+	authorizers := r.authorizers
+	r.Unlock()
+
+	for _, authorize := range authorizers {
+		ctx, denied := authorize(channel, req)
+		if denied != nil {
+			return denied
+		}
+
+		if ctx != nil {
+			req.ctx = ctx
+		}
+	}
+
+	return nil
+}
+
+func (r *router) AddAdmitters(admitters ...Admitter) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.admitters = append(r.admitters, admitters...)
+}
+
+// applyAdmitters returns functions releasing the request admitted, or
+// non-nil if the request is rejected, when admitters having admitted
+// it are released at once.
+func (r *router) applyAdmitters(channel string, req *RPCRequest) ([]func(), *RPCResponse) {
+	r.Lock()
+	admitters := r.admitters
+	r.Unlock()
+
+	var releases []func()
+	for _, admit := range admitters {
+		release, rejected := admit(channel, req)
+		if rejected != nil {
+			for _, fn := range releases {
+				fn()
+			}
+
+			return nil, rejected
+		}
+
+		if release != nil {
+			releases = append(releases, release)
+		}
+	}
+
+	return releases, nil
+}
+
 // returns nil if all interceptors applied, and non-nil
 // if any error occurred and the chained calls are terminated.
 func (r *router) applyInterceptors(interceptors []Hook, req *RPCRequest) *RPCResponse {
@@ -428,6 +590,20 @@ func (r *routerChannel) Handler(method string) Handler {
 	}
 }
 
+func (r *routerChannel) Methods() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var methods []string
+	for method := range r.handlers {
+		methods = append(methods, method)
+	}
+
+	sort.Strings(methods)
+
+	return methods
+}
+
 // AddMap merge handlers into the routing table.
 func (r *routerChannel) AddMap(handlers map[string]Handler) RouterChannel {
 	r.Lock()
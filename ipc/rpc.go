@@ -20,6 +20,10 @@ type RPCServer interface {
 	ExposeV2(name string, handler CalleeHandler) error
 }
 
+// ErrTimeout is returned by RPC clients when a call
+// is not responded within the timeout.
+var ErrTimeout = errors.New("timeout")
+
 // RPCClient defines caller side of an RPC service.
 type RPCClient interface {
 	//Call calls a remote method identified by its name with the given args.
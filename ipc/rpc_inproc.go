@@ -38,8 +38,10 @@ func (r *InProcRPC) Expose(name string, fn interface{}) {
 	r.broker.register(name, fn)
 }
 
+// ExposeV2 exposes a service by associating a callee handler,
+// replaced if already exposed.
 func (r *InProcRPC) ExposeV2(name string, handler CalleeHandler) error {
-	// TODO: implement me.
+	r.broker.register(name, handler)
 	return nil
 }
 
@@ -68,15 +70,22 @@ func (r *InProcRPC) Call(name string, args ...interface{}) (reflect.Value, error
 	return reflect.Value{}, nil
 }
 
-func (r *InProcRPC) CallV2(name string, _ []byte, _ time.Duration) ([]byte, error) {
-	_, ok := r.broker.handlers[name]
+// CallV2 calls the callee handler exposed by ExposeV2 synchronously,
+// so the timeout is ignored.
+func (r *InProcRPC) CallV2(name string, data []byte, _ time.Duration) ([]byte, error) {
+	r.broker.Lock()
+	fn, ok := r.broker.handlers[name]
+	r.broker.Unlock()
 	if !ok {
 		return nil, fmt.Errorf("rpc name %s not found", name)
 	}
 
-	// TODO: implement me.
+	handler, ok := fn.Interface().(CalleeHandler)
+	if !ok {
+		return nil, fmt.Errorf("rpc name %s is not exposed by ExposeV2", name)
+	}
 
-	return nil, nil
+	return handler(data)
 }
 
 func NewInProcRPC(conf *RPCConf) (RPC, error) {
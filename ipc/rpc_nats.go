@@ -63,7 +63,7 @@ func (r *NatsRPC) CallV2(name string, data []byte, timeout time.Duration) ([]byt
 	if err != nil {
 		log.Warnf("rpc caller call %s failed: %v", name, err)
 		if errors.Is(err, nats.ErrTimeout) {
-			return nil, errors.New("timeout")
+			return nil, ErrTimeout
 		}
 
 		return nil, err
@@ -0,0 +1,530 @@
+// Package metrics provides counters, gauges and histograms
+// exported in the Prometheus text exposition format.
+//
+// See https://prometheus.io/docs/instrumenting/exposition_formats/.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type defines the metric type.
+type Type string
+
+const (
+	CounterType   Type = "counter"
+	GaugeType     Type = "gauge"
+	HistogramType Type = "histogram"
+)
+
+// DefaultBuckets defines the default histogram buckets,
+// suitable for latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the process-wide registry.
+var Default = NewRegistry()
+
+// collector is implemented by all metric families.
+type collector interface {
+	describe() (name, help string, typ Type)
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and renders them.
+//
+// Note: all methods are goroutine-safe.
+type Registry struct {
+	sync.RWMutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]collector),
+	}
+}
+
+// Counter returns the counter of the given name, which is
+// created if not exist, or an error if the name is registered
+// as a different type.
+func (r *Registry) Counter(name, help string, labels ...string) (*Counter, error) {
+	c := r.getOrCreate(name, func() collector {
+		return &Counter{family: newFamily(name, help, labels)}
+	})
+
+	if counter, ok := c.(*Counter); ok {
+		return counter, nil
+	}
+
+	return nil, typeMismatch(name, c)
+}
+
+// MustCounter is like Counter but panics on errors, and
+// is intended for initialization of package variables.
+func (r *Registry) MustCounter(name, help string, labels ...string) *Counter {
+	c, err := r.Counter(name, help, labels...)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// Gauge returns the gauge of the given name, which is
+// created if not exist, or an error if the name is registered
+// as a different type.
+func (r *Registry) Gauge(name, help string, labels ...string) (*Gauge, error) {
+	c := r.getOrCreate(name, func() collector {
+		return &Gauge{family: newFamily(name, help, labels)}
+	})
+
+	if gauge, ok := c.(*Gauge); ok {
+		return gauge, nil
+	}
+
+	return nil, typeMismatch(name, c)
+}
+
+// MustGauge is like Gauge but panics on errors.
+func (r *Registry) MustGauge(name, help string, labels ...string) *Gauge {
+	g, err := r.Gauge(name, help, labels...)
+	if err != nil {
+		panic(err)
+	}
+
+	return g
+}
+
+// Histogram returns the histogram of the given name, which is
+// created if not exist, or an error if the name is registered
+// as a different type. DefaultBuckets is used if buckets is empty.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) (*Histogram, error) {
+	c := r.getOrCreate(name, func() collector {
+		return newHistogram(name, help, buckets, labels)
+	})
+
+	if histogram, ok := c.(*Histogram); ok {
+		return histogram, nil
+	}
+
+	return nil, typeMismatch(name, c)
+}
+
+// MustHistogram is like Histogram but panics on errors.
+func (r *Registry) MustHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h, err := r.Histogram(name, help, buckets, labels...)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+func typeMismatch(name string, c collector) error {
+	_, _, typ := c.describe()
+	return fmt.Errorf("metric %s is already registered as a %s", name, typ)
+}
+
+// GaugeFunc registers a gauge whose samples are produced by fn on each
+// collection, by calling emit once per sample. An existing gauge func of
+// the same name is replaced, and an error is returned if the name is
+// registered as a different type.
+func (r *Registry) GaugeFunc(name, help string, fn func(emit func(v float64, labelValues ...string)), labels ...string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if c, ok := r.collectors[name]; ok {
+		if _, ok = c.(*gaugeFunc); !ok {
+			return typeMismatch(name, c)
+		}
+	}
+
+	r.collectors[name] = &gaugeFunc{family: newFamily(name, help, labels), fn: fn}
+
+	return nil
+}
+
+// MustGaugeFunc is like GaugeFunc but panics on errors.
+func (r *Registry) MustGaugeFunc(name, help string, fn func(emit func(v float64, labelValues ...string)), labels ...string) {
+	if err := r.GaugeFunc(name, help, fn, labels...); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the metric of the given name, if any.
+func (r *Registry) Unregister(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.collectors, name)
+}
+
+// Write renders all metrics in text exposition format,
+// sorted by metric names.
+func (r *Registry) Write(w io.Writer) error {
+	r.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		name, help, typ := c.describe()
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		_, _ = fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler serving the metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			log.Warnln("write metrics failed:", err)
+		}
+	})
+}
+
+func (r *Registry) getOrCreate(name string, create func() collector) collector {
+	r.Lock()
+	defer r.Unlock()
+
+	if c, ok := r.collectors[name]; ok {
+		return c
+	}
+
+	c := create()
+	r.collectors[name] = c
+
+	return c
+}
+
+// family holds samples of a metric keyed by label values.
+type family struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+}
+
+func newFamily(name, help string, labels []string) family {
+	return family{name: name, help: help, labels: labels}
+}
+
+// key joins label values, which must match labels in count.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		log.Warnf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values))
+		fixed := make([]string, len(f.labels))
+		copy(fixed, values)
+		values = fixed
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+func (f *family) values(key string) []string {
+	if len(f.labels) == 0 {
+		return nil
+	}
+
+	return strings.Split(key, "\xff")
+}
+
+// series renders name{labels} with optional extra label.
+func (f *family) series(name string, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabel(values[i])))
+	}
+
+	if len(extraName) != 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escapeLabel(extraValue)))
+	}
+
+	if len(pairs) == 0 {
+		return name
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	family
+	samples map[string]float64
+}
+
+// Inc increases the counter by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		log.Warnf("counter %s can not decrease", c.name)
+		return
+	}
+
+	k := c.key(labelValues)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.samples == nil {
+		c.samples = make(map[string]float64)
+	}
+
+	c.samples[k] += v
+}
+
+// Value returns current value of the counter.
+func (c *Counter) Value(labelValues ...string) float64 {
+	k := c.key(labelValues)
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.samples[k]
+}
+
+func (c *Counter) describe() (string, string, Type) {
+	return c.name, c.help, CounterType
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, k := range sortedKeys(c.samples) {
+		_, _ = fmt.Fprintf(w, "%s %s\n", c.series(c.name, c.values(k), "", ""), formatFloat(c.samples[k]))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	family
+	samples map[string]float64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return v })
+}
+
+// Add adds v, which can be negative, to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Inc increases the gauge by 1.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decreases the gauge by 1.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns current value of the gauge.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	k := g.key(labelValues)
+
+	g.Lock()
+	defer g.Unlock()
+
+	return g.samples[k]
+}
+
+func (g *Gauge) update(labelValues []string, fn func(old float64) float64) {
+	k := g.key(labelValues)
+
+	g.Lock()
+	defer g.Unlock()
+
+	if g.samples == nil {
+		g.samples = make(map[string]float64)
+	}
+
+	g.samples[k] = fn(g.samples[k])
+}
+
+func (g *Gauge) describe() (string, string, Type) {
+	return g.name, g.help, GaugeType
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, k := range sortedKeys(g.samples) {
+		_, _ = fmt.Fprintf(w, "%s %s\n", g.series(g.name, g.values(k), "", ""), formatFloat(g.samples[k]))
+	}
+}
+
+type gaugeFunc struct {
+	family
+	fn func(emit func(v float64, labelValues ...string))
+}
+
+func (g *gaugeFunc) describe() (string, string, Type) {
+	return g.name, g.help, GaugeType
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	samples := make(map[string]float64)
+	g.fn(func(v float64, labelValues ...string) {
+		samples[g.key(labelValues)] = v
+	})
+
+	for _, k := range sortedKeys(samples) {
+		_, _ = fmt.Fprintf(w, "%s %s\n", g.series(g.name, g.values(k), "", ""), formatFloat(samples[k]))
+	}
+}
+
+// Histogram samples observations and counts them in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+	samples map[string]*histogramSample
+}
+
+type histogramSample struct {
+	counts []uint64 //cumulative counts are computed when rendering
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels []string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	return &Histogram{
+		family:  newFamily(name, help, labels),
+		buckets: b,
+		samples: make(map[string]*histogramSample),
+	}
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.samples[k]
+	if !ok {
+		s = &histogramSample{counts: make([]uint64, len(h.buckets))}
+		h.samples[k] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+// Count returns number of observations.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	k := h.key(labelValues)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if s, ok := h.samples[k]; ok {
+		return s.count
+	}
+
+	return 0
+}
+
+func (h *Histogram) describe() (string, string, Type) {
+	return h.name, h.help, HistogramType
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, k := range sortedKeys(h.samples) {
+		s := h.samples[k]
+		values := h.values(k)
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", formatFloat(upper)), cumulative)
+		}
+
+		_, _ = fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", "+Inf"), s.count)
+		_, _ = fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", values, "", ""), formatFloat(s.sum))
+		_, _ = fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", values, "", ""), s.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
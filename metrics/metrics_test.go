@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.MustCounter("calls_total", "Total calls.", "method", "result")
+	c.Inc("get", "ok")
+	c.Add(2, "get", "ok")
+	c.Inc("put", "error")
+	assert.Equal(t, float64(3), c.Value("get", "ok"))
+	assert.Same(t, c, r.MustCounter("calls_total", "Total calls.", "method", "result"))
+
+	g := r.MustGauge("up", "Up state.")
+	g.Set(1)
+
+	_, err := r.Gauge("calls_total", "Total calls.")
+	assert.ErrorContains(t, err, "already registered as a counter")
+	assert.Panics(t, func() { r.MustHistogram("up", "Up state.", nil) })
+
+	h := r.MustHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	require.Nil(t, r.GaugeFunc("services", "Services per state.", func(emit func(v float64, labelValues ...string)) {
+		emit(2, "servicing")
+		emit(1, `we"ird`)
+	}, "state"))
+	err = r.GaugeFunc("calls_total", "Total calls.", func(emit func(v float64, labelValues ...string)) {})
+	assert.ErrorContains(t, err, "already registered as a counter")
+	assert.Panics(t, func() {
+		r.MustGaugeFunc("latency_seconds", "Latency.", func(emit func(v float64, labelValues ...string)) {})
+	})
+
+	var buf bytes.Buffer
+	require.Nil(t, r.Write(&buf))
+
+	expected := `# HELP calls_total Total calls.
+# TYPE calls_total counter
+calls_total{method="get",result="ok"} 3
+calls_total{method="put",result="error"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+# HELP services Services per state.
+# TYPE services gauge
+services{state="servicing"} 2
+services{state="we\"ird"} 1
+# HELP up Up state.
+# TYPE up gauge
+up 1
+`
+	assert.Equal(t, expected, buf.String())
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expected, rec.Body.String())
+}
@@ -0,0 +1,490 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"github.com/zourva/pareto/uuid"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	IdentityHeader  = "identity" //metadata key of the signed identity of callers
+	deniedHeader    = "denied"   //metadata key of replies to raw calls denied, see deniedReply
+	IdentityMaxSkew = 60         //seconds, max age of identities accepted
+
+	AnyService = "*" //matches any authenticated service in AccessRule
+)
+
+var (
+	// ErrAccessDenied is returned to callers rejected by an AccessRule.
+	ErrAccessDenied = errors.New("access denied")
+
+	errNoIdentity      = errors.New("no identity")
+	errUnknownIdentity = errors.New("no key to verify identity")
+	errBadSignature    = errors.New("bad signature")
+	errStaleIdentity   = errors.New("identity expired")
+	errReplayed        = errors.New("identity replayed")
+)
+
+// Caller is the identity of the service calling a method, signed by
+// the caller using its identity key, see WithIdentity.
+//
+// Roles are claimed by the caller, and trusted as far as its key is,
+// i.e. services sharing a key may claim roles of each other.
+type Caller struct {
+	Service  string   `json:"svc"`
+	Instance string   `json:"ins"`
+	Roles    []string `json:"roles,omitempty"`
+	Time     uint64   `json:"ts"`  //timestamp in milliseconds
+	Nonce    string   `json:"jti"` //unique id of the identity, accepted once
+}
+
+// HasRole returns true if the caller claims the role.
+func (c *Caller) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type callerKey struct{}
+
+// CallerFromContext returns the verified identity of the caller
+// passed to handlers, or nil if the caller is anonymous.
+func CallerFromContext(ctx context.Context) *Caller {
+	c, _ := ctx.Value(callerKey{}).(*Caller)
+	return c
+}
+
+func contextWithCaller(ctx context.Context, c *Caller) context.Context {
+	if c == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// AccessRule declares callers allowed to call a channel or a method,
+// which is allowed if the caller is one of Services, or has one of
+// Roles. A rule allowing nothing denies all callers.
+type AccessRule struct {
+	Services []string `json:"services,omitempty"` //service names, or AnyService
+	Roles    []string `json:"roles,omitempty"`
+}
+
+func (r *AccessRule) allows(c *Caller) bool {
+	for _, name := range r.Services {
+		if name == AnyService || name == c.Service {
+			return true
+		}
+	}
+
+	for _, role := range r.Roles {
+		if c.HasRole(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AccessDenial is the audit record of a rejected call.
+type AccessDenial struct {
+	Service  string `json:"service"` //callee
+	Channel  string `json:"channel"`
+	Method   string `json:"method,omitempty"`
+	Caller   string `json:"caller,omitempty"` //empty if anonymous
+	Instance string `json:"instance,omitempty"`
+	Reason   string `json:"reason"`
+	Time     uint64 `json:"time"` //timestamp in milliseconds
+}
+
+// accessControl holds the identity of the service, keys to
+// verify callers, and access rules of channels and methods.
+type accessControl struct {
+	sync.RWMutex
+	key     []byte                 //identity key, nil if not signing
+	roles   []string               //roles claimed
+	trusted map[string][]byte      //service -> key to verify identities
+	rules   map[string]*AccessRule //channel#method -> rule, method omitted for channel
+	audit   func(*AccessDenial)    //optional audit hook
+
+	nonces map[string]uint64 //service/nonce -> expiry of identities accepted
+	pruned uint64            //timestamp of the last pruning of nonces
+}
+
+func newAccessControl() *accessControl {
+	return &accessControl{
+		trusted: make(map[string][]byte),
+		rules:   make(map[string]*AccessRule),
+		nonces:  make(map[string]uint64),
+	}
+}
+
+func ruleKey(channel, method string) string {
+	if len(method) == 0 {
+		return channel
+	}
+
+	return channel + "#" + method
+}
+
+func (a *accessControl) setRule(channel, method string, rule *AccessRule) {
+	a.Lock()
+	defer a.Unlock()
+
+	if rule == nil {
+		delete(a.rules, ruleKey(channel, method))
+	} else {
+		a.rules[ruleKey(channel, method)] = rule
+	}
+}
+
+// rule returns the rule of the method, or of the channel if
+// the method has none, or nil if access is not restricted.
+func (a *accessControl) rule(channel, method string) *AccessRule {
+	a.RLock()
+	defer a.RUnlock()
+
+	if len(method) != 0 {
+		if r, ok := a.rules[ruleKey(channel, method)]; ok {
+			return r
+		}
+	}
+
+	return a.rules[channel]
+}
+
+func (a *accessControl) signing() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.key != nil
+}
+
+// digest computes the signature of claims bound to the target
+// of the call and a binding of the request, e.g. a payload digest.
+func digest(key []byte, claims, channel, method, binding string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{claims, channel, method, binding}, "\n")))
+	return mac.Sum(nil)
+}
+
+// sign returns the identity token of the caller for the target,
+// formatted as base64url(claims).base64url(signature).
+func (a *accessControl) sign(c *Caller, channel, method, binding string) string {
+	a.RLock()
+	key := a.key
+	c.Roles = a.roles
+	a.RUnlock()
+
+	c.Nonce = uuid.UUID()
+
+	buf, _ := json.Marshal(c)
+	claims := base64.RawURLEncoding.EncodeToString(buf)
+	sig := digest(key, claims, channel, method, binding)
+
+	return claims + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// verify verifies the identity token for the target, using the key
+// trusted for the service claimed, or the identity key if none.
+func (a *accessControl) verify(token, channel, method, binding string) (*Caller, error) {
+	if len(token) == 0 {
+		return nil, errNoIdentity
+	}
+
+	claims, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errBadSignature
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(claims)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	c := &Caller{}
+	if err = json.Unmarshal(buf, c); err != nil {
+		return nil, errBadSignature
+	}
+
+	a.RLock()
+	key, ok := a.trusted[c.Service]
+	if !ok {
+		key = a.key
+	}
+	a.RUnlock()
+
+	if key == nil {
+		return nil, errUnknownIdentity
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, digest(key, claims, channel, method, binding)) {
+		return nil, errBadSignature
+	}
+
+	now := box.TimeNowMs()
+	skew := uint64(IdentityMaxSkew * 1000)
+	if c.Time+skew < now || c.Time > now+skew {
+		return nil, errStaleIdentity
+	}
+
+	if !a.accept(c, now+2*skew) {
+		return nil, errReplayed
+	}
+
+	return c, nil
+}
+
+// accept remembers the nonce of the identity until the expiry, which
+// is beyond the skew accepted, and returns false if already seen, to
+// reject identities replayed.
+func (a *accessControl) accept(c *Caller, expiry uint64) bool {
+	if len(c.Nonce) == 0 {
+		return false
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	now := box.TimeNowMs()
+	if now-a.pruned > 1000 {
+		a.pruned = now
+		for k, t := range a.nonces {
+			if t < now {
+				delete(a.nonces, k)
+			}
+		}
+	}
+
+	k := c.Service + "/" + c.Nonce
+	if _, ok := a.nonces[k]; ok {
+		return false
+	}
+
+	a.nonces[k] = expiry
+
+	return true
+}
+
+// payloadBinding binds identities of raw calls to the payload.
+func payloadBinding(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// requestBinding binds identities of JSON-RPC calls to the request id
+// and a digest of the params, which are encoded in the same way by
+// callers and callees, after being decoded as generic JSON values.
+func requestBinding(req *jsonrpc2.RPCRequest) string {
+	buf, _ := json.Marshal(req.Params)
+
+	var params any
+	if json.Unmarshal(buf, &params) == nil {
+		buf, _ = json.Marshal(params)
+	}
+
+	return strconv.Itoa(req.ID) + "." + payloadBinding(buf)
+}
+
+// WithIdentity enables signing calls of the service using the key,
+// claiming the given roles. The key also verifies identities of
+// callers having no key trusted, see WithTrustedKeys, which is
+// enough when all services share the same key.
+//
+// Identities are bound to the raw payload, or to the id and params of
+// JSON-RPC requests, and are accepted once within IdentityMaxSkew.
+func WithIdentity(key []byte, roles ...string) Option {
+	return func(s *MetaService) {
+		s.acl.key = key
+		s.acl.roles = roles
+	}
+}
+
+// WithTrustedKeys sets keys to verify identities of callers,
+// keyed by service name.
+func WithTrustedKeys(keys map[string][]byte) Option {
+	return func(s *MetaService) {
+		for name, key := range keys {
+			s.acl.trusted[name] = key
+		}
+	}
+}
+
+// WithAccessRule restricts access to a channel, or a JSON-RPC
+// method routed on it if method is not empty, see SetAccessRule.
+func WithAccessRule(channel, method string, rule *AccessRule) Option {
+	return func(s *MetaService) {
+		s.acl.setRule(channel, method, rule)
+	}
+}
+
+// WithAuditHook sets a hook receiving audit records of denied calls,
+// which are also logged and counted in MetricAccessDenied.
+func WithAuditHook(fn func(*AccessDenial)) Option {
+	return func(s *MetaService) {
+		s.acl.audit = fn
+	}
+}
+
+// SetAccessRule restricts access to a channel exposed by the service,
+// or to a JSON-RPC method routed on it if method is not empty, to
+// callers allowed by the rule. Rules of methods override the rule of
+// their channel, and the rule is removed if nil.
+//
+// Calls to channels or methods having no rule are not restricted.
+// Denied JSON-RPC calls get an ErrServerAccessDenied error, while
+// denied raw calls get ErrAccessDenied, see deniedReply.
+func (s *MetaService) SetAccessRule(channel, method string, rule *AccessRule) {
+	s.acl.setRule(channel, method, rule)
+}
+
+// identify returns the verified caller of a raw call, and an error
+// if the call is rejected by the rule of the channel. Channels routed
+// by the JSON-RPC router are authorized by authorizeRequest instead.
+func (s *MetaService) identify(channel string, meta map[string]string, data []byte) (*Caller, error) {
+	caller, err := s.acl.verify(meta[IdentityHeader], channel, "", payloadBinding(data))
+
+	var rule *AccessRule
+	if s.exposer.Router().Channel(channel) == nil {
+		rule = s.acl.rule(channel, "")
+	}
+
+	return caller, s.authorize(rule, channel, "", caller, err)
+}
+
+// deniedReply returns the reply to a raw call denied by access rules,
+// which is replied, instead of failing the handler, for callers over
+// NATS not to time out, and is turned into ErrAccessDenied by callers,
+// see openReply.
+func deniedReply(channel string) []byte {
+	return sealEnvelope(map[string]string{deniedHeader: channel}, nil)
+}
+
+// authorize checks the caller, or the error of its identity, against
+// the rule, and audits the denial if any.
+func (s *MetaService) authorize(rule *AccessRule, channel, method string, caller *Caller, err error) error {
+	if err != nil && !errors.Is(err, errNoIdentity) {
+		log.Debugf("%s ignore identity of call to %s: %v", s.Name(), ruleKey(channel, method), err)
+	}
+
+	if rule == nil {
+		return nil
+	}
+
+	d := &AccessDenial{
+		Service: s.name,
+		Channel: channel,
+		Method:  method,
+		Time:    box.TimeNowMs(),
+	}
+
+	switch {
+	case err != nil:
+		d.Reason = err.Error()
+	case !rule.allows(caller):
+		d.Reason = "not allowed"
+	default:
+		return nil
+	}
+
+	if caller != nil {
+		d.Caller = caller.Service
+		d.Instance = caller.Instance
+	}
+
+	s.auditDenial(d)
+
+	return ErrAccessDenied
+}
+
+func (s *MetaService) auditDenial(d *AccessDenial) {
+	buf, _ := json.Marshal(d)
+	log.Warnf("audit: access denied: %s", buf)
+	accessDeniedTotal.Inc(d.Service, d.Channel, d.Caller)
+
+	s.acl.RLock()
+	audit := s.acl.audit
+	s.acl.RUnlock()
+
+	if audit != nil {
+		audit(d)
+	}
+}
+
+// signCall is a jsonrpc2.CallHook adding the signed identity of the
+// service to requests, bound to the method, the request id and params.
+func (s *MetaService) signCall(_ context.Context, channel string, req *jsonrpc2.RPCRequest) func(*jsonrpc2.RPCResponse, error) {
+	if s.acl.signing() {
+		c := &Caller{Service: s.name, Instance: s.instance, Time: box.TimeNowMs()}
+		req.SetMeta(IdentityHeader, s.acl.sign(c, channel, req.Method, requestBinding(req)))
+	}
+
+	return nil
+}
+
+// resignRequest returns the encoded JSON-RPC request with a new signed
+// identity, for retries not to be rejected as replayed, or data as is
+// if not signing or not a request.
+func (s *MetaService) resignRequest(channel string, data []byte) []byte {
+	if !s.acl.signing() {
+		return data
+	}
+
+	req, rpcErr := jsonrpc2.ParseRequest(data)
+	if rpcErr != nil || len(req.Meta[IdentityHeader]) == 0 {
+		return data
+	}
+
+	s.signCall(context.Background(), channel, req)
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return data
+	}
+
+	return buf
+}
+
+// signPayload returns the signed identity of the service bound to the
+// raw payload sent to the channel, or an empty string if not signing.
+func (s *MetaService) signPayload(channel string, data []byte) string {
+	if !s.acl.signing() {
+		return ""
+	}
+
+	c := &Caller{Service: s.name, Instance: s.instance, Time: box.TimeNowMs()}
+	return s.acl.sign(c, channel, "", payloadBinding(data))
+}
+
+// authorizeRequest is a jsonrpc2.Authorizer enforcing access rules
+// of JSON-RPC methods, which passes the verified caller to handlers.
+func (s *MetaService) authorizeRequest(channel string, req *jsonrpc2.RPCRequest) (context.Context, *jsonrpc2.RPCResponse) {
+	caller, err := s.acl.verify(req.Meta[IdentityHeader], channel, req.Method, requestBinding(req))
+	if err = s.authorize(s.acl.rule(channel, req.Method), channel, req.Method, caller, err); err != nil {
+		rsp := jsonrpc2.NewErrorResponse(jsonrpc2.ErrServerAccessDenied,
+			fmt.Sprintf("%s: %s#%s", jsonrpc2.ErrCodeString[jsonrpc2.ErrServerAccessDenied], channel, req.Method))
+		rsp.ID = req.ID
+		return nil, rsp
+	}
+
+	if caller == nil {
+		return nil, nil
+	}
+
+	return contextWithCaller(req.Context(), caller), nil
+}
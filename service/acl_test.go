@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"testing"
+	"time"
+)
+
+func TestIdentityVerify(t *testing.T) {
+	signer := newAccessControl()
+	signer.key = []byte("key-of-a")
+	signer.roles = []string{"ops"}
+
+	verifier := newAccessControl()
+	verifier.trusted["a"] = []byte("key-of-a")
+
+	token := signer.sign(&Caller{Service: "a", Instance: "1", Time: box.TimeNowMs()}, "/ch", "m", "b")
+	c, err := verifier.verify(token, "/ch", "m", "b")
+	require.Nil(t, err)
+	assert.Equal(t, "a", c.Service)
+	assert.True(t, c.HasRole("ops"))
+
+	// bound to the target and the binding
+	_, err = verifier.verify(token, "/ch", "other", "b")
+	assert.Equal(t, errBadSignature, err)
+	_, err = verifier.verify(token, "/ch", "m", "tampered")
+	assert.Equal(t, errBadSignature, err)
+
+	// accepted once
+	_, err = verifier.verify(token, "/ch", "m", "b")
+	assert.Equal(t, errReplayed, err)
+
+	_, err = verifier.verify("", "/ch", "m", "b")
+	assert.Equal(t, errNoIdentity, err)
+	_, err = verifier.verify("garbage", "/ch", "m", "b")
+	assert.Equal(t, errBadSignature, err)
+
+	// claiming a service signed with another key
+	token = signer.sign(&Caller{Service: "b", Time: box.TimeNowMs()}, "/ch", "m", "b")
+	_, err = verifier.verify(token, "/ch", "m", "b")
+	assert.Equal(t, errUnknownIdentity, err)
+
+	token = signer.sign(&Caller{Service: "a", Time: box.TimeNowMs() - 2*IdentityMaxSkew*1000}, "/ch", "m", "b")
+	_, err = verifier.verify(token, "/ch", "m", "b")
+	assert.Equal(t, errStaleIdentity, err)
+}
+
+func TestAccessRule(t *testing.T) {
+	s := newInProcService(t, "acl")
+
+	var denials []*AccessDenial
+	WithAuditHook(func(d *AccessDenial) { denials = append(denials, d) })(s)
+
+	echo := NewMethod[echoReq, echoRsp]("/acl/rpc", "echo")
+	echo.ExposeContext(s, func(ctx context.Context, req *echoReq) (*echoRsp, error) {
+		rsp := &echoRsp{Text: req.Text}
+		if c := CallerFromContext(ctx); c != nil {
+			rsp.Text = c.Service
+		}
+		return rsp, nil
+	})
+	open := NewMethod[echoReq, echoRsp]("/acl/rpc", "open")
+	open.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		return &echoRsp{Text: req.Text}, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+
+	require.Nil(t, s.ExposeMethod("/acl/raw", func(data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	s.SetAccessRule("/acl/rpc", "echo", &AccessRule{Roles: []string{"ops"}})
+	s.SetAccessRule("/acl/raw", "", &AccessRule{Services: []string{"acl"}})
+
+	// anonymous callers are denied
+	_, err := echo.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	var rpcErr *jsonrpc2.RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, jsonrpc2.ErrServerAccessDenied, rpcErr.Code)
+
+	_, err = s.CallMethod("/acl/raw", []byte("hi"), time.Second)
+	assert.True(t, errors.Is(err, ErrAccessDenied))
+	assert.ErrorContains(t, err, "/acl/raw")
+
+	rsp, err := open.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "hi", rsp.Text)
+
+	require.Len(t, denials, 2)
+	assert.Equal(t, "echo", denials[0].Method)
+	assert.Equal(t, errNoIdentity.Error(), denials[0].Reason)
+	assert.Equal(t, "/acl/raw", denials[1].Channel)
+
+	// signed without the role required
+	WithIdentity([]byte("secret"))(s)
+	_, err = echo.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	assert.NotNil(t, err)
+	require.Len(t, denials, 3)
+	assert.Equal(t, "acl", denials[2].Caller)
+	assert.Equal(t, "not allowed", denials[2].Reason)
+
+	data, err := s.CallMethod("/acl/raw", []byte("hi"), time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("hi"), data)
+
+	// handlers get the verified caller
+	WithIdentity([]byte("secret"), "ops")(s)
+	rsp, err = echo.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "acl", rsp.Text)
+
+	// method rules override the channel rule
+	s.SetAccessRule("/acl/rpc", "", &AccessRule{})
+	_, err = open.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	assert.NotNil(t, err)
+	_, err = echo.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, denials, 4)
+
+	// identities of requests are bound to params, and renewed on retries
+	req := jsonrpc2.NewRequest(7, "echo", &echoReq{Text: "hi"})
+	s.signCall(context.Background(), "/acl/rpc", req)
+	buf, err := json.Marshal(req)
+	require.Nil(t, err)
+	parsed, _ := jsonrpc2.ParseRequest(buf)
+	assert.Equal(t, requestBinding(req), requestBinding(parsed))
+	assert.NotEqual(t, requestBinding(req), requestBinding(jsonrpc2.NewRequest(7, "echo", &echoReq{Text: "ho"})))
+
+	resigned, _ := jsonrpc2.ParseRequest(s.resignRequest("/acl/rpc", buf))
+	assert.NotEqual(t, parsed.Meta[IdentityHeader], resigned.Meta[IdentityHeader])
+	for _, r := range []*jsonrpc2.RPCRequest{parsed, resigned} {
+		_, rsp := s.authorizeRequest("/acl/rpc", r)
+		assert.Nil(t, rsp)
+	}
+	_, denied := s.authorizeRequest("/acl/rpc", parsed)
+	assert.NotNil(t, denied)
+	assert.Equal(t, errReplayed.Error(), denials[4].Reason)
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/metrics"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AdminShutdownTimeout defines the time to wait for
+	// in-flight requests when the admin server stops.
+	AdminShutdownTimeout = 2 //seconds
+)
+
+// AdminServer provides an HTTP server exposing
+// operational endpoints, e.g. health probes.
+type AdminServer struct {
+	sync.Mutex
+	addr     string
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewAdminServer creates an admin server listening on addr,
+// in format host:port. Use port 0 to pick a random port.
+func NewAdminServer(addr string) *AdminServer {
+	return &AdminServer{
+		addr: addr,
+		mux:  http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the given pattern.
+// See http.ServeMux for the pattern syntax.
+func (a *AdminServer) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (a *AdminServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	a.mux.HandleFunc(pattern, handler)
+}
+
+// Addr returns the address actually listened on,
+// or the configured one if not started.
+func (a *AdminServer) Addr() string {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.listener != nil {
+		return a.listener.Addr().String()
+	}
+
+	return a.addr
+}
+
+// Start listens and serves in another goroutine.
+func (a *AdminServer) Start() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.server != nil {
+		return errors.New("admin server already started")
+	}
+
+	l, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		log.Errorf("admin server listen on %s failed: %v", a.addr, err)
+		return err
+	}
+
+	a.listener = l
+	a.server = &http.Server{Handler: a.mux}
+
+	go func(srv *http.Server) {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorln("admin server quit:", err)
+		}
+	}(a.server)
+
+	log.Infof("admin server listening on %s", l.Addr())
+
+	return nil
+}
+
+// Stop shuts down the server gracefully.
+func (a *AdminServer) Stop() {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AdminShutdownTimeout*time.Second)
+	defer cancel()
+
+	if err := a.server.Shutdown(ctx); err != nil {
+		log.Warnln("admin server shutdown:", err)
+	}
+
+	a.server = nil
+	a.listener = nil
+
+	log.Infoln("admin server stopped")
+}
+
+// writeJSON writes v as the JSON body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnln("admin server write response failed:", err)
+	}
+}
+
+// probeResult defines the body of probe endpoints.
+type probeResult struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+	Detail  any      `json:"detail,omitempty"`
+}
+
+func writeProbe(w http.ResponseWriter, ok bool, detail any, reasons ...string) {
+	if ok {
+		writeJSON(w, http.StatusOK, &probeResult{Status: "ok", Detail: detail})
+	} else {
+		writeJSON(w, http.StatusServiceUnavailable, &probeResult{Status: "fail", Reasons: reasons, Detail: detail})
+	}
+}
+
+// mountProbes binds /healthz, /readyz, /status and /metrics
+// of a service to the admin server.
+func (s *MetaService) mountProbes(a *AdminServer) {
+	a.Handle("/metrics", metrics.Default.Handler())
+
+	a.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := s.Health()
+		state := s.State()
+		alive := report.Live && state != Offline && state != Stopped
+		writeProbe(w, alive, report, "state "+state.String())
+	})
+
+	a.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := s.Health()
+		ready := s.State() == Servicing && s.Ready()
+		writeProbe(w, ready, report, "state "+s.State().String())
+	})
+
+	a.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(s.MarshalStatus())
+	})
+}
+
+// mountRegistry binds /healthz, /readyz, /services,
+// /services/{name}, /leases and /metrics of the monitor to the admin server.
+//
+// /readyz accepts an optional query parameter, services, which is
+// a comma-separated list of service names that must be servicing.
+//
+// /services accepts optional query parameters, tags, a comma-separated
+// list of tags, and method, see QueryStatusListReq.
+func (m *Monitor) mountRegistry(a *AdminServer) {
+	a.Handle("/metrics", metrics.Default.Handler())
+	a.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		state := m.registry.State()
+		writeProbe(w, state != Offline && state != Stopped, nil, "state "+state.String())
+	})
+
+	a.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if m.registry.State() != Servicing {
+			writeProbe(w, false, nil, "registry not servicing")
+			return
+		}
+
+		var observed []string
+		if q := r.URL.Query().Get("services"); len(q) != 0 {
+			observed = strings.Split(q, ",")
+		}
+
+		if missing := m.GetNotServicing(observed); len(missing) != 0 {
+			writeProbe(w, false, nil, missing...)
+			return
+		}
+
+		writeProbe(w, true, nil)
+	})
+
+	a.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		filter := &QueryStatusListReq{Method: r.URL.Query().Get("method")}
+		if q := r.URL.Query().Get("tags"); len(q) != 0 {
+			filter.Tags = strings.Split(q, ",")
+		}
+
+		writeJSON(w, http.StatusOK, &StatusList{Services: m.Query(filter)})
+	})
+
+	a.HandleFunc("/services/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/services/")
+		instances := m.GetInstances(name)
+		if len(name) == 0 || len(instances) == 0 {
+			writeJSON(w, http.StatusNotFound, &probeResult{Status: "fail", Reasons: []string{"service not found"}})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &StatusList{Services: instances})
+	})
+
+	a.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.registry.Leases())
+	})
+}
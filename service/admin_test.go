@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveAdmin(a *AdminServer, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestRegistryAdminEndpoints(t *testing.T) {
+	m := &RegistryManager{MetaService: newInProcService(t, Registry)}
+	WithAdminEndpoint("127.0.0.1:0")(m)
+
+	m.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"ready":true}`))
+	m.handleStatus([]byte(`{"name":"svc","instance":"b","state":1}`))
+	m.handleStatus([]byte(`{"name":"other","state":1}`))
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveAdmin(m.admin, "/readyz").Code)
+
+	m.SetState(Servicing)
+	assert.Equal(t, http.StatusOK, serveAdmin(m.admin, "/healthz").Code)
+	assert.Equal(t, http.StatusOK, serveAdmin(m.admin, "/readyz?services=svc").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serveAdmin(m.admin, "/readyz?services=svc,other").Code)
+
+	var list StatusList
+	rec := serveAdmin(m.admin, "/services")
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Services, 3)
+
+	rec = serveAdmin(m.admin, "/services/svc")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list.Services, 2)
+
+	assert.Equal(t, http.StatusNotFound, serveAdmin(m.admin, "/services/none").Code)
+
+	liveRegistries.Store(m, m)
+	defer liveRegistries.Delete(m)
+	rec = serveAdmin(m.admin, "/metrics")
+	assert.Contains(t, rec.Body.String(), `pareto_registry_services{state="servicing"} 1`)
+	assert.Contains(t, rec.Body.String(), `pareto_registry_status_reports_total{service="svc"} 2`)
+}
+
+func TestServiceProbeEndpoints(t *testing.T) {
+	s := newInProcService(t, "probed")
+	WithProbeEndpoint("127.0.0.1:0")(s)
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveAdmin(s.admin, "/healthz").Code)
+
+	s.SetState(Servicing)
+	assert.Equal(t, http.StatusOK, serveAdmin(s.admin, "/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serveAdmin(s.admin, "/readyz").Code)
+
+	s.SetReady(true)
+	assert.Equal(t, http.StatusOK, serveAdmin(s.admin, "/readyz").Code)
+
+	require.Nil(t, s.admin.Start())
+	defer s.admin.Stop()
+
+	rsp, err := http.Get("http://" + s.admin.Addr() + "/status")
+	require.Nil(t, err)
+	defer rsp.Body.Close()
+
+	var status Status
+	require.Nil(t, json.NewDecoder(rsp.Body).Decode(&status))
+	assert.Equal(t, "probed", status.Name)
+}
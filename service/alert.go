@@ -0,0 +1,528 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/box/meta"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EndpointServiceAlert is bound as a PS endpoint publishing
+// alert firing and resolution events.
+const EndpointServiceAlert = "/registry-center/service/alert"
+
+const AlertEvaluateInterval = 5 //seconds
+
+// AlertState defines the state of an alert.
+type AlertState string
+
+const (
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert types supported by AlertRuleConf.
+const (
+	AlertNotServicing      = "not_servicing"
+	AlertOfflineCount      = "offline_count"
+	AlertReadinessFlapping = "readiness_flapping"
+)
+
+// Alert defines an alert event sent to notifiers.
+type Alert struct {
+	Rule     string     `json:"rule"`               //name of the rule
+	Subject  string     `json:"subject"`            //violating subject, e.g. a service name
+	State    AlertState `json:"state"`              //firing or resolved
+	Severity string     `json:"severity,omitempty"` //severity defined by the rule
+	Message  string     `json:"message"`            //human-readable detail
+	Since    uint64     `json:"since"`              //timestamp in ms when violation began
+	Time     uint64     `json:"time"`               //timestamp in ms of the event
+}
+
+// Violation defines a subject breaking a rule.
+type Violation struct {
+	Subject string
+	Message string
+}
+
+// AlertRule defines a condition evaluated periodically.
+type AlertRule interface {
+	// Name returns the unique name of the rule.
+	Name() string
+
+	// Severity returns the severity attached to alerts.
+	Severity() string
+
+	// For returns how long a violation must last before firing.
+	For() time.Duration
+
+	// Evaluate returns subjects violating the rule at the moment.
+	Evaluate(m *Monitor) []Violation
+}
+
+// changeObserver is implemented by rules needing
+// status change events of services.
+type changeObserver interface {
+	observe(old, new *Status)
+}
+
+// AlertRuleConf defines an alert rule declaratively.
+type AlertRuleConf struct {
+	//Name of the rule, mandatory and unique.
+	Name string `json:"name"`
+
+	//Type of the rule, one of not_servicing,
+	//offline_count and readiness_flapping.
+	Type string `json:"type"`
+
+	//Service observed, used by not_servicing and readiness_flapping.
+	//readiness_flapping observes all services if empty.
+	Service string `json:"service,omitempty"`
+
+	//Domain observed, used by offline_count.
+	Domain int `json:"domain,omitempty"`
+
+	//Threshold is the max number of offline instances for offline_count,
+	//or the number of readiness changes within Window for readiness_flapping.
+	Threshold int `json:"threshold,omitempty"`
+
+	//Window, in seconds, used by readiness_flapping.
+	Window uint32 `json:"window,omitempty"`
+
+	//For, in seconds, defines how long a violation must last before firing.
+	For uint32 `json:"for,omitempty"`
+
+	//Severity attached to alerts, e.g. warning or critical.
+	Severity string `json:"severity,omitempty"`
+}
+
+// NewAlertRule creates a rule from its declaration.
+func NewAlertRule(conf *AlertRuleConf) (AlertRule, error) {
+	if len(conf.Name) == 0 {
+		return nil, errors.New("alert rule name must not be empty")
+	}
+
+	base := ruleBase{
+		name:     conf.Name,
+		severity: conf.Severity,
+		duration: time.Duration(conf.For) * time.Second,
+	}
+
+	switch conf.Type {
+	case AlertNotServicing:
+		if len(conf.Service) == 0 {
+			return nil, fmt.Errorf("alert rule %s: service must not be empty", conf.Name)
+		}
+
+		return &notServicingRule{ruleBase: base, service: conf.Service}, nil
+	case AlertOfflineCount:
+		return &offlineCountRule{ruleBase: base, domain: conf.Domain, max: conf.Threshold}, nil
+	case AlertReadinessFlapping:
+		if conf.Threshold <= 0 || conf.Window == 0 {
+			return nil, fmt.Errorf("alert rule %s: threshold and window must be positive", conf.Name)
+		}
+
+		return &flappingRule{
+			ruleBase: base,
+			service:  conf.Service,
+			changes:  conf.Threshold,
+			window:   time.Duration(conf.Window) * time.Second,
+			history:  make(map[string][]time.Time),
+		}, nil
+	default:
+		return nil, fmt.Errorf("alert rule %s: unknown type %s", conf.Name, conf.Type)
+	}
+}
+
+type ruleBase struct {
+	name     string
+	severity string
+	duration time.Duration
+}
+
+func (r *ruleBase) Name() string       { return r.name }
+func (r *ruleBase) Severity() string   { return r.severity }
+func (r *ruleBase) For() time.Duration { return r.duration }
+
+// notServicingRule fires when a service has no servicing instance.
+type notServicingRule struct {
+	ruleBase
+	service string
+}
+
+func (r *notServicingRule) Evaluate(m *Monitor) []Violation {
+	if len(m.GetNotServicing([]string{r.service})) == 0 {
+		return nil
+	}
+
+	return []Violation{{Subject: r.service, Message: fmt.Sprintf("service %s is not servicing", r.service)}}
+}
+
+// offlineCountRule fires when more than max instances
+// of a domain are offline.
+type offlineCountRule struct {
+	ruleBase
+	domain int
+	max    int
+}
+
+func (r *offlineCountRule) Evaluate(m *Monitor) []Violation {
+	var offline []string
+	for _, s := range m.GetStatusList().Services {
+		if s.Domain == r.domain && s.State == Offline {
+			offline = append(offline, s.Name+InstanceSeparator+s.InstanceId())
+		}
+	}
+
+	if len(offline) <= r.max {
+		return nil
+	}
+
+	sort.Strings(offline)
+	return []Violation{{
+		Subject: fmt.Sprintf("domain %d", r.domain),
+		Message: fmt.Sprintf("%d service instances offline in domain %d: %v", len(offline), r.domain, offline),
+	}}
+}
+
+// flappingRule fires when readiness of a service changes
+// at least the given times within the window.
+type flappingRule struct {
+	ruleBase
+	sync.Mutex
+	service string
+	changes int
+	window  time.Duration
+	history map[string][]time.Time //service -> readiness change time
+}
+
+func (r *flappingRule) observe(old, new *Status) {
+	if old.Ready == new.Ready {
+		return
+	}
+
+	if len(r.service) != 0 && r.service != new.Name {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.history[new.Name] = append(r.history[new.Name], time.Now())
+}
+
+func (r *flappingRule) Evaluate(m *Monitor) []Violation {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []Violation
+	begin := time.Now().Add(-r.window)
+	for name, changes := range r.history {
+		var recent []time.Time
+		for _, t := range changes {
+			if t.After(begin) {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(r.history, name)
+			continue
+		}
+
+		r.history[name] = recent
+		if len(recent) >= r.changes {
+			result = append(result, Violation{
+				Subject: name,
+				Message: fmt.Sprintf("readiness of service %s changed %d times in %v", name, len(recent), r.window),
+			})
+		}
+	}
+
+	return result
+}
+
+// AlertNotifier delivers alert events.
+type AlertNotifier interface {
+	Notify(alert *Alert) error
+}
+
+// LogNotifier writes alert events to the log.
+type LogNotifier struct{}
+
+func (n *LogNotifier) Notify(alert *Alert) error {
+	if alert.State == AlertFiring {
+		log.Warnf("alert %s firing on %s: %s", alert.Rule, alert.Subject, alert.Message)
+	} else {
+		log.Infof("alert %s resolved on %s", alert.Rule, alert.Subject)
+	}
+
+	return nil
+}
+
+// BusNotifier publishes alert events, in JSON, on a bus topic.
+type BusNotifier struct {
+	service Service
+	topic   string
+}
+
+// NewBusNotifier creates a notifier publishing through the given
+// service on topic, or EndpointServiceAlert if topic is empty.
+func NewBusNotifier(s Service, topic string) *BusNotifier {
+	if len(topic) == 0 {
+		topic = EndpointServiceAlert
+	}
+
+	return &BusNotifier{service: s, topic: topic}
+}
+
+func (n *BusNotifier) Notify(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	return n.service.Notify(n.topic, data)
+}
+
+// WebhookNotifier posts alert events, in JSON, to an HTTP endpoint.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url with the given timeout.
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (n *WebhookNotifier) Notify(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	_ = rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook %s responded %s", n.url, rsp.Status)
+	}
+
+	return nil
+}
+
+// Alerter evaluates alert rules on a loop and sends de-duplicated
+// firing and resolution events to notifiers.
+type Alerter struct {
+	sync.Mutex
+	monitor   *Monitor
+	rules     []AlertRule
+	notifiers []AlertNotifier
+	loop      meta.Loop
+
+	pending map[string]time.Time //rule|subject -> violation began
+	active  map[string]*Alert    //rule|subject -> firing alert
+}
+
+// NewAlerter creates an alerter evaluating rules against the monitor.
+func NewAlerter(m *Monitor) *Alerter {
+	a := &Alerter{
+		monitor: m,
+		pending: make(map[string]time.Time),
+		active:  make(map[string]*Alert),
+	}
+
+	m.registry.observe(a.observe)
+
+	return a
+}
+
+// AddRule adds a rule, replacing the one with the same name.
+func (a *Alerter) AddRule(rule AlertRule) {
+	a.Lock()
+	defer a.Unlock()
+
+	for i, r := range a.rules {
+		if r.Name() == rule.Name() {
+			a.rules[i] = rule
+			return
+		}
+	}
+
+	a.rules = append(a.rules, rule)
+}
+
+// AddRules adds rules from declarations.
+func (a *Alerter) AddRules(confs []*AlertRuleConf) error {
+	for _, conf := range confs {
+		rule, err := NewAlertRule(conf)
+		if err != nil {
+			return err
+		}
+
+		a.AddRule(rule)
+	}
+
+	return nil
+}
+
+// AddNotifier adds a notifier.
+func (a *Alerter) AddNotifier(n AlertNotifier) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.notifiers = append(a.notifiers, n)
+}
+
+// Active returns alerts currently firing.
+func (a *Alerter) Active() []*Alert {
+	a.Lock()
+	defer a.Unlock()
+
+	var list []*Alert
+	for _, alert := range a.active {
+		cp := *alert
+		list = append(list, &cp)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Rule+list[i].Subject < list[j].Rule+list[j].Subject
+	})
+
+	return list
+}
+
+// Start evaluates rules every interval, 5s if interval is 0.
+func (a *Alerter) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = AlertEvaluateInterval * time.Second
+	}
+
+	a.loop = meta.NewLoop("alerter", meta.LoopConfig{
+		Tick: uint32(interval.Milliseconds()),
+	})
+
+	a.loop.Run(meta.LoopRunHook{
+		Working: func() error {
+			a.evaluate()
+			return nil
+		},
+	})
+}
+
+// Stop stops the evaluation loop.
+func (a *Alerter) Stop() {
+	if a.loop != nil {
+		a.loop.Stop()
+		a.loop = nil
+	}
+}
+
+func (a *Alerter) observe(old, new *Status) {
+	a.Lock()
+	rules := append([]AlertRule{}, a.rules...)
+	a.Unlock()
+
+	for _, rule := range rules {
+		if o, ok := rule.(changeObserver); ok {
+			o.observe(old, new)
+		}
+	}
+}
+
+// evaluate runs all rules once and emits events.
+func (a *Alerter) evaluate() {
+	a.Lock()
+	rules := append([]AlertRule{}, a.rules...)
+	a.Unlock()
+
+	type violation struct {
+		rule AlertRule
+		Violation
+	}
+
+	current := make(map[string]violation)
+	for _, rule := range rules {
+		for _, v := range rule.Evaluate(a.monitor) {
+			current[rule.Name()+"|"+v.Subject] = violation{rule: rule, Violation: v}
+		}
+	}
+
+	var events []*Alert
+
+	a.Lock()
+	now := time.Now()
+	for key, v := range current {
+		if alert, ok := a.active[key]; ok {
+			alert.Message = v.Message
+			continue
+		}
+
+		since, ok := a.pending[key]
+		if !ok {
+			since = now
+			a.pending[key] = since
+		}
+
+		if now.Sub(since) < v.rule.For() {
+			continue
+		}
+
+		alert := &Alert{
+			Rule:     v.rule.Name(),
+			Subject:  v.Subject,
+			State:    AlertFiring,
+			Severity: v.rule.Severity(),
+			Message:  v.Message,
+			Since:    uint64(since.UnixMilli()),
+			Time:     box.TimeNowMs(),
+		}
+
+		a.active[key] = alert
+		delete(a.pending, key)
+
+		cp := *alert
+		events = append(events, &cp)
+	}
+
+	for key := range a.pending {
+		if _, ok := current[key]; !ok {
+			delete(a.pending, key)
+		}
+	}
+
+	for key, alert := range a.active {
+		if _, ok := current[key]; ok {
+			continue
+		}
+
+		delete(a.active, key)
+
+		resolved := *alert
+		resolved.State = AlertResolved
+		resolved.Time = box.TimeNowMs()
+		events = append(events, &resolved)
+	}
+
+	notifiers := append([]AlertNotifier{}, a.notifiers...)
+	a.Unlock()
+
+	for _, event := range events {
+		for _, n := range notifiers {
+			if err := n.Notify(event); err != nil {
+				log.Warnf("notify alert %s on %s failed: %v", event.Rule, event.Subject, err)
+			}
+		}
+	}
+}
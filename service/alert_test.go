@@ -0,0 +1,73 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+type captureNotifier struct {
+	sync.Mutex
+	alerts []*Alert
+}
+
+func (c *captureNotifier) Notify(alert *Alert) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.alerts = append(c.alerts, alert)
+	return nil
+}
+
+func (c *captureNotifier) take() []*Alert {
+	c.Lock()
+	defer c.Unlock()
+
+	alerts := c.alerts
+	c.alerts = nil
+	return alerts
+}
+
+func TestAlerter(t *testing.T) {
+	m := &Monitor{registry: &RegistryManager{MetaService: newInProcService(t, Registry)}}
+	a := NewAlerter(m)
+
+	capture := &captureNotifier{}
+	a.AddNotifier(capture)
+	a.AddNotifier(&LogNotifier{})
+	require.Nil(t, a.AddRules([]*AlertRuleConf{
+		{Name: "svc-down", Type: AlertNotServicing, Service: "svc", Severity: "critical"},
+		{Name: "svc-flapping", Type: AlertReadinessFlapping, Service: "svc", Threshold: 2, Window: 60},
+		{Name: "delayed", Type: AlertNotServicing, Service: "svc", For: 60},
+	}))
+	_, err := NewAlertRule(&AlertRuleConf{Name: "bad", Type: "unknown"})
+	assert.NotNil(t, err)
+
+	m.registry.handleStatus([]byte(`{"name":"svc","instance":"a","state":1}`))
+	a.evaluate()
+
+	alerts := capture.take()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "svc-down", alerts[0].Rule)
+	assert.Equal(t, AlertFiring, alerts[0].State)
+	assert.Equal(t, "critical", alerts[0].Severity)
+
+	// de-duplicated
+	a.evaluate()
+	assert.Len(t, capture.take(), 0)
+	assert.Len(t, a.Active(), 1)
+
+	m.registry.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"ready":true}`))
+	m.registry.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"ready":false}`))
+	a.evaluate()
+
+	alerts = capture.take()
+	require.Len(t, alerts, 2)
+	states := map[string]AlertState{}
+	for _, alert := range alerts {
+		states[alert.Rule] = alert.State
+	}
+	assert.Equal(t, AlertResolved, states["svc-down"])
+	assert.Equal(t, AlertFiring, states["svc-flapping"])
+}
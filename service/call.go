@@ -0,0 +1,262 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/ipc"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BalancePolicy defines how an instance is picked
+// among healthy instances of a service.
+type BalancePolicy int
+
+const (
+	RoundRobin  BalancePolicy = iota // pick instances in turn
+	LeastRecent                      // pick the instance least recently called
+)
+
+// instanceCacheTTL defines how long the instance list
+// of a service queried from the registry is reused.
+const instanceCacheTTL = StatusReportInterval * time.Second
+
+// ErrNoHealthyInstance is returned when a call targets any
+// healthy instance of a service while none is available.
+var ErrNoHealthyInstance = errors.New("no healthy instance available")
+
+// ErrTimeout is returned when a call is not responded in time.
+var ErrTimeout = ipc.ErrTimeout
+
+// CallOption customizes the behavior of CallMethod.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	service  string        //target service, used by balancing
+	instance string        //target instance
+	policy   BalancePolicy //balance policy
+	domain   int           //target domain
+	scoped   bool          //true if target domain is given
+	version  string        //version range of instances balanced over
+
+	idempotent bool //true if the call is safe to retry
+	unsigned   bool //true if the identity is not sent with the payload
+}
+
+// ToInstance targets the call at the given instance
+// of the service exposing the method.
+func ToInstance(instance string) CallOption {
+	return func(o *callOptions) {
+		o.instance = instance
+	}
+}
+
+// ToAnyInstance targets the call at any healthy instance
+// of the given service, picked using the given policy.
+func ToAnyInstance(service string, policy BalancePolicy) CallOption {
+	return func(o *callOptions) {
+		o.service = service
+		o.policy = policy
+	}
+}
+
+// WithVersion restricts balancing with ToAnyInstance to instances
+// whose version is in the range, e.g. "^1.2" or ">=1.2 <1.5", see
+// VersionRange. Traffic splits of the service apply within the range.
+func WithVersion(versions string) CallOption {
+	return func(o *callOptions) {
+		o.version = versions
+	}
+}
+
+// InDomain targets the call at the given domain, instead of
+// the domain of the caller. Balancing with ToAnyInstance then
+// resolves instances known by the registry of that domain.
+func InDomain(domain int) CallOption {
+	return func(o *callOptions) {
+		o.domain = domain
+		o.scoped = true
+	}
+}
+
+// unsigned sends the payload without identity, for JSON-RPC
+// calls carrying the identity in the request, see signCall.
+func unsigned() CallOption {
+	return func(o *callOptions) {
+		o.unsigned = true
+	}
+}
+
+func newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	return o
+}
+
+type instanceCache struct {
+	list   []*Status
+	split  *TrafficSplit
+	expiry time.Time
+}
+
+// balancer picks instances of services for outgoing calls.
+type balancer struct {
+	sync.Mutex
+	resolver func(domain int, service string) ([]*Status, error)
+	splitter func(domain int, service string) (*TrafficSplit, error) //optional
+
+	cache   map[string]*instanceCache //domain/service -> instances
+	splits  map[string]*TrafficSplit  //domain/service -> last split known
+	cursors map[string]uint64         //domain/service -> round-robin cursor
+	used    map[string]time.Time      //domain/service/instance -> last used
+}
+
+func newBalancer(resolver func(domain int, service string) ([]*Status, error)) *balancer {
+	return &balancer{
+		resolver: resolver,
+		cache:    make(map[string]*instanceCache),
+		splits:   make(map[string]*TrafficSplit),
+		cursors:  make(map[string]uint64),
+		used:     make(map[string]time.Time),
+	}
+}
+
+// pick returns a healthy instance of the service in the domain, whose
+// version is in the range if not nil, and of the version chosen by the
+// traffic split of the service, if any.
+func (b *balancer) pick(domain int, service string, policy BalancePolicy, versions *VersionRange) (*Status, error) {
+	c := b.instances(domain, service)
+	list := healthy(c.list, versions)
+	if len(list) == 0 {
+		// instances may be back, or the list stale, refresh on next pick
+		b.invalidate(domain, service)
+
+		if versions != nil {
+			return nil, fmt.Errorf("service %s of version %s: %w", service, versions, ErrNoHealthyInstance)
+		}
+
+		return nil, fmt.Errorf("service %s: %w", service, ErrNoHealthyInstance)
+	}
+
+	// instances of each version split are balanced in turn on their own
+	k := domainKey(domain, service)
+	if c.split != nil {
+		if group, i := c.split.choose(list); group != nil {
+			list = group
+			k += "#" + strconv.Itoa(i)
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	var chosen *Status
+	switch policy {
+	case LeastRecent:
+		for _, s := range list {
+			if chosen == nil || b.used[b.key(domain, s)].Before(b.used[b.key(domain, chosen)]) {
+				chosen = s
+			}
+		}
+	case RoundRobin:
+		fallthrough
+	default:
+		chosen = list[b.cursors[k]%uint64(len(list))]
+		b.cursors[k]++
+	}
+
+	b.used[b.key(domain, chosen)] = time.Now()
+
+	return chosen, nil
+}
+
+// invalidate expires cached instances of the service, forcing
+// a re-query on next pick, and keeps them as the last known.
+func (b *balancer) invalidate(domain int, service string) {
+	k := domainKey(domain, service)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if c, ok := b.cache[k]; ok {
+		b.cache[k] = &instanceCache{list: c.list, split: c.split}
+	}
+}
+
+// healthy returns healthy instances in the list, whose
+// version is in the range if not nil.
+func healthy(list []*Status, versions *VersionRange) []*Status {
+	var result []*Status
+	for _, s := range list {
+		if s.Healthy() && (versions == nil || versions.Match(s.Version)) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+func (b *balancer) instances(domain int, service string) *instanceCache {
+	k := domainKey(domain, service)
+
+	b.Lock()
+	c, ok := b.cache[k]
+	b.Unlock()
+
+	if ok && time.Now().Before(c.expiry) {
+		return c
+	}
+
+	list, err := b.resolver(domain, service)
+	if err != nil {
+		// keep the last list known, if any, instead of failing
+		// calls until the entry expires, and query again next time
+		log.Warnf("query instances of %s failed, keep the last known: %v", service, err)
+		if ok {
+			return c
+		}
+
+		return &instanceCache{}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].InstanceId() < list[j].InstanceId()
+	})
+
+	c = &instanceCache{list: list, expiry: time.Now().Add(instanceCacheTTL)}
+	if b.splitter != nil && len(list) != 0 {
+		split, err := b.splitter(domain, service)
+		if err != nil {
+			// keep the last split known, instead of sending
+			// all calls to any version while the query fails
+			log.Warnf("query traffic split of %s failed, keep the last known: %v", service, err)
+		}
+
+		b.Lock()
+		if err == nil {
+			b.splits[k] = split
+		}
+		c.split = b.splits[k]
+		b.Unlock()
+	}
+
+	b.Lock()
+	b.cache[k] = c
+	b.Unlock()
+
+	return c
+}
+
+func (b *balancer) key(domain int, s *Status) string {
+	return domainKey(domain, s.Name) + "/" + s.InstanceId()
+}
+
+func domainKey(domain int, service string) string {
+	return strconv.Itoa(domain) + "/" + service
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/ipc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBalancerPick(t *testing.T) {
+	b := newBalancer(func(domain int, service string) ([]*Status, error) {
+		return []*Status{
+			{Name: service, Instance: "c", State: Servicing, Ready: true},
+			{Name: service, Instance: "a", State: Servicing, Ready: true},
+			{Name: service, Instance: "b", State: Starting},
+		}, nil
+	})
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		s, err := b.pick(0, "svc", RoundRobin, nil)
+		assert.Nil(t, err)
+		picked = append(picked, s.InstanceId())
+	}
+	assert.Equal(t, []string{"a", "c", "a", "c"}, picked)
+
+	first, _ := b.pick(0, "svc", LeastRecent, nil)
+	second, _ := b.pick(0, "svc", LeastRecent, nil)
+	assert.NotEqual(t, first, second)
+
+	empty := newBalancer(func(domain int, service string) ([]*Status, error) { return nil, nil })
+	_, err := empty.pick(0, "svc", RoundRobin, nil)
+	assert.ErrorIs(t, err, ErrNoHealthyInstance)
+
+	// the last list known is kept if the query fails, and
+	// refreshed early once no healthy instance is found
+	var failing, ready bool
+	var queries int
+	flaky := newBalancer(func(domain int, service string) ([]*Status, error) {
+		queries++
+		if failing {
+			return nil, errors.New("registry unreachable")
+		}
+		return []*Status{{Name: service, Instance: "a", State: Servicing, Ready: ready}}, nil
+	})
+	_, err = flaky.pick(0, "svc", RoundRobin, nil)
+	assert.ErrorIs(t, err, ErrNoHealthyInstance)
+	ready = true
+	_, err = flaky.pick(0, "svc", RoundRobin, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queries)
+
+	failing = true
+	flaky.invalidate(0, "svc")
+	s, err := flaky.pick(0, "svc", RoundRobin, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "a", s.InstanceId())
+	_, err = flaky.pick(0, "svc", RoundRobin, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, queries)
+}
+
+func TestDomainScoping(t *testing.T) {
+	assert.Equal(t, "/a/b", DomainTopic(0, "/a/b"))
+	assert.Equal(t, "/domain/3/a/b", DomainTopic(3, "/a/b"))
+	assert.Equal(t, "/domain/3/a", DomainTopic(3, "a"))
+
+	m, err := ipc.NewMessager(&ipc.MessagerConf{
+		BusConf: &ipc.BusConf{Name: "domain-bus", Type: ipc.InnerProcBus},
+		RpcConf: &ipc.RPCConf{Name: "domain-rpc", Type: ipc.InnerProcRpc},
+	})
+	require.Nil(t, err)
+
+	alpha := NewMetaService(&Descriptor{Name: "alpha", Domain: 1, Registry: "inproc"}, WithMessager(m))
+	beta := NewMetaService(&Descriptor{Name: "beta", Domain: 2, Registry: "inproc"}, WithMessager(m))
+	require.Equal(t, 1, alpha.Domain())
+
+	require.Nil(t, alpha.ExposeMethod("/echo", func(data []byte) ([]byte, error) { return data, nil }))
+	_, err = beta.CallMethod("/echo", []byte("hi"), time.Second)
+	assert.NotNil(t, err)
+
+	rsp, err := beta.CallMethod("/echo", []byte("hi"), time.Second, InDomain(1), ToInstance(alpha.Instance()))
+	require.Nil(t, err)
+	assert.Equal(t, "hi", string(rsp))
+
+	var received int32
+	require.Nil(t, alpha.Listen("/notice", func(data []byte) { atomic.AddInt32(&received, 1) }))
+	require.Nil(t, beta.Notify("/notice", nil))
+	require.Nil(t, beta.NotifyDomain(1, "/notice", nil))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&received) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+
+	registry := &RegistryManager{domain: 1}
+	registry.handleStatus([]byte(`{"name":"alpha","domain":1,"state":2}`))
+	registry.handleStatus([]byte(`{"name":"beta","domain":2,"state":2}`))
+	assert.True(t, registry.Registered("alpha"))
+	assert.False(t, registry.Registered("beta"))
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"math/rand"
+)
+
+var (
+	setTrafficSplitMethod   = NewMethod[TrafficSplit, TrafficSplitRsp](EndpointServiceInfo, SetTrafficSplit)
+	queryTrafficSplitMethod = NewMethod[TrafficSplitReq, TrafficSplitRsp](EndpointServiceInfo, QueryTrafficSplit)
+)
+
+// VersionWeight routes a share of calls to instances
+// whose version is in the range.
+type VersionWeight struct {
+	Range  string `json:"range"`  //version range, see VersionRange
+	Weight uint32 `json:"weight"` //share of calls, relative to other weights
+}
+
+// TrafficSplit splits calls balanced over instances of a service, see
+// ToAnyInstance, between versions of the service by weight, e.g. to
+// route 5% of calls to a canary release:
+//
+//	{"service": "echo", "weights": [
+//		{"range": "1.4.0-rc.1", "weight": 5},
+//		{"range": "^1.3", "weight": 95}]}
+//
+// An instance belongs to the first range containing its version, and
+// instances in no range, or in ranges of zero weight, are not called,
+// unless none of the instances belongs to any range of weight.
+//
+// Splits are set by operators in the registry, and applied by callers,
+// which refresh them together with the instances of the service.
+type TrafficSplit struct {
+	Service string           `json:"service"`
+	Weights []*VersionWeight `json:"weights,omitempty"` //empty to remove the split
+
+	ranges []*VersionRange //parsed ranges of weights
+}
+
+// compile parses version ranges of the split.
+func (t *TrafficSplit) compile() error {
+	if len(t.Service) == 0 {
+		return errors.New("service of traffic split not specified")
+	}
+
+	t.ranges = make([]*VersionRange, 0, len(t.Weights))
+	for _, w := range t.Weights {
+		r, err := ParseVersionRange(w.Range)
+		if err != nil {
+			return err
+		}
+
+		t.ranges = append(t.ranges, r)
+	}
+
+	return nil
+}
+
+// choose picks a range by weight among those having instances in the
+// list, and returns the instances in it, and the index of it, or nil
+// and -1 if none of the instances belongs to any range of weight.
+func (t *TrafficSplit) choose(list []*Status) ([]*Status, int) {
+	groups := make([][]*Status, len(t.ranges))
+	for _, s := range list {
+		for i, r := range t.ranges {
+			if r.Match(s.Version) {
+				groups[i] = append(groups[i], s)
+				break
+			}
+		}
+	}
+
+	var total uint64
+	for i, g := range groups {
+		if len(g) != 0 {
+			total += uint64(t.Weights[i].Weight)
+		}
+	}
+
+	if total == 0 {
+		return nil, -1
+	}
+
+	n := uint64(rand.Int63n(int64(total)))
+	for i, g := range groups {
+		if len(g) == 0 {
+			continue
+		}
+
+		if w := uint64(t.Weights[i].Weight); n >= w {
+			n -= w
+		} else {
+			return g, i
+		}
+	}
+
+	return nil, -1
+}
+
+// rpcFailure returns the error carried by the
+// response if it's a JSON-RPC error response.
+func rpcFailure(rsp []byte) error {
+	if len(rsp) == 0 || rsp[0] != '{' {
+		return nil
+	}
+
+	r := &jsonrpc2.RPCResponse{}
+	if json.Unmarshal(rsp, r) != nil || len(r.Version) == 0 || r.Error == nil {
+		return nil
+	}
+
+	return r.Error
+}
+
+type TrafficSplitReq struct {
+	Service string `json:"service"`
+}
+
+type TrafficSplitRsp struct {
+	Split *TrafficSplit `json:"split"` //nil if calls are not split
+}
+
+// exposeSplits routes traffic split methods on the info channel of the registry.
+func (s *RegistryManager) exposeSplits() {
+	setTrafficSplitMethod.Expose(s, func(req *TrafficSplit) (*TrafficSplitRsp, error) {
+		if err := s.SetTrafficSplit(req); err != nil {
+			return nil, jsonrpc2.NewErrorWithMsg(jsonrpc2.ErrServerInvalidParameters, err.Error())
+		}
+
+		return &TrafficSplitRsp{Split: s.TrafficSplit(req.Service)}, nil
+	})
+	queryTrafficSplitMethod.Expose(s, func(req *TrafficSplitReq) (*TrafficSplitRsp, error) {
+		return &TrafficSplitRsp{Split: s.TrafficSplit(req.Service)}, nil
+	})
+}
+
+// SetTrafficSplit replaces the traffic split of the service, or
+// removes it if no weights are given. Callers apply the split
+// within StatusReportInterval.
+//
+// Splits are held in memory, and not persisted, i.e. they must be set
+// again once the registry restarts, while callers keep the last split
+// known until the registry answers their queries.
+func (s *RegistryManager) SetTrafficSplit(split *TrafficSplit) error {
+	if err := split.compile(); err != nil {
+		return err
+	}
+
+	if len(split.Weights) == 0 {
+		s.splits.Delete(split.Service)
+		log.Infof("registry manager: traffic split of %s removed", split.Service)
+		return nil
+	}
+
+	s.splits.Store(split.Service, split)
+	log.Infof("registry manager: traffic split of %s set, %s", split.Service, formatWeights(split.Weights))
+
+	return nil
+}
+
+// TrafficSplit returns the traffic split of the service, or nil if not split.
+func (s *RegistryManager) TrafficSplit(service string) *TrafficSplit {
+	if v, ok := s.splits.Load(service); ok {
+		return v.(*TrafficSplit)
+	}
+
+	return nil
+}
+
+func formatWeights(weights []*VersionWeight) string {
+	text := ""
+	for i, w := range weights {
+		if i > 0 {
+			text += ", "
+		}
+
+		text += fmt.Sprintf("%s=%d", w.Range, w.Weight)
+	}
+
+	return text
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"testing"
+	"time"
+)
+
+func TestBalancerVersions(t *testing.T) {
+	b := newBalancer(func(domain int, service string) ([]*Status, error) {
+		return []*Status{
+			{Name: service, Instance: "a", State: Servicing, Ready: true, Version: "1.2.0"},
+			{Name: service, Instance: "b", State: Servicing, Ready: true, Version: "1.3.0"},
+			{Name: service, Instance: "c", State: Servicing, Ready: true, Version: "2.0.0-rc.1"},
+			{Name: service, Instance: "d", State: Starting, Version: "1.3.1"},
+		}, nil
+	})
+
+	pinned, _ := ParseVersionRange("~1.3")
+	for i := 0; i < 3; i++ {
+		s, err := b.pick(0, "svc", RoundRobin, pinned)
+		require.Nil(t, err)
+		assert.Equal(t, "b", s.InstanceId())
+	}
+
+	missing, _ := ParseVersionRange("^3")
+	_, err := b.pick(0, "svc", RoundRobin, missing)
+	assert.ErrorIs(t, err, ErrNoHealthyInstance)
+	assert.ErrorContains(t, err, "^3")
+
+	split := &TrafficSplit{Service: "svc", Weights: []*VersionWeight{
+		{Range: "2.0.0-rc.1", Weight: 1},
+		{Range: "^1", Weight: 3},
+	}}
+	require.Nil(t, split.compile())
+	var failing bool
+	b.splitter = func(domain int, service string) (*TrafficSplit, error) {
+		if failing {
+			return nil, errors.New("registry unreachable")
+		}
+		return split, nil
+	}
+	b.invalidate(0, "svc")
+
+	picked := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		s, err := b.pick(0, "svc", RoundRobin, nil)
+		require.Nil(t, err)
+		picked[s.InstanceId()]++
+	}
+	assert.InDelta(t, 1000, picked["c"], 200)
+	assert.InDelta(t, 1500, picked["a"], 200)
+	assert.InDelta(t, 1500, picked["b"], 200)
+
+	// the last split known is kept if the query fails
+	failing = true
+	b.invalidate(0, "svc")
+	assert.Same(t, split, b.instances(0, "svc").split)
+	failing = false
+
+	// ranges without instances in the pinned versions are skipped
+	for i := 0; i < 10; i++ {
+		s, err := b.pick(0, "svc", RoundRobin, pinned)
+		require.Nil(t, err)
+		assert.Equal(t, "b", s.InstanceId())
+	}
+
+	// instances in no range of weight are called only if no others are
+	split.Weights[1].Weight = 0
+	rc, _ := ParseVersionRange("^1.2")
+	s, err := b.pick(0, "svc", RoundRobin, rc)
+	require.Nil(t, err)
+	assert.NotEqual(t, "c", s.InstanceId())
+	s, err = b.pick(0, "svc", RoundRobin, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "c", s.InstanceId())
+}
+
+func TestRegistryTrafficSplit(t *testing.T) {
+	s := &RegistryManager{
+		MetaService: newInProcService(t, Registry),
+		leases:      newLeaseTable(),
+		timer:       time.AfterFunc(time.Hour, func() {}),
+	}
+	defer s.timer.Stop()
+	s.RpcServer().Router().AddChannel(EndpointServiceInfo,
+		map[string]jsonrpc2.Handler{QueryStatusList: s.handleQueryStatusList})
+	s.exposeSplits()
+	require.Nil(t, s.RpcServer().Serve())
+
+	split, err := s.Registrar().QueryTrafficSplit(s.Domain(), "svc")
+	require.Nil(t, err)
+	assert.Nil(t, split)
+
+	_, err = s.Registrar().SetTrafficSplit(&TrafficSplit{Service: "svc",
+		Weights: []*VersionWeight{{Range: ">=", Weight: 1}}})
+	assert.ErrorContains(t, err, "version range")
+
+	split, err = s.Registrar().SetTrafficSplit(&TrafficSplit{Service: "svc",
+		Weights: []*VersionWeight{{Range: "1.1.0", Weight: 1}, {Range: "^1.0", Weight: 9}}})
+	require.Nil(t, err)
+	require.Len(t, split.Weights, 2)
+
+	split, err = s.Registrar().QueryTrafficSplit(s.Domain(), "svc")
+	require.Nil(t, err)
+	require.NotNil(t, split)
+	assert.Equal(t, "^1.0", split.Weights[1].Range)
+	assert.Len(t, split.ranges, 2)
+
+	_, err = s.Registrar().SetTrafficSplit(&TrafficSplit{Service: "svc"})
+	require.Nil(t, err)
+	assert.Nil(t, s.TrafficSplit("svc"))
+
+	// the registry selects instances by version
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"version":"1.0.3"}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"b","state":2,"version":"1.1.0"}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"c","state":2,"version":"2.0.0"}`))
+	list := s.Registrar().Query(&QueryStatusListReq{Version: "^1.1 || 2"})
+	require.NotNil(t, list)
+	require.Len(t, list.Services, 2)
+	assert.Equal(t, "b", list.Services[0].Instance)
+	assert.Equal(t, "c", list.Services[1].Instance)
+
+	_, err = queryStatusListMethod.Invoke(s, &QueryStatusListReq{Version: "^x.1"}, time.Second)
+	assert.ErrorContains(t, err, "malformed version")
+}
@@ -0,0 +1,423 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CheckpointDir     = "checkpoint" //dir under the working dir holding checkpoint files
+	CheckpointHistory = 3            //number of versions kept for each key
+	CheckpointTimeout = 5            //seconds, to wait for the file lock
+)
+
+// ErrCheckpointNotFound is returned when no checkpoint
+// of the given key, or version, exists.
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// Checkpoint is a versioned snapshot of a piece of service state.
+type Checkpoint struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"` //starts from 1 and increases on each save
+	Time    uint64 `json:"time"`    //timestamp in milliseconds
+	Data    []byte `json:"data"`
+}
+
+// Decode unmarshals data of the checkpoint, saved
+// by MetaService.SaveCheckpoint, into v.
+func (c *Checkpoint) Decode(v any) error {
+	return json.Unmarshal(c.Data, v)
+}
+
+// Recoverable is implemented by services restoring their state from
+// checkpoints when started. Recover is called by Start, after
+// CheckRecovery and before the service turns to Servicing, with the
+// latest checkpoint of each key, which is empty on first start, and
+// may be saved by other instances, see MetaService.Checkpoints.
+//
+// Start fails if Recover returns an error.
+type Recoverable interface {
+	Recover(last map[string]*Checkpoint) error
+}
+
+// CheckpointStore persists checkpoints in a local bbolt file,
+// one bucket per key, keeping the latest CheckpointHistory
+// versions of each key.
+//
+// All methods are goroutine-safe.
+type CheckpointStore struct {
+	path    string
+	history int
+	db      *bolt.DB //nil if opened on each transaction
+}
+
+// OpenCheckpointStore opens, or creates, the checkpoint file at path.
+func OpenCheckpointStore(path string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: CheckpointTimeout * time.Second})
+	if err != nil {
+		log.Errorf("open checkpoint file %s failed: %v", path, err)
+		return nil, err
+	}
+
+	return &CheckpointStore{
+		path:    path,
+		history: CheckpointHistory,
+		db:      db,
+	}, nil
+}
+
+// OpenSharedCheckpointStore opens the checkpoint file at path on each
+// transaction, instead of holding its file lock until closed, so that
+// processes sharing the file wait for each other's transactions only.
+func OpenSharedCheckpointStore(path string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return &CheckpointStore{
+		path:    path,
+		history: CheckpointHistory,
+	}, nil
+}
+
+// Path returns path of the checkpoint file.
+func (c *CheckpointStore) Path() string {
+	return c.path
+}
+
+// Close closes the checkpoint file.
+func (c *CheckpointStore) Close() error {
+	if c.db == nil {
+		return nil
+	}
+
+	return c.db.Close()
+}
+
+// acquire returns the db, which is opened if the store is shared.
+func (c *CheckpointStore) acquire() (*bolt.DB, error) {
+	if c.db != nil {
+		return c.db, nil
+	}
+
+	db, err := bolt.Open(c.path, 0644, &bolt.Options{Timeout: CheckpointTimeout * time.Second})
+	if err != nil {
+		log.Errorf("open checkpoint file %s failed: %v", c.path, err)
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// release closes the db if opened by acquire.
+func (c *CheckpointStore) release(db *bolt.DB) {
+	if c.db != nil {
+		return
+	}
+
+	if err := db.Close(); err != nil {
+		log.Warnf("close checkpoint file %s failed: %v", c.path, err)
+	}
+}
+
+func (c *CheckpointStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := c.acquire()
+	if err != nil {
+		return err
+	}
+
+	defer c.release(db)
+
+	return db.View(fn)
+}
+
+func (c *CheckpointStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := c.acquire()
+	if err != nil {
+		return err
+	}
+
+	defer c.release(db)
+
+	return db.Update(fn)
+}
+
+func versionKey(version uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, version)
+	return k
+}
+
+// Save saves data as a new version of the key, drops
+// versions beyond the history limit, and returns the new version.
+func (c *CheckpointStore) Save(key string, data []byte) (uint64, error) {
+	var version uint64
+	err := c.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return fmt.Errorf("create bucket failed: %v", err)
+		}
+
+		if version, err = b.NextSequence(); err != nil {
+			return fmt.Errorf("next version failed: %v", err)
+		}
+
+		buf, err := json.Marshal(&Checkpoint{
+			Key:     key,
+			Version: version,
+			Time:    box.TimeNowMs(),
+			Data:    data,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = b.Put(versionKey(version), buf); err != nil {
+			return err
+		}
+
+		// versions are in ascending order, drop the oldest ones
+		if version <= uint64(c.history) {
+			return nil
+		}
+
+		oldest := version - uint64(c.history)
+		cur := b.Cursor()
+		for k, _ := cur.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = cur.Next() {
+			if err = cur.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return version, err
+}
+
+// Load returns the latest checkpoint of the key.
+func (c *CheckpointStore) Load(key string) (*Checkpoint, error) {
+	return c.load(key, func(b *bolt.Bucket) []byte {
+		_, v := b.Cursor().Last()
+		return v
+	})
+}
+
+// LoadVersion returns the checkpoint of the key with the given version.
+func (c *CheckpointStore) LoadVersion(key string, version uint64) (*Checkpoint, error) {
+	return c.load(key, func(b *bolt.Bucket) []byte {
+		return b.Get(versionKey(version))
+	})
+}
+
+func (c *CheckpointStore) load(key string, get func(b *bolt.Bucket) []byte) (*Checkpoint, error) {
+	cp := &Checkpoint{}
+	err := c.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(key))
+		if b == nil {
+			return ErrCheckpointNotFound
+		}
+
+		v := get(b)
+		if v == nil {
+			return ErrCheckpointNotFound
+		}
+
+		return json.Unmarshal(v, cp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// Versions returns versions of the key kept, in ascending order.
+func (c *CheckpointStore) Versions(key string) []uint64 {
+	var versions []uint64
+	_ = c.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, _ []byte) error {
+			versions = append(versions, binary.BigEndian.Uint64(k))
+			return nil
+		})
+	})
+
+	return versions
+}
+
+// Keys returns all keys having checkpoints, sorted.
+func (c *CheckpointStore) Keys() []string {
+	var keys []string
+	_ = c.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			keys = append(keys, string(name))
+			return nil
+		})
+	})
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Latest returns the latest checkpoint of each key.
+func (c *CheckpointStore) Latest() map[string]*Checkpoint {
+	last := make(map[string]*Checkpoint)
+	for _, key := range c.Keys() {
+		if cp, err := c.Load(key); err == nil {
+			last[key] = cp
+		}
+	}
+
+	return last
+}
+
+// Delete removes all versions of the key.
+func (c *CheckpointStore) Delete(key string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(key))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// checkpointer manages the checkpoint store of a service,
+// which is opened on first use and closed when the service stops.
+type checkpointer struct {
+	sync.Mutex
+	dir   string
+	name  string
+	store *CheckpointStore
+}
+
+func (c *checkpointer) open() (*CheckpointStore, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.store != nil {
+		return c.store, nil
+	}
+
+	dir := c.dir
+	if len(dir) == 0 {
+		dir = filepath.Join(box.GetWorkingDir(), CheckpointDir)
+	}
+
+	store, err := OpenSharedCheckpointStore(filepath.Join(dir, c.name+".db"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.store = store
+
+	return store, nil
+}
+
+func (c *checkpointer) close() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.store == nil {
+		return
+	}
+
+	if err := c.store.Close(); err != nil {
+		log.Warnf("close checkpoint file %s failed: %v", c.store.Path(), err)
+	}
+
+	c.store = nil
+}
+
+// Checkpoints returns the checkpoint store of the service, which is
+// a bbolt file named after the service under CheckpointDir of the
+// working dir, unless overridden by WithCheckpointDir.
+//
+// Instances of the same service on one host share the file by
+// default, which is opened on each transaction, so instances wait
+// for each other only while a checkpoint is read or written.
+//
+// Checkpoints are thus state shared by the instances, where the
+// latest save of a key wins, and state of each instance should be
+// saved under keys of its own, e.g. suffixed with MetaService.Instance.
+func (s *MetaService) Checkpoints() (*CheckpointStore, error) {
+	return s.checkpoints.open()
+}
+
+// SaveCheckpoint saves v, encoded as JSON, as a new version of the
+// checkpoint of the key, and returns the version.
+func (s *MetaService) SaveCheckpoint(key string, v any) (uint64, error) {
+	store, err := s.Checkpoints()
+	if err != nil {
+		return 0, err
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return store.Save(key, buf)
+}
+
+// LoadCheckpoint decodes the latest checkpoint of the key into v,
+// and returns ErrCheckpointNotFound if there's none.
+func (s *MetaService) LoadCheckpoint(key string, v any) (*Checkpoint, error) {
+	store, err := s.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := store.Load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, cp.Decode(v)
+}
+
+// recoverService calls Recover of the service, if implemented,
+// with the latest checkpoints.
+func recoverService(s Service) error {
+	r, ok := s.(Recoverable)
+	if !ok {
+		return nil
+	}
+
+	last := make(map[string]*Checkpoint)
+	if c, ok := s.(interface {
+		Checkpoints() (*CheckpointStore, error)
+	}); ok {
+		store, err := c.Checkpoints()
+		if err != nil {
+			return err
+		}
+
+		last = store.Latest()
+	}
+
+	log.Infof("recover service %s from %d checkpoints", s.Name(), len(last))
+
+	return r.Recover(last)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointStore(t *testing.T) {
+	store, err := OpenCheckpointStore(filepath.Join(t.TempDir(), "svc.db"))
+	require.Nil(t, err)
+	defer store.Close()
+
+	_, err = store.Load("offset")
+	assert.ErrorIs(t, err, ErrCheckpointNotFound)
+
+	for i := 1; i <= 5; i++ {
+		version, err := store.Save("offset", []byte{byte(i)})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(i), version)
+	}
+	_, err = store.Save("session", []byte("s"))
+	require.Nil(t, err)
+
+	cp, err := store.Load("offset")
+	require.Nil(t, err)
+	assert.Equal(t, uint64(5), cp.Version)
+	assert.Equal(t, []byte{5}, cp.Data)
+
+	assert.Equal(t, []uint64{3, 4, 5}, store.Versions("offset"))
+	cp, err = store.LoadVersion("offset", 3)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{3}, cp.Data)
+	_, err = store.LoadVersion("offset", 1)
+	assert.ErrorIs(t, err, ErrCheckpointNotFound)
+
+	assert.Equal(t, []string{"offset", "session"}, store.Keys())
+	require.Nil(t, store.Delete("session"))
+	require.Nil(t, store.Delete("session"))
+	assert.Len(t, store.Latest(), 1)
+}
+
+type recoverableService struct {
+	*MetaService
+	recovered map[string]*Checkpoint
+	err       error
+}
+
+func (s *recoverableService) Recover(last map[string]*Checkpoint) error {
+	s.recovered = last
+	return s.err
+}
+
+type counterState struct {
+	Count int `json:"count"`
+}
+
+func TestServiceRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	s := &recoverableService{MetaService: newInProcService(t, "recoverable")}
+	WithCheckpointDir(dir)(s.MetaService)
+
+	require.True(t, Start(s))
+	assert.Empty(t, s.recovered)
+
+	for i := 1; i <= 2; i++ {
+		_, err := s.SaveCheckpoint("counter", &counterState{Count: i})
+		require.Nil(t, err)
+	}
+
+	var state counterState
+	cp, err := s.LoadCheckpoint("counter", &state)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), cp.Version)
+	assert.Equal(t, 2, state.Count)
+
+	// other instances on the host share the file
+	other := NewMetaService(&Descriptor{Name: "recoverable", Instance: "other", Registry: "inproc"},
+		WithMessager(s.Messager()), WithCheckpointDir(dir))
+	version, err := other.SaveCheckpoint("counter", &counterState{Count: 3})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(3), version)
+	_, err = s.LoadCheckpoint("counter", &state)
+	require.Nil(t, err)
+	assert.Equal(t, 3, state.Count)
+	Stop(s)
+
+	// restarted with the last checkpoint
+	require.True(t, Start(s))
+	require.Contains(t, s.recovered, "counter")
+	require.Nil(t, s.recovered["counter"].Decode(&state))
+	assert.Equal(t, 3, state.Count)
+	Stop(s)
+
+	s.err = errors.New("corrupted")
+	assert.False(t, Start(s))
+	assert.Equal(t, Stopped, s.State())
+}
@@ -6,4 +6,12 @@ type Descriptor struct {
 	Name     string `json:"name"`     // 服务名称
 	Domain   int    `json:"domain"`   // 服务归属域
 	Registry string `json:"registry"` //
+	Instance string `json:"instance"` // 服务实例标识, 为空时自动生成
+	Version  string `json:"version"`  // 服务版本, 为空时使用builder.Version
+
+	Tags   []string          `json:"tags,omitempty"`   // 服务标签
+	Labels map[string]string `json:"labels,omitempty"` // 服务键值标签
+
+	Faults []*FaultRule `json:"faults,omitempty"` // 故障注入规则, 仅用于测试, 需WithFaultInjection启用, 见SetFaults
+	Limits []*LimitRule `json:"limits,omitempty"` // 通道及方法限流规则, 见SetLimit
 }
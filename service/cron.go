@@ -0,0 +1,242 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule defines when a job runs.
+type Schedule interface {
+	// Next returns the first activation time later than after,
+	// or the zero time if there's none.
+	Next(after time.Time) time.Time
+}
+
+// interval activates at fixed intervals.
+type interval time.Duration
+
+// Every returns a schedule activating at fixed intervals,
+// which are rounded up to at least one millisecond.
+func Every(d time.Duration) Schedule {
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+
+	return interval(d)
+}
+
+func (i interval) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// cronSearchLimit bounds the search of the next activation.
+const cronSearchLimit = 5 //years
+
+// cronField defines the range and names of a cron field.
+type cronField struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{min: 0, max: 7, names: map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cron is a parsed cron expression, each field a bitset.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// day matches if either dom or dow matches,
+	// when both are restricted, i.e. not *
+	either bool
+}
+
+// ParseCron parses a standard 5-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field accepts *, values, ranges (a-b), steps (*/n, a-b/n, a/n)
+// and comma-separated lists of them. Months and days of week accept
+// three-letter English names, and both 0 and 7 stand for Sunday.
+//
+// Descriptors @yearly, @annually, @monthly, @weekly, @daily, @midnight,
+// @hourly, and @every <duration>, e.g. @every 1h30m, are also accepted.
+//
+// Activation times are in the location of the time passed to Next.
+func ParseCron(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid cron expression %q: bad duration", expr)
+		}
+
+		return Every(d), nil
+	}
+
+	if spec, ok := cronDescriptors[expr]; ok {
+		expr = spec
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expect 5 fields, got %d", expr, len(fields))
+	}
+
+	c := &cron{}
+	var err error
+	for i, p := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&c.minute, cronMinute},
+		{&c.hour, cronHour},
+		{&c.dom, cronDom},
+		{&c.month, cronMonth},
+		{&c.dow, cronDow},
+	} {
+		if *p.bits, err = parseCronField(fields[i], p.field); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.either = fields[2] != "*" && fields[4] != "*"
+
+	return c, nil
+}
+
+// MustParseCron is like ParseCron but panics on error.
+func MustParseCron(expr string) Schedule {
+	s, err := ParseCron(expr)
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+func parseCronField(expr string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		lo, hi, step := f.min, f.max, uint(1)
+
+		rng := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || s == 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+
+			step = uint(s)
+			rng = part[:i]
+		}
+
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			v, err := f.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+
+			lo = v
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step == 1 {
+				hi = lo
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("bad range in %q", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(s string) (uint, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint(v) < f.min || uint(v) > f.max {
+		return 0, fmt.Errorf("value %q out of range [%d, %d]", s, f.min, f.max)
+	}
+
+	return uint(v), nil
+}
+
+func (c *cron) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchLimit, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.either {
+		return dom || dow
+	}
+
+	return dom && dow
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Monday
+	from := time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC)
+
+	for _, c := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"5,10 8 * * *", time.Date(2024, 1, 2, 8, 5, 0, 0, time.UTC)},
+		{"0 0 * * sat,sun", time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		// either day-of-month or day-of-week matches
+		{"0 0 15 * fri", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+	} {
+		s, err := ParseCron(c.expr)
+		require.Nil(t, err, c.expr)
+		assert.Equal(t, c.next, s.Next(from), c.expr)
+	}
+
+	// never activated
+	assert.True(t, MustParseCron("0 0 30 feb *").Next(from).IsZero())
+
+	for _, bad := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *",
+		"* * * foo *", "@every", "@every -1s",
+	} {
+		_, err := ParseCron(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	assert.Equal(t, from.Add(time.Minute), Every(time.Minute).Next(from))
+}
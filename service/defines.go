@@ -1,6 +1,12 @@
 package service
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/zourva/pareto/box"
+	"path"
+	"strconv"
+	"strings"
+)
 
 const (
 	Registry = "registry"
@@ -33,11 +39,26 @@ const (
 	EndpointServiceRRHandlePrefix = "/registry-center/service/handle/"
 )
 
+// DomainPrefix prefixes topics and methods of a domain, see DomainTopic.
+const DomainPrefix = "/domain/"
+
+// InstanceSeparator separates an endpoint from the instance id
+// in instance-specific endpoints.
+const InstanceSeparator = "@"
+
 const (
 	Register        = "Register"
 	ReportStatus    = "ReportStatus"
 	QueryStatus     = "QueryStatus"
 	QueryStatusList = "QueryStatusList"
+	QueryEvents     = "QueryEvents"
+
+	SetTrafficSplit   = "SetTrafficSplit"
+	QueryTrafficSplit = "QueryTrafficSplit"
+
+	AcquireLease = "AcquireLease"
+	ReleaseLease = "ReleaseLease"
+	QueryLease   = "QueryLease"
 )
 
 type RegisterReq struct {
@@ -60,6 +81,10 @@ type ReportStatusRsp struct {
 
 type QueryStatusReq struct {
 	Name string `json:"name"`
+
+	// Instance, if provided, selects the instance of the service,
+	// otherwise the most healthy instance is returned.
+	Instance string `json:"instance,omitempty"`
 }
 
 type QueryStatusRsp struct {
@@ -69,8 +94,135 @@ type QueryStatusRsp struct {
 type QueryStatusListReq struct {
 	// names of services observed
 	Observed []string `json:"observed"`
+
+	// Prefix, if provided, selects services whose name has the prefix.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Pattern, if provided, selects services whose name matches
+	// the glob pattern, in the syntax of path.Match, e.g. "edge-*".
+	Pattern string `json:"pattern,omitempty"`
+
+	// Domains, if provided, selects instances in any of the domains.
+	Domains []int `json:"domains,omitempty"`
+
+	// States, if provided, selects instances in any of the states.
+	States []State `json:"states,omitempty"`
+
+	// Ready, if provided, selects instances of the readiness.
+	Ready *bool `json:"ready,omitempty"`
+
+	// MaxAge, if provided, selects instances updated
+	// within the duration, in milliseconds.
+	MaxAge uint64 `json:"maxAge,omitempty"`
+
+	// Tags, if provided, selects instances carrying all the tags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Labels, if provided, selects instances carrying all the labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Method, if provided, selects instances exposing the
+	// channel or JSON-RPC method, see Status.Exposes.
+	Method string `json:"method,omitempty"`
+
+	// Version, if provided, selects instances whose version
+	// is in the range, e.g. "^1.2", see VersionRange.
+	Version string `json:"version,omitempty"`
+
+	// SortBy orders instances selected by one of SortByName,
+	// the default, SortByState, SortByTime or SortByVersion,
+	// and then by name and instance.
+	SortBy string `json:"sortBy,omitempty"`
+
+	// Desc reverses the order of instances selected.
+	Desc bool `json:"desc,omitempty"`
+
+	// Limit, if provided, returns at most Limit instances, and the
+	// cursor of the next page in StatusList.Next if there are more.
+	Limit int `json:"limit,omitempty"`
+
+	// Cursor, if provided, returns the page following the cursor,
+	// which is the StatusList.Next of the previous page queried
+	// with the same filters and order.
+	Cursor string `json:"cursor,omitempty"`
+
+	versions *VersionRange //parsed Version
+}
+
+// match returns true if the status satisfies all filters except Observed.
+func (q *QueryStatusListReq) match(s *Status) bool {
+	if !strings.HasPrefix(s.Name, q.Prefix) {
+		return false
+	}
+
+	if len(q.Pattern) != 0 {
+		if ok, _ := path.Match(q.Pattern, s.Name); !ok {
+			return false
+		}
+	}
+
+	if !q.matchDomain(s.Domain) || !q.matchState(s.State) {
+		return false
+	}
+
+	if q.Ready != nil && *q.Ready != s.Ready {
+		return false
+	}
+
+	if q.MaxAge != 0 && s.Time+q.MaxAge < box.TimeNowMs() {
+		return false
+	}
+
+	if !s.HasTags(q.Tags...) || !s.MatchLabels(q.Labels) {
+		return false
+	}
+
+	if len(q.Method) != 0 && !s.Exposes(q.Method) {
+		return false
+	}
+
+	return q.matchVersion(s.Version)
+}
+
+func (q *QueryStatusListReq) matchVersion(version string) bool {
+	if len(q.Version) == 0 {
+		return true
+	}
+
+	if q.versions == nil {
+		r, err := ParseVersionRange(q.Version)
+		if err != nil {
+			return false
+		}
+
+		q.versions = r
+	}
+
+	return q.versions.Match(version)
+}
+
+func (q *QueryStatusListReq) matchDomain(domain int) bool {
+	for _, d := range q.Domains {
+		if d == domain {
+			return true
+		}
+	}
+
+	return len(q.Domains) == 0
 }
 
+func (q *QueryStatusListReq) matchState(state State) bool {
+	for _, st := range q.States {
+		if st == state {
+			return true
+		}
+	}
+
+	return len(q.States) == 0
+}
+
+// QueryStatusListRsp contains one status per instance, so
+// a service with several instances appears several times.
 type QueryStatusListRsp struct {
 	List *StatusList `json:"list"`
 }
@@ -120,3 +272,58 @@ type Endpoint struct {
 func (r *Endpoint) SerializedName() string {
 	return fmt.Sprintf("%s/%s/%s", r.Service, r.Object, r.Method)
 }
+
+// InstanceEndpoint returns the endpoint bound exclusively by one
+// instance of a service, in format: endpoint + "@" + instance.
+//
+// e.g.:
+//
+//	/webserver/cookie@5fa2c7e1
+func InstanceEndpoint(endpoint, instance string) string {
+	return endpoint + InstanceSeparator + instance
+}
+
+// DomainTopic returns the topic, or rpc endpoint, scoped to the given
+// domain, in format: "/domain/" + domain + topic. Topics of domain 0,
+// the default domain, are not prefixed, to keep compatible with
+// services unaware of domains.
+//
+// e.g.:
+//
+//	/domain/3/registry-center/service/status
+func DomainTopic(domain int, topic string) string {
+	if domain == 0 {
+		return topic
+	}
+
+	prefix := DomainPrefix + strconv.Itoa(domain)
+	if !strings.HasPrefix(topic, "/") {
+		prefix += "/"
+	}
+
+	return prefix + topic
+}
+
+// LeaseReq requests the registry to acquire, renew,
+// release or query a lease, see Elector.
+type LeaseReq struct {
+	Name   string `json:"name"`             //name of the lease
+	Holder string `json:"holder,omitempty"` //instance acquiring or releasing the lease
+	TTL    uint32 `json:"ttl,omitempty"`    //milliseconds, to acquire or renew for
+	Token  uint64 `json:"token,omitempty"`  //fencing token of the lease to release
+}
+
+// Lease is held by at most one instance at a time.
+type Lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder,omitempty"` //instance holding the lease, empty if free
+	Token  uint64 `json:"token"`            //fencing token, increased on each new holder
+	Expiry uint64 `json:"expiry,omitempty"` //timestamp in milliseconds
+}
+
+// LeaseRsp carries the lease after the request, and whether
+// the lease is acquired, renewed or released as requested.
+type LeaseRsp struct {
+	Granted bool   `json:"granted"`
+	Lease   *Lease `json:"lease"`
+}
@@ -0,0 +1,424 @@
+package service
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LeaseTTL defines the default ttl, in seconds, of leases acquired
+// by electors, which renew them every third of the ttl.
+const LeaseTTL = 10
+
+var (
+	acquireLeaseMethod = NewMethod[LeaseReq, LeaseRsp](EndpointServiceInfo, AcquireLease)
+	releaseLeaseMethod = NewMethod[LeaseReq, LeaseRsp](EndpointServiceInfo, ReleaseLease)
+	queryLeaseMethod   = NewMethod[LeaseReq, LeaseRsp](EndpointServiceInfo, QueryLease)
+)
+
+// leaseTable holds leases granted by the registry.
+//
+// Leases are not persisted, so fencing tokens start from the epoch,
+// i.e. the time the table is created in milliseconds, to keep them
+// increasing across restarts of the registry, as long as leases are
+// granted less than once per millisecond on average, and the clock
+// of the registry does not go backwards.
+type leaseTable struct {
+	sync.Mutex
+	epoch  uint64
+	leases map[string]*Lease
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{epoch: box.TimeNowMs(), leases: make(map[string]*Lease)}
+}
+
+// get returns the lease of the name, cleared if expired.
+func (t *leaseTable) get(name string, now uint64) *Lease {
+	l, ok := t.leases[name]
+	if !ok {
+		l = &Lease{Name: name, Token: t.epoch}
+		t.leases[name] = l
+	}
+
+	if len(l.Holder) != 0 && now >= l.Expiry {
+		log.Infof("lease %s of %s expired", name, l.Holder)
+		l.Holder = ""
+		l.Expiry = 0
+	}
+
+	return l
+}
+
+// acquire grants the lease to the holder if it's free, or
+// renews it if already held by the holder.
+func (t *leaseTable) acquire(req *LeaseReq) *LeaseRsp {
+	t.Lock()
+	defer t.Unlock()
+
+	now := box.TimeNowMs()
+	l := t.get(req.Name, now)
+	switch l.Holder {
+	case req.Holder:
+	case "":
+		l.Holder = req.Holder
+		l.Token++
+		log.Infof("lease %s granted to %s, token %d", l.Name, l.Holder, l.Token)
+	default:
+		return &LeaseRsp{Granted: false, Lease: t.copy(l)}
+	}
+
+	l.Expiry = now + uint64(req.TTL)
+
+	return &LeaseRsp{Granted: true, Lease: t.copy(l)}
+}
+
+// release frees the lease if held by the holder with the token.
+func (t *leaseTable) release(req *LeaseReq) *LeaseRsp {
+	t.Lock()
+	defer t.Unlock()
+
+	l := t.get(req.Name, box.TimeNowMs())
+	if l.Holder != req.Holder || l.Token != req.Token {
+		return &LeaseRsp{Granted: false, Lease: t.copy(l)}
+	}
+
+	l.Holder = ""
+	l.Expiry = 0
+	log.Infof("lease %s released by %s", l.Name, req.Holder)
+
+	return &LeaseRsp{Granted: true, Lease: t.copy(l)}
+}
+
+func (t *leaseTable) query(req *LeaseReq) *LeaseRsp {
+	t.Lock()
+	defer t.Unlock()
+
+	l := t.get(req.Name, box.TimeNowMs())
+
+	return &LeaseRsp{Granted: len(l.Holder) != 0, Lease: t.copy(l)}
+}
+
+// revoke frees all leases held by the holder, before they expire,
+// while the holder keeps leading until it fails to renew them, i.e.
+// leases of instances timed out in the registry are not revoked.
+func (t *leaseTable) revoke(holder string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, l := range t.leases {
+		if l.Holder == holder {
+			l.Holder = ""
+			l.Expiry = 0
+			log.Infof("lease %s of %s revoked", l.Name, holder)
+		}
+	}
+}
+
+// list returns leases held, sorted by name.
+func (t *leaseTable) list() []*Lease {
+	t.Lock()
+	defer t.Unlock()
+
+	now := box.TimeNowMs()
+
+	var result []*Lease
+	for name := range t.leases {
+		if l := t.get(name, now); len(l.Holder) != 0 {
+			result = append(result, t.copy(l))
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+func (t *leaseTable) copy(l *Lease) *Lease {
+	c := *l
+	return &c
+}
+
+// exposeLeases routes lease methods on the info channel of the registry.
+func (s *RegistryManager) exposeLeases() {
+	acquireLeaseMethod.Expose(s, func(req *LeaseReq) (*LeaseRsp, error) {
+		return s.leases.acquire(req), nil
+	})
+
+	releaseLeaseMethod.Expose(s, func(req *LeaseReq) (*LeaseRsp, error) {
+		return s.leases.release(req), nil
+	})
+
+	queryLeaseMethod.Expose(s, func(req *LeaseReq) (*LeaseRsp, error) {
+		return s.leases.query(req), nil
+	})
+}
+
+// Leases returns leases currently held, sorted by name.
+func (s *RegistryManager) Leases() []*Lease {
+	return s.leases.list()
+}
+
+// ElectorOption customizes an Elector.
+type ElectorOption func(*Elector)
+
+// WithLeaseTTL overrides the ttl of the lease, see LeaseTTL.
+func WithLeaseTTL(ttl time.Duration) ElectorOption {
+	return func(e *Elector) {
+		e.ttl = ttl
+	}
+}
+
+// OnElected sets the callback invoked when the instance becomes
+// the leader, with the fencing token of its term, which should be
+// passed to shared resources for them to reject stale leaders.
+func OnElected(fn func(token uint64)) ElectorOption {
+	return func(e *Elector) {
+		e.onElected = fn
+	}
+}
+
+// OnRevoked sets the callback invoked when the instance is no
+// longer the leader, i.e. the lease is taken by another instance,
+// cannot be renewed in time, or is released when stopped.
+func OnRevoked(fn func()) ElectorOption {
+	return func(e *Elector) {
+		e.onRevoked = fn
+	}
+}
+
+// Elector campaigns for leadership of an election among instances,
+// using a lease granted by the registry, identified by the election
+// name. The leader renews the lease every third of the ttl, and
+// considers itself revoked if the lease is not renewed within the ttl,
+// which is measured from before the request is sent, so that it steps
+// down no later than the registry lets the lease expire.
+//
+// Callbacks are invoked from the campaigning goroutine.
+type Elector struct {
+	sync.RWMutex
+	service   *MetaService
+	name      string
+	holder    string
+	ttl       time.Duration
+	onElected func(token uint64)
+	onRevoked func()
+
+	leader bool      //true if holding the lease
+	token  uint64    //fencing token of the term
+	expiry time.Time //local deadline to renew the lease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewElector creates an elector of the service for the given election.
+// Electors of a service are stopped when the service stops.
+func NewElector(s *MetaService, name string, opts ...ElectorOption) *Elector {
+	e := &Elector{
+		service: s,
+		name:    name,
+		holder:  s.Instance(),
+		ttl:     LeaseTTL * time.Second,
+	}
+
+	for _, fn := range opts {
+		fn(e)
+	}
+
+	s.mutex.Lock()
+	s.electors[name] = e
+	s.mutex.Unlock()
+
+	return e
+}
+
+// Name returns name of the election.
+func (e *Elector) Name() string {
+	return e.name
+}
+
+// IsLeader returns true if the instance is the leader.
+func (e *Elector) IsLeader() bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.leader
+}
+
+// Token returns the fencing token of the current term,
+// which is valid only when the instance is the leader.
+func (e *Elector) Token() uint64 {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.token
+}
+
+// Leader queries the registry for the lease of the election.
+func (e *Elector) Leader() (*Lease, error) {
+	rsp, err := queryLeaseMethod.Invoke(e.service, &LeaseReq{Name: e.name}, e.ttl/3)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Lease, nil
+}
+
+// Start starts campaigning, does nothing if already started.
+func (e *Elector) Start() {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.stop != nil {
+		return
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go e.run(e.stop, e.done)
+}
+
+// Stop stops campaigning and releases the lease if held.
+func (e *Elector) Stop() {
+	e.Lock()
+	stop, done := e.stop, e.done
+	e.stop, e.done = nil, nil
+	e.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+
+	if !e.IsLeader() {
+		return
+	}
+
+	_, err := releaseLeaseMethod.Invoke(e.service,
+		&LeaseReq{Name: e.name, Holder: e.holder, Token: e.Token()}, e.ttl/3)
+	if err != nil {
+		log.Warnf("%s release lease %s failed: %v", e.service.Name(), e.name, err)
+	}
+
+	e.revoke()
+}
+
+func (e *Elector) run(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.campaign()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign acquires, or renews, the lease.
+func (e *Elector) campaign() {
+	begin := time.Now()
+	rsp, err := acquireLeaseMethod.Invoke(e.service,
+		&LeaseReq{Name: e.name, Holder: e.holder, TTL: uint32(e.ttl.Milliseconds())}, e.ttl/3)
+
+	switch {
+	case err != nil:
+		log.Debugf("%s acquire lease %s failed: %v", e.service.Name(), e.name, err)
+		e.RLock()
+		expired := e.leader && time.Now().After(e.expiry)
+		e.RUnlock()
+
+		if expired {
+			e.revoke()
+		}
+	case rsp.Granted:
+		e.Lock()
+		e.expiry = begin.Add(e.ttl)
+		renewed := e.leader && e.token == rsp.Lease.Token
+		e.Unlock()
+
+		if !renewed {
+			e.revoke()
+			e.elect(rsp.Lease.Token)
+		}
+	default:
+		e.revoke()
+	}
+}
+
+func (e *Elector) elect(token uint64) {
+	e.Lock()
+	e.leader = true
+	e.token = token
+	e.Unlock()
+
+	log.Infof("%s elected as leader of %s, token %d", e.service.Name(), e.name, token)
+	_ = e.service.Registrar().ReportStatus()
+
+	if e.onElected != nil {
+		e.onElected(token)
+	}
+}
+
+// revoke steps down if the instance is the leader.
+func (e *Elector) revoke() {
+	e.Lock()
+	if !e.leader {
+		e.Unlock()
+		return
+	}
+
+	e.leader = false
+	e.Unlock()
+
+	log.Infof("%s revoked as leader of %s", e.service.Name(), e.name)
+	_ = e.service.Registrar().ReportStatus()
+
+	if e.onRevoked != nil {
+		e.onRevoked()
+	}
+}
+
+// leads returns names of elections led by the service, sorted.
+func (s *MetaService) leads() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var names []string
+	for name, e := range s.electors {
+		if e.IsLeader() {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// stopElectors stops all electors of the service.
+func (s *MetaService) stopElectors() {
+	s.mutex.RLock()
+	electors := make([]*Elector, 0, len(s.electors))
+	for _, e := range s.electors {
+		electors = append(electors, e)
+	}
+	s.mutex.RUnlock()
+
+	for _, e := range electors {
+		e.Stop()
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLeaseTable(t *testing.T) {
+	leases := newLeaseTable()
+
+	rsp := leases.acquire(&LeaseReq{Name: "primary", Holder: "a", TTL: 1000})
+	assert.True(t, rsp.Granted)
+	assert.Equal(t, leases.epoch+1, rsp.Lease.Token)
+
+	rsp = leases.acquire(&LeaseReq{Name: "primary", Holder: "b", TTL: 1000})
+	assert.False(t, rsp.Granted)
+	assert.Equal(t, "a", rsp.Lease.Holder)
+
+	// renewal keeps the token
+	rsp = leases.acquire(&LeaseReq{Name: "primary", Holder: "a", TTL: 1000})
+	assert.True(t, rsp.Granted)
+	assert.Equal(t, leases.epoch+1, rsp.Lease.Token)
+
+	assert.False(t, leases.release(&LeaseReq{Name: "primary", Holder: "a", Token: leases.epoch + 2}).Granted)
+	assert.True(t, leases.release(&LeaseReq{Name: "primary", Holder: "a", Token: leases.epoch + 1}).Granted)
+	assert.False(t, leases.query(&LeaseReq{Name: "primary"}).Granted)
+
+	rsp = leases.acquire(&LeaseReq{Name: "primary", Holder: "b", TTL: 1})
+	assert.True(t, rsp.Granted)
+	assert.Equal(t, leases.epoch+2, rsp.Lease.Token)
+
+	// expired leases are free to take
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, leases.list())
+	rsp = leases.acquire(&LeaseReq{Name: "primary", Holder: "a", TTL: 1000})
+	assert.True(t, rsp.Granted)
+	assert.Equal(t, leases.epoch+3, rsp.Lease.Token)
+
+	leases.acquire(&LeaseReq{Name: "backup", Holder: "a", TTL: 1000})
+	list := leases.list()
+	require.Len(t, list, 2)
+	assert.Equal(t, "backup", list[0].Name)
+
+	leases.revoke("a")
+	assert.Empty(t, leases.list())
+
+	// tokens keep increasing after a restart of the registry
+	time.Sleep(2 * time.Millisecond)
+	rsp = newLeaseTable().acquire(&LeaseReq{Name: "primary", Holder: "b", TTL: 1000})
+	assert.Greater(t, rsp.Lease.Token, leases.epoch+3)
+}
+
+func TestElectorFailover(t *testing.T) {
+	reg := &RegistryManager{MetaService: newInProcService(t, Registry), leases: newLeaseTable()}
+	reg.exposeLeases()
+	require.Nil(t, reg.RpcServer().Serve())
+
+	ttl := 150 * time.Millisecond
+	elected := make(chan uint64, 4)
+	revoked := make(chan struct{}, 4)
+	primary := NewElector(reg.MetaService, "primary", WithLeaseTTL(ttl),
+		OnElected(func(token uint64) { elected <- token }),
+		OnRevoked(func() { revoked <- struct{}{} }))
+
+	standbyElected := make(chan uint64, 4)
+	standby := &Elector{
+		service:   reg.MetaService,
+		name:      "primary",
+		holder:    "standby",
+		ttl:       ttl,
+		onElected: func(token uint64) { standbyElected <- token },
+	}
+
+	primary.Start()
+	assert.Equal(t, reg.leases.epoch+1, waitToken(t, elected))
+	assert.True(t, primary.IsLeader())
+	assert.Equal(t, []string{"primary"}, reg.leads())
+
+	standby.Start()
+	time.Sleep(ttl)
+	assert.False(t, standby.IsLeader())
+
+	lease, err := primary.Leader()
+	require.Nil(t, err)
+	assert.Equal(t, reg.Instance(), lease.Holder)
+
+	// stopping releases the lease to the standby
+	primary.Stop()
+	<-revoked
+	assert.False(t, primary.IsLeader())
+	assert.Empty(t, reg.leads())
+	assert.Equal(t, reg.leases.epoch+2, waitToken(t, standbyElected))
+
+	// a lease lost at the registry starts a new term with a new token
+	reg.leases.revoke("standby")
+	assert.Equal(t, reg.leases.epoch+3, waitToken(t, standbyElected))
+	assert.Equal(t, reg.leases.epoch+3, standby.Token())
+
+	standby.Stop()
+	assert.False(t, standby.IsLeader())
+	assert.Empty(t, reg.Leases())
+}
+
+func TestElectorLeaseOutlivesTimeout(t *testing.T) {
+	reg := &RegistryManager{
+		MetaService: newInProcService(t, Registry),
+		leases:      newLeaseTable(),
+		timer:       time.AfterFunc(time.Hour, func() {}),
+	}
+	defer reg.timer.Stop()
+
+	reg.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"checkInterval":1,"allowFailures":1}`))
+	reg.leases.acquire(&LeaseReq{Name: "primary", Holder: "a", TTL: 60000})
+
+	// a leader timed out keeps its lease until it expires
+	reg.getInstance("svc", "a").updateTime -= 10 * 1000
+	reg.checkTimeout()
+	assert.Equal(t, Offline, reg.getInstance("svc", "a").state)
+	rsp := reg.leases.acquire(&LeaseReq{Name: "primary", Holder: "b", TTL: 60000})
+	assert.False(t, rsp.Granted)
+	assert.Equal(t, "a", rsp.Lease.Holder)
+}
+
+func waitToken(t *testing.T, ch chan uint64) uint64 {
+	select {
+	case token := <-ch:
+		return token
+	case <-time.After(time.Second):
+		t.Fatal("not elected")
+		return 0
+	}
+}
@@ -0,0 +1,394 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	EventLogDir       = "events"           //dir under the working dir holding the event log
+	EventLogFile      = "registry.db"      //file name of the event log of the registry
+	EventLogRetention = 7 * 24 * time.Hour //default max age of events kept
+	EventLogMaxEvents = 100000             //default max number of events kept
+	EventQueryLimit   = 1000               //default max number of events returned by a query
+
+	eventBucket   = "events" //bucket holding events, keyed by time and sequence
+	eventQueueLen = 1024     //events appended and not yet written
+)
+
+var queryEventsMethod = NewMethod[QueryEventsReq, QueryEventsRsp](EndpointServiceInfo, QueryEvents)
+
+var (
+	// ErrEventLogDisabled is returned by QueryEvents if
+	// the registry does not record events, see WithEventLog.
+	ErrEventLogDisabled = errors.New("event log disabled")
+
+	// ErrEventLogClosed is returned by EventLog methods once closed.
+	ErrEventLogClosed = errors.New("event log closed")
+)
+
+// EventType classifies changes of instances recorded by the registry.
+type EventType string
+
+const (
+	EventRegistered   EventType = "registered"   //first status of an instance received
+	EventStateChanged EventType = "state"        //state reported changed
+	EventReadyChanged EventType = "readiness"    //readiness reported changed
+	EventTimeout      EventType = "timeout"      //forced offline, having stopped reporting
+	EventUnregistered EventType = "unregistered" //stopped normally, or purged after offline
+)
+
+// RegistryEvent is a change of an instance recorded by the registry.
+// PrevState and PrevReady hold the state and readiness before the change.
+type RegistryEvent struct {
+	Seq       uint64    `json:"seq"`  //starts from 1 and increases on each event
+	Time      uint64    `json:"time"` //timestamp in milliseconds
+	Type      EventType `json:"type"`
+	Service   string    `json:"service"`
+	Instance  string    `json:"instance"`
+	Domain    int       `json:"domain"`
+	PrevState State     `json:"prevState"`
+	State     State     `json:"state"`
+	PrevReady bool      `json:"prevReady"`
+	Ready     bool      `json:"ready"`
+	Version   string    `json:"version,omitempty"`
+}
+
+// QueryEventsReq selects events recorded by the registry.
+// Zero fields select all.
+type QueryEventsReq struct {
+	Service  string      `json:"service,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Types    []EventType `json:"types,omitempty"`
+	From     uint64      `json:"from,omitempty"`  //timestamp in milliseconds, inclusive
+	To       uint64      `json:"to,omitempty"`    //timestamp in milliseconds, exclusive
+	Limit    int         `json:"limit,omitempty"` //max events returned, EventQueryLimit if 0
+}
+
+func (q *QueryEventsReq) match(e *RegistryEvent) bool {
+	if (len(q.Service) != 0 && q.Service != e.Service) ||
+		(len(q.Instance) != 0 && q.Instance != e.Instance) {
+		return false
+	}
+
+	if e.Time < q.From || (q.To != 0 && e.Time >= q.To) {
+		return false
+	}
+
+	if len(q.Types) == 0 {
+		return true
+	}
+
+	for _, t := range q.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueryEventsRsp carries events selected, in time order,
+// and whether more events are selected beyond the limit.
+type QueryEventsRsp struct {
+	Events []*RegistryEvent `json:"events"`
+	More   bool             `json:"more,omitempty"`
+}
+
+// EventLog is an append-only log of registry events, persisted
+// in a local bbolt file, dropping events beyond its retention.
+//
+// Events are written in batches by a goroutine of the log, so that
+// appending does not wait for the file to be synced, and are keyed
+// by time, so that queries seek to the time range selected.
+//
+// All methods are goroutine-safe.
+type EventLog struct {
+	path      string
+	maxAge    time.Duration
+	maxEvents int
+	count     int //number of events kept, changed by the writer only
+	db        *bolt.DB
+
+	mutex   sync.RWMutex
+	closed  bool
+	queue   chan *RegistryEvent
+	flushes chan chan error
+	done    chan struct{}
+}
+
+// OpenEventLog opens, or creates, the event log at path, keeping
+// events for maxAge and at most maxEvents of them. Zero values
+// disable the corresponding limit.
+func OpenEventLog(path string, maxAge time.Duration, maxEvents int) (*EventLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: CheckpointTimeout * time.Second})
+	if err != nil {
+		log.Errorf("open event log %s failed: %v", path, err)
+		return nil, err
+	}
+
+	l := &EventLog{
+		path:      path,
+		maxAge:    maxAge,
+		maxEvents: maxEvents,
+		db:        db,
+		queue:     make(chan *RegistryEvent, eventQueueLen),
+		flushes:   make(chan chan error),
+		done:      make(chan struct{}),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(eventBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket failed: %v", err)
+		}
+
+		l.count = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	go l.write()
+
+	return l, nil
+}
+
+// Path returns path of the event log file.
+func (l *EventLog) Path() string {
+	return l.path
+}
+
+// Close writes events appended, and closes the event log file.
+func (l *EventLog) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return ErrEventLogClosed
+	}
+
+	l.closed = true
+	close(l.queue)
+	l.mutex.Unlock()
+
+	<-l.done
+
+	return l.db.Close()
+}
+
+// eventKey orders events by time, and by sequence within the same time.
+func eventKey(time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, time)
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func eventTime(k []byte) uint64 {
+	return binary.BigEndian.Uint64(k)
+}
+
+// Append queues the event to be recorded, setting its time if not
+// set, and its sequence once written, i.e. the event must not be
+// modified after. Events beyond the retention are dropped on writes.
+func (l *EventLog) Append(e *RegistryEvent) error {
+	box.SetIfEq(&e.Time, 0, box.TimeNowMs())
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.closed {
+		return ErrEventLogClosed
+	}
+
+	l.queue <- e
+
+	return nil
+}
+
+// Flush waits until events appended are written.
+func (l *EventLog) Flush() error {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return ErrEventLogClosed
+	}
+
+	ack := make(chan error, 1)
+	l.flushes <- ack
+	l.mutex.RUnlock()
+
+	return <-ack
+}
+
+// write writes events queued in batches, until the log is closed.
+func (l *EventLog) write() {
+	defer close(l.done)
+
+	for {
+		select {
+		case e, ok := <-l.queue:
+			if !ok {
+				return
+			}
+
+			batch, open := l.drain([]*RegistryEvent{e}, eventQueueLen)
+			l.commit(batch)
+			if !open {
+				return
+			}
+		case ack := <-l.flushes:
+			batch, _ := l.drain(nil, 0)
+			ack <- l.commit(batch)
+		}
+	}
+}
+
+// drain takes events queued, at most max of them if positive, without
+// waiting, and returns false if the queue is closed.
+func (l *EventLog) drain(batch []*RegistryEvent, max int) ([]*RegistryEvent, bool) {
+	for max <= 0 || len(batch) < max {
+		select {
+		case e, ok := <-l.queue:
+			if !ok {
+				return batch, false
+			}
+
+			batch = append(batch, e)
+		default:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
+
+// commit writes the events, assigning their sequences, in one
+// transaction, and drops events beyond the retention.
+func (l *EventLog) commit(batch []*RegistryEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	count := l.count
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(eventBucket))
+		for _, e := range batch {
+			e.Seq, _ = b.NextSequence()
+
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put(eventKey(e.Time, e.Seq), buf); err != nil {
+				return err
+			}
+
+			count++
+		}
+
+		var err error
+		count, err = l.prune(b, count)
+		return err
+	})
+	if err != nil {
+		log.Warnf("write %d events to %s failed: %v", len(batch), l.path, err)
+		return err
+	}
+
+	l.count = count
+
+	return nil
+}
+
+// prune drops the oldest events, which are expired or exceed
+// the max number, and returns the number of events left.
+func (l *EventLog) prune(b *bolt.Bucket, count int) (int, error) {
+	var deadline uint64
+	if now, age := box.TimeNowMs(), uint64(l.maxAge.Milliseconds()); age > 0 && now > age {
+		deadline = now - age
+	}
+
+	// keys are collected first, since deleting
+	// while iterating makes the cursor skip keys
+	var dropped [][]byte
+	cur := b.Cursor()
+	for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+		if (l.maxEvents <= 0 || count-len(dropped) <= l.maxEvents) && eventTime(k) >= deadline {
+			break
+		}
+
+		dropped = append(dropped, k)
+	}
+
+	for _, k := range dropped {
+		if err := b.Delete(k); err != nil {
+			return count, err
+		}
+	}
+
+	return count - len(dropped), nil
+}
+
+// Query returns events selected, in time order, and whether more
+// events are selected beyond the limit of the request, after events
+// appended are written.
+func (l *EventLog) Query(q *QueryEventsReq) (*QueryEventsRsp, error) {
+	if err := l.Flush(); err != nil {
+		return nil, err
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = EventQueryLimit
+	}
+
+	rsp := &QueryEventsRsp{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(eventBucket)).Cursor()
+		for k, v := cur.Seek(eventKey(q.From, 0)); k != nil; k, v = cur.Next() {
+			if q.To != 0 && eventTime(k) >= q.To {
+				break
+			}
+
+			e := &RegistryEvent{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+
+			if !q.match(e) {
+				continue
+			}
+
+			if len(rsp.Events) == limit {
+				rsp.More = true
+				break
+			}
+
+			rsp.Events = append(rsp.Events, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/box"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	events, err := OpenEventLog(path, time.Hour, 4)
+	require.Nil(t, err)
+
+	now := box.TimeNowMs()
+	require.Nil(t, events.Append(&RegistryEvent{Type: EventRegistered, Service: "a", Time: now - 2*3600*1000}))
+	for i := 0; i < 5; i++ {
+		require.Nil(t, events.Append(&RegistryEvent{Type: EventStateChanged, Service: "a", Time: now + uint64(i)}))
+	}
+	require.Nil(t, events.Append(&RegistryEvent{Type: EventTimeout, Service: "b", Instance: "1", Time: now + 5}))
+
+	// the expired one and the oldest ones beyond the max are dropped
+	rsp, err := events.Query(&QueryEventsReq{})
+	require.Nil(t, err)
+	require.Len(t, rsp.Events, 4)
+	assert.Equal(t, uint64(4), rsp.Events[0].Seq)
+	assert.Equal(t, uint64(7), rsp.Events[3].Seq)
+
+	rsp, _ = events.Query(&QueryEventsReq{Service: "a", From: now + 3, Limit: 1})
+	require.Len(t, rsp.Events, 1)
+	assert.Equal(t, now+3, rsp.Events[0].Time)
+	assert.True(t, rsp.More)
+
+	rsp, _ = events.Query(&QueryEventsReq{Types: []EventType{EventTimeout, EventRegistered}})
+	require.Len(t, rsp.Events, 1)
+	assert.Equal(t, "1", rsp.Events[0].Instance)
+
+	rsp, _ = events.Query(&QueryEventsReq{To: now + 3})
+	assert.Len(t, rsp.Events, 1)
+
+	// the log survives restarts, keeping the sequence
+	require.Nil(t, events.Close())
+	events, err = OpenEventLog(path, 0, 4)
+	require.Nil(t, err)
+
+	require.Nil(t, events.Append(&RegistryEvent{Type: EventUnregistered, Service: "b", Time: now + 6}))
+	rsp, _ = events.Query(&QueryEventsReq{})
+	require.Len(t, rsp.Events, 4)
+	assert.Equal(t, uint64(8), rsp.Events[3].Seq)
+
+	// concurrent appends are written in batches before queries
+	require.Nil(t, events.Close())
+	events, err = OpenEventLog(path, 0, 0)
+	require.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, events.Append(&RegistryEvent{Type: EventStateChanged, Service: "c", Time: now + 10 + uint64(i)}))
+		}(i)
+	}
+	wg.Wait()
+
+	rsp, err = events.Query(&QueryEventsReq{From: now + 10, To: now + 60, Limit: 100})
+	require.Nil(t, err)
+	require.Len(t, rsp.Events, 50)
+	assert.Equal(t, now+10, rsp.Events[0].Time)
+	assert.Equal(t, now+59, rsp.Events[49].Time)
+
+	require.Nil(t, events.Close())
+	assert.ErrorIs(t, events.Append(&RegistryEvent{Type: EventRegistered}), ErrEventLogClosed)
+}
+
+func TestRegistryEvents(t *testing.T) {
+	s := &RegistryManager{
+		MetaService: newInProcService(t, Registry),
+		leases:      newLeaseTable(),
+		timer:       time.AfterFunc(time.Hour, func() {}),
+	}
+	defer s.timer.Stop()
+	s.exposeEvents()
+	require.Nil(t, s.RpcServer().Serve())
+
+	_, err := queryEventsMethod.Invoke(s, &QueryEventsReq{}, time.Second)
+	assert.ErrorContains(t, err, ErrEventLogDisabled.Error())
+
+	events, err := OpenEventLog(filepath.Join(t.TempDir(), "events.db"), 0, 0)
+	require.Nil(t, err)
+	defer events.Close()
+	s.events = events
+
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":1,"version":"1.0"}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"ready":true}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"b","state":2}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"b","state":4}`))
+
+	// instance a stops reporting
+	s.getInstance("svc", "a").updateTime -= 3600 * 1000
+	s.checkTimeout()
+
+	rsp, err := queryEventsMethod.Invoke(s, &QueryEventsReq{Service: "svc", Instance: "a"}, time.Second)
+	require.Nil(t, err)
+	var types []EventType
+	for _, e := range rsp.Events {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []EventType{EventRegistered, EventStateChanged, EventReadyChanged, EventTimeout}, types)
+	assert.Equal(t, "1.0", rsp.Events[0].Version)
+	assert.Equal(t, Starting, rsp.Events[1].PrevState)
+	assert.Equal(t, Servicing, rsp.Events[1].State)
+	assert.True(t, rsp.Events[3].PrevReady)
+	assert.Equal(t, Offline, rsp.Events[3].State)
+
+	rsp, err = queryEventsMethod.Invoke(s, &QueryEventsReq{Types: []EventType{EventUnregistered}}, time.Second)
+	require.Nil(t, err)
+	require.Len(t, rsp.Events, 1)
+	assert.Equal(t, "b", rsp.Events[0].Instance)
+	assert.Equal(t, Stopped, rsp.Events[0].State)
+}
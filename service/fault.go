@@ -0,0 +1,385 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointFaultsPrefix prefixes the channel exposed by services having
+// fault injection enabled, in format: prefix + name, to query and set
+// fault rules at runtime, see WithFaultInjection.
+//
+// The payload is a FaultControl, whose rules, if not null, replace the
+// rules of the service, and the reply is a FaultControl carrying the
+// rules in effect.
+const EndpointFaultsPrefix = "/pareto/faults/"
+
+// ErrFaultInjected is returned by calls, notices and handlers
+// failed by a FaultError rule.
+var ErrFaultInjected = errors.New("fault injected")
+
+// FaultPoint identifies where faults are injected.
+type FaultPoint string
+
+const (
+	FaultOnNotify FaultPoint = "notify" //publisher side of Notify, targets are topics
+	FaultOnCall   FaultPoint = "call"   //caller side of CallMethod, targets are channels
+	FaultOnHandle FaultPoint = "handle" //callee side of exposed channels, and JSON-RPC handlers
+)
+
+// FaultKind defines how a message misbehaves.
+type FaultKind string
+
+const (
+	FaultDelay   FaultKind = "delay"   //delays the message by Latency
+	FaultDrop    FaultKind = "drop"    //loses the message, callers time out over NATS
+	FaultError   FaultKind = "error"   //fails the message with ErrFaultInjected, or Code for JSON-RPC handlers
+	FaultCorrupt FaultKind = "corrupt" //flips random bytes of the payload, or of the reply of handlers
+)
+
+// FaultRule injects a fault into messages matching the rule, with the
+// given probability.
+//
+// Target is a glob pattern, in the syntax of path.Match, of topics or
+// channels, optionally followed by "#" and a pattern of JSON-RPC methods
+// routed on the channel, e.g. "/echo/*" or "/echo/rpc#say*".
+type FaultRule struct {
+	Point       FaultPoint `json:"point,omitempty"` //empty for all points
+	Target      string     `json:"target"`
+	Kind        FaultKind  `json:"kind"`
+	Probability float64    `json:"probability,omitempty"` //in (0, 1], or 0 to always inject
+	Latency     uint32     `json:"latency,omitempty"`     //milliseconds, of FaultDelay
+	Code        int        `json:"code,omitempty"`        //JSON-RPC error code of FaultError, ErrServerInternal if 0
+	Message     string     `json:"message,omitempty"`     //error message of FaultError
+}
+
+func (r *FaultRule) matches(point FaultPoint, channel, method string) bool {
+	if len(r.Point) != 0 && r.Point != point {
+		return false
+	}
+
+	chPattern, mPattern, scoped := strings.Cut(r.Target, "#")
+	if ok, _ := path.Match(chPattern, channel); !ok {
+		return false
+	}
+
+	if !scoped {
+		return true
+	}
+
+	ok, _ := path.Match(mPattern, method)
+	return ok
+}
+
+func (r *FaultRule) fires() bool {
+	return r.Probability <= 0 || rand.Float64() < r.Probability
+}
+
+func (r *FaultRule) err() error {
+	if len(r.Message) == 0 {
+		return ErrFaultInjected
+	}
+
+	return fmt.Errorf("%w: %s", ErrFaultInjected, r.Message)
+}
+
+// FaultControl is the payload exchanged on EndpointFaultsPrefix.
+type FaultControl struct {
+	Rules   []*FaultRule `json:"rules"`
+	Enabled bool         `json:"enabled,omitempty"` //false in replies if fault injection is disabled
+}
+
+// fault is the outcome of rules fired for a message.
+type fault struct {
+	delay   time.Duration
+	drop    bool
+	failure *FaultRule //the FaultError rule fired, if any
+	corrupt bool
+}
+
+func (f *fault) wait() {
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+}
+
+// faultInjector holds fault rules of a service, which are ignored
+// unless enabled, and faultInjection is enabled at build time.
+type faultInjector struct {
+	sync.RWMutex
+	enabled bool
+	rules   []*FaultRule
+}
+
+func (f *faultInjector) set(rules []*FaultRule) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.rules = rules
+}
+
+func (f *faultInjector) enable() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.enabled = true
+}
+
+func (f *faultInjector) active() bool {
+	f.RLock()
+	defer f.RUnlock()
+
+	return faultInjection && f.enabled
+}
+
+func (f *faultInjector) list() []*FaultRule {
+	f.RLock()
+	defer f.RUnlock()
+
+	return append([]*FaultRule{}, f.rules...)
+}
+
+// inject returns the outcome of rules firing for the message, or nil
+// if none fired. Delays of rules fired add up, and drop and error
+// rules stop the evaluation.
+//
+// Control channels of fault rules are never faulted, to keep
+// services recoverable.
+func (f *faultInjector) inject(service string, point FaultPoint, channel, method string) *fault {
+	if !faultInjection || strings.HasPrefix(channel, EndpointFaultsPrefix) {
+		return nil
+	}
+
+	f.RLock()
+	enabled, rules := f.enabled, f.rules
+	f.RUnlock()
+
+	if !enabled {
+		return nil
+	}
+
+	var result *fault
+	for _, r := range rules {
+		if !r.matches(point, channel, method) || !r.fires() {
+			continue
+		}
+
+		if result == nil {
+			result = &fault{}
+		}
+
+		faultsInjected.Inc(service, string(point), string(r.Kind))
+		log.Debugf("%s inject %s fault on %s of %s", service, r.Kind, point, ruleKey(channel, method))
+
+		switch r.Kind {
+		case FaultDelay:
+			result.delay += time.Duration(r.Latency) * time.Millisecond
+		case FaultDrop:
+			result.drop = true
+			return result
+		case FaultError:
+			result.failure = r
+			return result
+		case FaultCorrupt:
+			result.corrupt = true
+		}
+	}
+
+	return result
+}
+
+// corrupt returns a copy of data having random bytes flipped.
+func corrupt(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+
+	bad := append([]byte{}, data...)
+	for i := 0; i <= len(bad)/16; i++ {
+		bad[rand.Intn(len(bad))] ^= 0xff
+	}
+
+	return bad
+}
+
+// peekMethod returns the method and id of a JSON-RPC request,
+// or an empty method if data is not a request.
+func peekMethod(data []byte) (string, int) {
+	req := &struct {
+		ID     int    `json:"id"`
+		Method string `json:"method"`
+	}{}
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, req) != nil {
+		return "", 0
+	}
+
+	return req.Method, req.ID
+}
+
+// WithFaultInjection enables fault rules of the service, which are
+// ignored otherwise, and by services built with the production tag.
+//
+// The control channel of fault rules, see EndpointFaultsPrefix, is
+// exposed only if control is not nil, and is restricted to callers
+// allowed by it, i.e. callers must sign their identity, see WithIdentity.
+func WithFaultInjection(control *AccessRule) Option {
+	return func(s *MetaService) {
+		s.faults.enable()
+		if control != nil {
+			s.acl.setRule(EndpointFaultsPrefix+s.name, "", control)
+		}
+	}
+}
+
+// WithFaults sets fault rules of the service, see SetFaults.
+func WithFaults(rules ...*FaultRule) Option {
+	return func(s *MetaService) {
+		s.faults.set(rules)
+	}
+}
+
+// SetFaults replaces fault rules of the service, which make its
+// messages misbehave on purpose to test resilience, and clears
+// them if rules is empty. Rules are evaluated in order.
+//
+// Fault rules are ignored unless enabled by WithFaultInjection.
+func (s *MetaService) SetFaults(rules []*FaultRule) {
+	s.faults.set(rules)
+	log.Infof("%s fault rules set, %d rules", s.Name(), len(rules))
+}
+
+// Faults returns fault rules of the service.
+func (s *MetaService) Faults() []*FaultRule {
+	return s.faults.list()
+}
+
+// exposeFaults exposes the control channel of fault rules, if fault
+// injection is enabled, and the channel is restricted by an access rule.
+func (s *MetaService) exposeFaults() {
+	channel := EndpointFaultsPrefix + s.name
+	if !s.faults.active() || s.acl.rule(channel, "") == nil {
+		return
+	}
+
+	// not listed in endpoints of the service
+	err := s.expose(channel, func(_ context.Context, data []byte) ([]byte, error) {
+		// the rule may be removed by SetAccessRule after exposed
+		if s.acl.rule(channel, "") == nil {
+			return deniedReply(channel), nil
+		}
+
+		req := &FaultControl{}
+		if len(data) != 0 {
+			if err := json.Unmarshal(data, req); err != nil {
+				return nil, err
+			}
+		}
+
+		if req.Rules != nil {
+			s.SetFaults(req.Rules)
+		}
+
+		return json.Marshal(&FaultControl{Rules: s.Faults(), Enabled: s.faults.active()})
+	})
+	if err != nil {
+		log.Warnf("%s expose fault control failed: %v", s.Name(), err)
+	}
+}
+
+// injectNotify applies faults to a notice of the topic, and returns
+// the payload to publish, and whether to publish it.
+func (s *MetaService) injectNotify(topic string, data []byte) ([]byte, bool, error) {
+	f := s.faults.inject(s.name, FaultOnNotify, topic, "")
+	if f == nil {
+		return data, true, nil
+	}
+
+	f.wait()
+	switch {
+	case f.drop:
+		return nil, false, nil
+	case f.failure != nil:
+		return nil, false, f.failure.err()
+	case f.corrupt:
+		return corrupt(data), true, nil
+	}
+
+	return data, true, nil
+}
+
+// injectCall applies faults to a call of the channel, and returns
+// the payload to send, or the error ending the call.
+func (s *MetaService) injectCall(name string, data []byte, to time.Duration) ([]byte, error) {
+	method, _ := peekMethod(data)
+	f := s.faults.inject(s.name, FaultOnCall, name, method)
+	if f == nil {
+		return data, nil
+	}
+
+	f.wait()
+	switch {
+	case f.drop:
+		// lost requests end as timeouts reported by messagers
+		time.Sleep(to)
+		return nil, ErrTimeout
+	case f.failure != nil:
+		return nil, f.failure.err()
+	case f.corrupt:
+		return corrupt(data), nil
+	}
+
+	return data, nil
+}
+
+// injectHandle wraps the handler of the channel, in effect, to apply
+// faults to requests. JSON-RPC requests failed by FaultError rules
+// are replied with the error code of the rule.
+func (s *MetaService) injectHandle(channel string, data []byte, handle func([]byte) ([]byte, error)) ([]byte, error) {
+	var method string
+	var id int
+	rpc := s.exposer.Router().Channel(channel) != nil
+	if rpc {
+		method, id = peekMethod(data)
+	}
+
+	f := s.faults.inject(s.name, FaultOnHandle, channel, method)
+	if f == nil {
+		return handle(data)
+	}
+
+	f.wait()
+	switch {
+	case f.drop:
+		// replies are not sent if handlers fail
+		return nil, ErrFaultInjected
+	case f.failure != nil:
+		if !rpc {
+			return nil, f.failure.err()
+		}
+
+		code := f.failure.Code
+		if code == 0 {
+			code = jsonrpc2.ErrServerInternal
+		}
+
+		rsp := jsonrpc2.NewErrorResponse(code, f.failure.err().Error())
+		rsp.ID = id
+		return rsp.Marshal()
+	}
+
+	rsp, err := handle(data)
+	if err == nil && f.corrupt {
+		rsp = corrupt(rsp)
+	}
+
+	return rsp, err
+}
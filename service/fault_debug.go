@@ -0,0 +1,6 @@
+//go:build !production
+
+package service
+
+// faultInjection allows fault rules, see WithFaultInjection.
+const faultInjection = true
@@ -0,0 +1,6 @@
+//go:build production
+
+package service
+
+// faultInjection disables fault rules in production builds.
+const faultInjection = false
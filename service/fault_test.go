@@ -0,0 +1,127 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFaultRuleMatches(t *testing.T) {
+	r := &FaultRule{Point: FaultOnHandle, Target: "/echo/*#say*"}
+	assert.True(t, r.matches(FaultOnHandle, "/echo/rpc", "sayHi"))
+	assert.False(t, r.matches(FaultOnHandle, "/echo/rpc", "echo"))
+	assert.False(t, r.matches(FaultOnCall, "/echo/rpc", "sayHi"))
+	assert.False(t, r.matches(FaultOnHandle, "/other/rpc", "sayHi"))
+
+	r = &FaultRule{Target: "/echo/*"}
+	assert.True(t, r.matches(FaultOnNotify, "/echo/x", ""))
+	assert.True(t, r.matches(FaultOnCall, "/echo/rpc", "any"))
+
+	f := &faultInjector{enabled: true, rules: []*FaultRule{{Target: "*", Kind: FaultDrop, Probability: 1e-9}}}
+	assert.Nil(t, f.inject("s", FaultOnCall, "x", ""))
+
+	// rules are ignored unless enabled
+	f = &faultInjector{rules: []*FaultRule{{Target: "*", Kind: FaultDrop}}}
+	assert.Nil(t, f.inject("s", FaultOnCall, "x", ""))
+}
+
+func TestFaultInjection(t *testing.T) {
+	s := newInProcService(t, "faulty", WithIdentity([]byte("secret"), "ops"),
+		WithFaultInjection(&AccessRule{Roles: []string{"ops"}}))
+
+	received := make(chan string, 4)
+	require.Nil(t, s.Listen("/faulty/notice", func(data []byte) { received <- string(data) }))
+
+	echo := NewMethod[echoReq, echoRsp]("/faulty/rpc", "echo")
+	echo.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		return &echoRsp{Text: req.Text}, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+	require.Nil(t, s.ExposeMethod("/faulty/raw", func(data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	// notices
+	s.SetFaults([]*FaultRule{{Point: FaultOnNotify, Target: "/faulty/*", Kind: FaultDrop}})
+	require.Nil(t, s.Notify("/faulty/notice", []byte("lost")))
+	s.SetFaults([]*FaultRule{{Point: FaultOnNotify, Target: "/faulty/*", Kind: FaultCorrupt}})
+	require.Nil(t, s.Notify("/faulty/notice", []byte("payload")))
+	select {
+	case data := <-received:
+		assert.Len(t, data, len("payload"))
+		assert.NotEqual(t, "payload", data)
+	case <-time.After(time.Second):
+		t.Fatal("corrupted notice not received")
+	}
+	s.SetFaults([]*FaultRule{{Point: FaultOnNotify, Target: "/faulty/*", Kind: FaultError}})
+	assert.ErrorIs(t, s.Notify("/faulty/notice", []byte("failed")), ErrFaultInjected)
+	assert.Len(t, received, 0)
+
+	// calls
+	s.SetFaults([]*FaultRule{{Point: FaultOnCall, Target: "/faulty/raw", Kind: FaultError, Message: "boom"}})
+	_, err := s.CallMethod("/faulty/raw", []byte("hi"), time.Second)
+	assert.ErrorIs(t, err, ErrFaultInjected)
+	assert.ErrorContains(t, err, "boom")
+
+	s.SetFaults([]*FaultRule{{Point: FaultOnCall, Target: "/faulty/raw", Kind: FaultDelay, Latency: 50}})
+	start := time.Now()
+	rsp, err := s.CallMethod("/faulty/raw", []byte("hi"), time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "hi", string(rsp))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// handlers, JSON-RPC errors carry the code of the rule
+	s.SetFaults([]*FaultRule{{Point: FaultOnHandle, Target: "/faulty/rpc#echo", Kind: FaultError, Code: 4002}})
+	_, err = echo.Invoke(s, &echoReq{Text: "hi"}, time.Second)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrFaultInjected.Error())
+	assert.Contains(t, err.Error(), "4002")
+
+	s.SetFaults([]*FaultRule{{Point: FaultOnHandle, Target: "/faulty/raw", Kind: FaultDrop}})
+	_, err = s.CallMethod("/faulty/raw", []byte("hi"), time.Second)
+	assert.True(t, errors.Is(err, ErrFaultInjected))
+
+	// the control channel is never faulted
+	s.SetFaults([]*FaultRule{{Target: "/pareto/faults/*", Kind: FaultError}})
+	data, err := s.CallMethod(EndpointFaultsPrefix+s.Name(), []byte(`{"rules":[]}`), time.Second)
+	require.Nil(t, err)
+	ctl := &FaultControl{}
+	require.Nil(t, json.Unmarshal(data, ctl))
+	assert.Empty(t, ctl.Rules)
+	assert.True(t, ctl.Enabled)
+	assert.Empty(t, s.Faults())
+
+	reply, err := echo.Invoke(s, &echoReq{Text: "ok"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "ok", reply.Text)
+
+	// callers not allowed by the rule are denied
+	s.SetAccessRule(EndpointFaultsPrefix+s.Name(), "", &AccessRule{Roles: []string{"chaos"}})
+	_, err = s.CallMethod(EndpointFaultsPrefix+s.Name(), []byte(`{"rules":[]}`), 100*time.Millisecond)
+	assert.NotNil(t, err)
+	s.SetAccessRule(EndpointFaultsPrefix+s.Name(), "", nil)
+	_, err = s.CallMethod(EndpointFaultsPrefix+s.Name(), []byte(`{"rules":[]}`), 100*time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestFaultInjectionDisabled(t *testing.T) {
+	// disabled by default, without the control channel
+	s := newInProcService(t, "steady", WithFaults(&FaultRule{Target: "*", Kind: FaultError}))
+	require.Nil(t, s.ExposeMethod("/steady/raw", func(data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	rsp, err := s.CallMethod("/steady/raw", []byte("hi"), time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "hi", string(rsp))
+	_, err = s.CallMethod(EndpointFaultsPrefix+s.Name(), nil, 100*time.Millisecond)
+	assert.NotNil(t, err)
+
+	// enabled without a rule, the control channel is not exposed
+	s = newInProcService(t, "unguarded", WithFaultInjection(nil))
+	_, err = s.CallMethod(EndpointFaultsPrefix+s.Name(), nil, 100*time.Millisecond)
+	assert.NotNil(t, err)
+}
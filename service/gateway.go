@@ -0,0 +1,341 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	GatewayTimeout     = 5       //seconds, default timeout of calls made by the gateway
+	GatewayMaxBodySize = 1 << 20 //bytes, default max size of request bodies
+)
+
+// ErrUnauthorized is returned by GatewayAuthHook to reject
+// requests with 401, other errors are rejected with 403.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Route maps an HTTP path to a channel exposed on the bus, or to a
+// JSON-RPC method routed on the channel if Method is not empty.
+//
+// Requests are accepted with POST only. The body is passed as is to
+// raw channels, or as params to JSON-RPC methods, and the response
+// is written back with 200, see HTTPStatusOf for errors.
+type Route struct {
+	Path    string `json:"path"`              //HTTP path, e.g. /api/echo
+	Channel string `json:"channel"`           //channel called, e.g. /echo/rpc
+	Method  string `json:"method,omitempty"`  //JSON-RPC method, empty for raw channels
+	Service string `json:"service,omitempty"` //if not empty, calls healthy instances of the service only
+
+	Timeout     time.Duration `json:"timeout,omitempty"`     //overrides the timeout of the gateway
+	MaxBodySize int64         `json:"maxBodySize,omitempty"` //overrides the max body size of the gateway
+	ContentType string        `json:"contentType,omitempty"` //of responses of raw channels, application/json by default
+}
+
+// EndpointRoute returns the route of the JSON-RPC method identified by
+// the endpoint, whose path is "/" + e.SerializedName(), calling method
+// e.Method routed on channel "/" + e.Service + "/" + e.Object, e.g.
+//
+//	/echo/rpc/say -> method say of channel /echo/rpc
+func EndpointRoute(e *Endpoint) *Route {
+	return &Route{
+		Path:    "/" + e.SerializedName(),
+		Channel: fmt.Sprintf("/%s/%s", e.Service, e.Object),
+		Method:  e.Method,
+	}
+}
+
+// GatewayAuthHook authorizes HTTP requests before calling the route,
+// and rejects them by returning an error, see ErrUnauthorized.
+type GatewayAuthHook func(r *http.Request, route *Route) error
+
+// GatewayOption customizes a Gateway.
+type GatewayOption func(*Gateway)
+
+// WithRoutes adds routes to the gateway.
+func WithRoutes(routes ...*Route) GatewayOption {
+	return func(g *Gateway) {
+		g.AddRoutes(routes...)
+	}
+}
+
+// WithGatewayTimeout overrides GatewayTimeout of the gateway.
+func WithGatewayTimeout(d time.Duration) GatewayOption {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// WithMaxBodySize overrides GatewayMaxBodySize of the gateway.
+func WithMaxBodySize(n int64) GatewayOption {
+	return func(g *Gateway) {
+		g.maxBodySize = n
+	}
+}
+
+// WithGatewayAuth appends hooks authorizing requests, which
+// are called in order until any of them rejects the request.
+func WithGatewayAuth(hooks ...GatewayAuthHook) GatewayOption {
+	return func(g *Gateway) {
+		g.auth = append(g.auth, hooks...)
+	}
+}
+
+// Gateway exposes channels and JSON-RPC methods on the bus to HTTP
+// clients, calling them using CallMethod of the service it's bound to.
+//
+// Gateway is an http.Handler, and can be mounted on any server,
+// or listen on its own by Start.
+type Gateway struct {
+	service     *MetaService
+	timeout     time.Duration
+	maxBodySize int64
+	auth        []GatewayAuthHook
+
+	mutex  sync.RWMutex
+	routes map[string]*Route //path -> route
+
+	server *AdminServer
+}
+
+// NewGateway creates a gateway calling methods on behalf of the service.
+func NewGateway(s *MetaService, opts ...GatewayOption) *Gateway {
+	g := &Gateway{
+		service:     s,
+		timeout:     GatewayTimeout * time.Second,
+		maxBodySize: GatewayMaxBodySize,
+		routes:      make(map[string]*Route),
+	}
+
+	for _, fn := range opts {
+		fn(g)
+	}
+
+	return g
+}
+
+// AddRoutes adds routes, replacing existing ones of the same path.
+func (g *Gateway) AddRoutes(routes ...*Route) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, r := range routes {
+		g.routes[r.Path] = r
+		log.Debugf("gateway route %s -> %s", r.Path, ruleKey(r.Channel, r.Method))
+	}
+}
+
+// RemoveRoute removes the route of the path.
+func (g *Gateway) RemoveRoute(path string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.routes, path)
+}
+
+func (g *Gateway) route(path string) *Route {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.routes[path]
+}
+
+// Start listens on addr, in format host:port, and serves
+// requests in another goroutine.
+func (g *Gateway) Start(addr string) error {
+	server := NewAdminServer(addr)
+	server.Handle("/", g)
+	if err := server.Start(); err != nil {
+		return err
+	}
+
+	g.server = server
+
+	return nil
+}
+
+// Stop shuts down the server started by Start.
+func (g *Gateway) Stop() {
+	if g.server != nil {
+		g.server.Stop()
+		g.server = nil
+	}
+}
+
+// Addr returns the address listened on, or an empty string if not started.
+func (g *Gateway) Addr() string {
+	if g.server == nil {
+		return ""
+	}
+
+	return g.server.Addr()
+}
+
+// ServeHTTP calls the route of the request path.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := g.route(r.URL.Path)
+	if route == nil {
+		writeGatewayError(w, http.StatusNotFound, "no route of "+r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	for _, hook := range g.auth {
+		if err := hook(r, route); err != nil {
+			code := http.StatusForbidden
+			if errors.Is(err, ErrUnauthorized) {
+				code = http.StatusUnauthorized
+			}
+
+			writeGatewayError(w, code, err.Error())
+			return
+		}
+	}
+
+	limit := g.maxBodySize
+	if route.MaxBodySize > 0 {
+		limit = route.MaxBodySize
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			writeGatewayError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	timeout := g.timeout
+	if route.Timeout > 0 {
+		timeout = route.Timeout
+	}
+
+	var opts []CallOption
+	if len(route.Service) != 0 {
+		opts = append(opts, ToAnyInstance(route.Service, RoundRobin))
+	}
+
+	if len(route.Method) != 0 {
+		g.invoke(r.Context(), w, route, body, timeout, opts)
+	} else {
+		g.call(r.Context(), w, route, body, timeout, opts)
+	}
+}
+
+// invoke calls the JSON-RPC method of the route with body as params.
+func (g *Gateway) invoke(ctx context.Context, w http.ResponseWriter, route *Route,
+	body []byte, timeout time.Duration, opts []CallOption) {
+	params := json.RawMessage("{}")
+	if len(body) != 0 {
+		if !json.Valid(body) {
+			writeGatewayError(w, http.StatusBadRequest, "malformed JSON body")
+			return
+		}
+
+		params = body
+	}
+
+	method := NewMethod[json.RawMessage, json.RawMessage](route.Channel, route.Method)
+	rsp, err := method.InvokeContext(ctx, g.service, &params, timeout, opts...)
+	if err != nil {
+		g.fail(w, route, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(*rsp) == 0 {
+		*rsp = json.RawMessage("null")
+	}
+	_, _ = w.Write(*rsp)
+}
+
+// call calls the raw channel of the route with body as the payload.
+func (g *Gateway) call(ctx context.Context, w http.ResponseWriter, route *Route,
+	body []byte, timeout time.Duration, opts []CallOption) {
+	rsp, err := g.service.CallMethodContext(ctx, route.Channel, body, timeout, opts...)
+	if err != nil {
+		g.fail(w, route, err)
+		return
+	}
+
+	contentType := route.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(rsp)
+}
+
+func (g *Gateway) fail(w http.ResponseWriter, route *Route, err error) {
+	log.Debugf("gateway call %s failed: %v", ruleKey(route.Channel, route.Method), err)
+
+	var rpcErr *jsonrpc2.RPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		writeJSON(w, HTTPStatusOf(rpcErr.Code), &gatewayError{Error: rpcErr})
+	case errors.Is(err, ErrAccessDenied):
+		writeGatewayError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrBusy):
+		writeGatewayError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, ErrNoHealthyInstance), errors.Is(err, ErrCircuitOpen):
+		writeGatewayError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, ErrTimeout):
+		writeGatewayError(w, http.StatusGatewayTimeout, err.Error())
+	default:
+		writeGatewayError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// gatewayStatus maps JSON-RPC error codes to HTTP status codes.
+var gatewayStatus = map[int]int{
+	jsonrpc2.ErrParseNotWellFormed:            http.StatusBadRequest,
+	jsonrpc2.ErrParseUnsupportedEncoding:      http.StatusBadRequest,
+	jsonrpc2.ErrParseInvalidCharacterEncoding: http.StatusBadRequest,
+	jsonrpc2.ErrServerInvalid:                 http.StatusBadRequest,
+	jsonrpc2.ErrServerMethodNotFound:          http.StatusNotFound,
+	jsonrpc2.ErrServerInvalidParameters:       http.StatusBadRequest,
+	jsonrpc2.ErrServerInternal:                http.StatusInternalServerError,
+	jsonrpc2.ErrServerInvalidMessageId:        http.StatusBadGateway,
+	jsonrpc2.ErrServerAccessDenied:            http.StatusForbidden,
+	jsonrpc2.ErrServerBusy:                    http.StatusTooManyRequests,
+	jsonrpc2.ErrApplicationError:              http.StatusInternalServerError,
+	jsonrpc2.ErrSystemError:                   http.StatusInternalServerError,
+	jsonrpc2.ErrTransportError:                http.StatusBadGateway,
+}
+
+// HTTPStatusOf returns the HTTP status code of the JSON-RPC error
+// code, which is 500 for codes defined by applications.
+func HTTPStatusOf(code int) int {
+	if status, ok := gatewayStatus[code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// gatewayError is the body of error responses of the gateway, carrying
+// the JSON-RPC error of the callee, or an error of the gateway itself
+// whose code is the HTTP status code.
+type gatewayError struct {
+	Error *jsonrpc2.RPCError `json:"error"`
+}
+
+func writeGatewayError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, &gatewayError{Error: &jsonrpc2.RPCError{Code: code, Message: msg}})
+}
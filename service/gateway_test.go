@@ -0,0 +1,127 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	s := newInProcService(t, "gateway")
+
+	echo := NewMethod[echoReq, echoRsp]("/gateway/rpc", "echo")
+	echo.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		if req.Text == "fail" {
+			return nil, jsonrpc2.NewErrorWithMsg(4001, "failed as asked")
+		}
+		return &echoRsp{Text: req.Text}, nil
+	})
+	secret := NewMethod[echoReq, echoRsp]("/gateway/rpc", "secret")
+	secret.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		return &echoRsp{Text: req.Text}, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+	s.SetAccessRule("/gateway/rpc", "secret", &AccessRule{Roles: []string{"ops"}})
+
+	require.Nil(t, s.ExposeMethod("/gateway/raw", func(data []byte) ([]byte, error) {
+		if len(data) == 0 {
+			return nil, errors.New("empty")
+		}
+		return data, nil
+	}))
+
+	route := EndpointRoute(&Endpoint{Service: "gateway", Object: "rpc", Method: "echo"})
+	assert.Equal(t, "/gateway/rpc/echo", route.Path)
+
+	g := NewGateway(s,
+		WithRoutes(route,
+			&Route{Path: "/api/secret", Channel: "/gateway/rpc", Method: "secret"},
+			&Route{Path: "/api/missing", Channel: "/gateway/rpc", Method: "missing"},
+			&Route{Path: "/api/raw", Channel: "/gateway/raw", ContentType: "text/plain", MaxBodySize: 8}),
+		WithGatewayTimeout(time.Second),
+		WithGatewayAuth(func(r *http.Request, route *Route) error {
+			if r.Header.Get("Authorization") != "Bearer t" {
+				return ErrUnauthorized
+			}
+			return nil
+		}))
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	post := func(path, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer t")
+		rsp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer rsp.Body.Close()
+		data, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(bytes.TrimSpace(data))
+	}
+
+	code, body := post("/gateway/rpc/echo", `{"text":"hi"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"text":"hi","count":0}`, body)
+
+	code, body = post("/gateway/rpc/echo", `{"text":"fail"}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Contains(t, body, `"code":4001`)
+
+	code, _ = post("/gateway/rpc/echo", `{"text":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("/gateway/rpc/echo", `{`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("/api/secret", `{}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	// the router reports unknown methods as internal errors
+	code, body = post("/api/missing", `{}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Contains(t, body, "method not found")
+	code, _ = post("/nowhere", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, http.StatusTooManyRequests, HTTPStatusOf(jsonrpc2.ErrServerBusy))
+
+	code, body = post("/api/raw", "hello")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", body)
+	code, _ = post("/api/raw", "")
+	assert.Equal(t, http.StatusBadGateway, code)
+	code, _ = post("/api/raw", "too large body")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// failures of reading the body other than its size are bad requests
+	req := httptest.NewRequest(http.MethodPost, "/api/raw", iotest.ErrReader(errors.New("reset")))
+	req.Header.Set("Authorization", "Bearer t")
+	recorder := httptest.NewRecorder()
+	g.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	g.fail(recorder, route, fmt.Errorf("call: %w", ErrTimeout))
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+
+	// denied raw calls are replied, and reported as forbidden
+	s.SetAccessRule("/gateway/raw", "", &AccessRule{Roles: []string{"ops"}})
+	code, _ = post("/api/raw", "hello")
+	assert.Equal(t, http.StatusForbidden, code)
+	s.SetAccessRule("/gateway/raw", "", nil)
+
+	rsp, err := http.Get(server.URL + "/api/raw")
+	require.Nil(t, err)
+	_ = rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+	rsp, err = http.Post(server.URL+"/api/raw", "text/plain", strings.NewReader("hi"))
+	require.Nil(t, err)
+	_ = rsp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HealthCheckTimeout  = 2 //seconds
+	HealthCheckInterval = 5 //seconds
+)
+
+// MetricsHealth is the section name of health
+// check details in Status.Metrics.
+const MetricsHealth = "health"
+
+// CheckKind defines the kind of a health check.
+type CheckKind int
+
+const (
+	Readiness CheckKind = iota // failures make the service not ready
+	Liveness                   // failures make the service not alive, see MetaService.Fail
+)
+
+func (k CheckKind) String() string {
+	switch k {
+	case Readiness:
+		return "readiness"
+	case Liveness:
+		return "liveness"
+	default:
+		return "unknown"
+	}
+}
+
+// HealthCheck defines a named probe executed periodically,
+// e.g. a database ping or a broker connectivity check.
+type HealthCheck struct {
+	//Name identifies the check within a service, mandatory.
+	Name string
+
+	//Kind of the check, Readiness by default.
+	Kind CheckKind
+
+	//Check probes the health and returns non-nil error
+	//when unhealthy. The context is canceled when Timeout
+	//expires, mandatory.
+	Check func(ctx context.Context) error
+
+	//Timeout of each probe, 2s by default.
+	Timeout time.Duration
+
+	//Interval between two probes, 5s by default.
+	Interval time.Duration
+
+	//Threshold defines number of consecutive failures
+	//before the check is treated as unhealthy, 1 by default.
+	Threshold uint32
+}
+
+// CheckResult defines the latest result of a health check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+	Failures uint32 `json:"failures,omitempty"` //consecutive failures
+	Duration int64  `json:"duration"`           //probe duration in milliseconds
+	Time     uint64 `json:"time"`               //probe timestamp in milliseconds
+}
+
+// HealthReport aggregates results of all health checks.
+type HealthReport struct {
+	Live   bool           `json:"live"`
+	Ready  bool           `json:"ready"`
+	Checks []*CheckResult `json:"checks,omitempty"`
+}
+
+type checkRunner struct {
+	check  *HealthCheck
+	result *CheckResult
+	quit   chan struct{}
+}
+
+// healthChecker runs health checks of a service and
+// aggregates their results.
+type healthChecker struct {
+	sync.RWMutex
+	runners map[string]*checkRunner
+	running bool
+	dead    bool //liveness checks failed, since last reported
+	wg      sync.WaitGroup
+
+	//called when any check result changes
+	onChange func(report *HealthReport)
+}
+
+func newHealthChecker(onChange func(report *HealthReport)) *healthChecker {
+	return &healthChecker{
+		runners:  make(map[string]*checkRunner),
+		onChange: onChange,
+	}
+}
+
+func (h *healthChecker) add(c *HealthCheck) error {
+	if c == nil || len(c.Name) == 0 || c.Check == nil {
+		return errors.New("health check name and function must not be empty")
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = HealthCheckTimeout * time.Second
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = HealthCheckInterval * time.Second
+	}
+
+	box.SetIfEq(&c.Threshold, 0, 1)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.runners[c.Name]; ok {
+		return fmt.Errorf("health check %s already exists", c.Name)
+	}
+
+	r := &checkRunner{
+		check: c,
+		result: &CheckResult{
+			Name: c.Name,
+			Kind: c.Kind.String(),
+		},
+		quit: make(chan struct{}),
+	}
+
+	h.runners[c.Name] = r
+	if h.running {
+		h.launch(r)
+	}
+
+	return nil
+}
+
+func (h *healthChecker) remove(name string) {
+	h.Lock()
+	r, ok := h.runners[name]
+	if ok {
+		delete(h.runners, name)
+		if h.running {
+			close(r.quit)
+		}
+	}
+	h.Unlock()
+
+	if ok {
+		h.notify()
+	}
+}
+
+func (h *healthChecker) start() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.running {
+		return
+	}
+
+	h.running = true
+	for _, r := range h.runners {
+		r.quit = make(chan struct{})
+		h.launch(r)
+	}
+}
+
+func (h *healthChecker) stop() {
+	h.Lock()
+	if !h.running {
+		h.Unlock()
+		return
+	}
+
+	h.running = false
+	for _, r := range h.runners {
+		close(r.quit)
+	}
+	h.Unlock()
+
+	h.wg.Wait()
+}
+
+// empty returns true if no check of the given kind exists.
+func (h *healthChecker) empty(kind CheckKind) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, r := range h.runners {
+		if r.check.Kind == kind {
+			return false
+		}
+	}
+
+	return true
+}
+
+// report returns a snapshot of the aggregated results.
+// A service is live/ready iff all its liveness/readiness
+// checks are healthy.
+func (h *healthChecker) report() *HealthReport {
+	h.RLock()
+	defer h.RUnlock()
+
+	report := &HealthReport{Live: true, Ready: true}
+	for _, r := range h.runners {
+		result := *r.result
+		report.Checks = append(report.Checks, &result)
+
+		if !result.Healthy {
+			if r.check.Kind == Liveness {
+				report.Live = false
+			} else {
+				report.Ready = false
+			}
+		}
+	}
+
+	sort.Slice(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+
+	return report
+}
+
+// died returns the failed liveness checks if the report turns the
+// service from alive to not alive, where checks not yet probed are
+// ignored, and remembers the liveness of the report.
+func (h *healthChecker) died(report *HealthReport) []string {
+	var failed []string
+	for _, c := range report.Checks {
+		if c.Kind == Liveness.String() && !c.Healthy && c.Time != 0 {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	dead := h.dead
+	h.dead = len(failed) != 0
+	if dead {
+		return nil
+	}
+
+	return failed
+}
+
+// launch runs the check loop of a runner, must be called with lock held.
+func (h *healthChecker) launch(r *checkRunner) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(r.check.Interval)
+		defer ticker.Stop()
+
+		for {
+			h.probe(r)
+
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (h *healthChecker) probe(r *checkRunner) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.check.Timeout)
+	defer cancel()
+
+	begin := time.Now()
+	err := runCheck(ctx, r.check.Check)
+	elapsed := time.Since(begin)
+
+	h.Lock()
+	old := *r.result
+	result := r.result
+	result.Time = box.TimeNowMs()
+	result.Duration = elapsed.Milliseconds()
+	if err != nil {
+		result.Failures++
+		result.Error = err.Error()
+		if result.Failures >= r.check.Threshold {
+			result.Healthy = false
+		}
+	} else {
+		result.Failures = 0
+		result.Error = ""
+		result.Healthy = true
+	}
+	changed := old.Healthy != result.Healthy || old.Time == 0
+	h.Unlock()
+
+	if err != nil {
+		log.Debugf("health check %s failed: %v", r.check.Name, err)
+	}
+
+	if changed {
+		h.notify()
+	}
+}
+
+func (h *healthChecker) notify() {
+	if h.onChange != nil {
+		h.onChange(h.report())
+	}
+}
+
+// runCheck runs fn and returns its error, or the context
+// error if fn does not return before the context is done.
+func runCheck(ctx context.Context, fn func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("health check panic: %v", p)
+			}
+		}()
+
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddHealthCheck registers a health check, which is run periodically
+// once the service is started. When any readiness check exists,
+// readiness of the service, while servicing, is driven by the aggregated
+// result of readiness checks, and SetReady should not be called manually.
+func (s *MetaService) AddHealthCheck(c *HealthCheck) error {
+	return s.health.add(c)
+}
+
+// RemoveHealthCheck removes the health check of the given name, if any.
+func (s *MetaService) RemoveHealthCheck(name string) {
+	s.health.remove(name)
+}
+
+// Health returns the aggregated report of health checks.
+func (s *MetaService) Health() *HealthReport {
+	return s.health.report()
+}
+
+// onHealthChanged reports the service as failed once liveness checks
+// fail, which restarts it if supervised, and drives readiness by
+// readiness checks.
+func (s *MetaService) onHealthChanged(report *HealthReport) {
+	if failed := s.health.died(report); len(failed) != 0 {
+		s.Fail(fmt.Errorf("liveness checks failed: %s", strings.Join(failed, ", ")))
+	}
+
+	if s.health.empty(Readiness) || s.State() != Servicing {
+		return
+	}
+
+	if s.Ready() != report.Ready {
+		log.Infof("service %s readiness changed to %v by health checks", s.Name(), report.Ready)
+		s.SetReady(report.Ready)
+	}
+}
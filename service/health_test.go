@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/ipc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newInProcService(t *testing.T, name string, opts ...Option) *MetaService {
+	m, err := ipc.NewMessager(&ipc.MessagerConf{
+		BusConf: &ipc.BusConf{Name: name + "-bus", Type: ipc.InnerProcBus},
+		RpcConf: &ipc.RPCConf{Name: name + "-rpc", Type: ipc.InnerProcRpc},
+	})
+	require.Nil(t, err)
+
+	s := NewMetaService(&Descriptor{Name: name, Registry: "inproc"}, append(opts, WithMessager(m))...)
+	require.NotNil(t, s)
+
+	return s
+}
+
+func TestHealthCheckDrivesReadiness(t *testing.T) {
+	s := newInProcService(t, "health")
+
+	var failing atomic.Bool
+	require.Nil(t, s.AddHealthCheck(&HealthCheck{
+		Name:     "db",
+		Interval: 20 * time.Millisecond,
+		Check: func(ctx context.Context) error {
+			if failing.Load() {
+				return errors.New("db down")
+			}
+			return nil
+		},
+	}))
+	require.Nil(t, s.AddHealthCheck(&HealthCheck{
+		Name:     "loop",
+		Kind:     Liveness,
+		Timeout:  10 * time.Millisecond,
+		Interval: 20 * time.Millisecond,
+		Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}))
+	assert.NotNil(t, s.AddHealthCheck(&HealthCheck{Name: "db", Check: func(context.Context) error { return nil }}))
+
+	failures := make(chan error, 4)
+	s.setFailureHook(func(err error) { failures <- err })
+
+	s.SetState(Servicing)
+	s.startBuiltins()
+	defer s.stopBuiltins()
+
+	assert.Eventually(t, s.Ready, time.Second, 10*time.Millisecond)
+
+	// failing liveness checks fail the service once
+	select {
+	case err := <-failures:
+		assert.ErrorContains(t, err, "loop: context deadline exceeded")
+	case <-time.After(time.Second):
+		t.Fatal("service not failed by liveness check")
+	}
+
+	failing.Store(true)
+	assert.Eventually(t, func() bool { return !s.Ready() }, time.Second, 10*time.Millisecond)
+
+	report := s.Health()
+	assert.False(t, report.Live)
+	assert.False(t, report.Ready)
+	require.Len(t, report.Checks, 2)
+	assert.Equal(t, "db down", report.Checks[0].Error)
+
+	metrics := s.collectMetrics()
+	assert.Contains(t, metrics, MetricsHealth)
+	assert.Len(t, failures, 0)
+}
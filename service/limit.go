@@ -0,0 +1,416 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/config"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsLimits = "limits"
+
+	limitIdleTimeout = time.Minute //buckets of callers idle longer are dropped
+
+	busyHeader = "busy" //metadata key of replies to raw calls rejected, see busyReply
+)
+
+// ErrBusy is returned by calls of raw channels rejected by limits.
+// Rejected JSON-RPC calls get an ErrServerBusy error instead.
+var ErrBusy = errors.New("server busy")
+
+// Limit defines how many calls a channel, or a JSON-RPC method,
+// accepts. Zero values are unlimited.
+//
+// Rates are enforced by token buckets refilled at the rate, holding
+// at most the burst of calls, which is the rate rounded up if zero.
+type Limit struct {
+	Rate  float64 `json:"rate,omitempty"`  //calls per second of each caller
+	Burst int     `json:"burst,omitempty"` //calls of each caller at once
+
+	MethodRate  float64 `json:"methodRate,omitempty"`  //calls per second of all callers
+	MethodBurst int     `json:"methodBurst,omitempty"` //calls of all callers at once
+
+	Concurrency int `json:"concurrency,omitempty"` //calls handled at the same time
+}
+
+// LimitRule is the limit of a channel, or of a JSON-RPC method
+// routed on it if Method is not empty, in configs.
+type LimitRule struct {
+	Channel string `json:"channel"`
+	Method  string `json:"method,omitempty"`
+	Limit   *Limit `json:"limit"`
+}
+
+// LimitStatus reports calls of a channel, or of a JSON-RPC
+// method, admitted and rejected by limits.
+type LimitStatus struct {
+	Channel  string `json:"channel"`
+	Method   string `json:"method,omitempty"`
+	InFlight int    `json:"inFlight"`
+	Callers  int    `json:"callers"` //callers having a bucket
+	Admitted uint64 `json:"admitted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if any, after refilling tokens since last taken.
+func (b *bucket) take(rate float64, burst int, now time.Time) bool {
+	capacity := float64(burst)
+	if burst <= 0 {
+		capacity = math.Ceil(rate)
+	}
+
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// refund gives back a token taken by a call rejected afterwards.
+func (b *bucket) refund() {
+	b.tokens++
+}
+
+// limitState holds buckets and counters of a channel or method.
+type limitState struct {
+	inFlight int
+	method   bucket
+	callers  map[string]*bucket //caller service -> bucket
+
+	admitted uint64
+	rejected uint64
+}
+
+// limiter holds limits of channels and methods, and their states,
+// keyed by ruleKey, where methods limited by the rule of their
+// channel have states of their own.
+type limiter struct {
+	sync.Mutex
+	rules  map[string]*Limit
+	states map[string]*limitState
+	pruned time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		rules:  make(map[string]*Limit),
+		states: make(map[string]*limitState),
+	}
+}
+
+func (l *limiter) set(channel, method string, limit *Limit) {
+	l.Lock()
+	defer l.Unlock()
+
+	k := ruleKey(channel, method)
+	if limit == nil {
+		delete(l.rules, k)
+	} else {
+		l.rules[k] = limit
+	}
+}
+
+func (l *limiter) reset(rules []*LimitRule) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.rules = make(map[string]*Limit, len(rules))
+	for _, r := range rules {
+		if r.Limit != nil {
+			l.rules[ruleKey(r.Channel, r.Method)] = r.Limit
+		}
+	}
+}
+
+func (l *limiter) list() []*LimitRule {
+	l.Lock()
+	defer l.Unlock()
+
+	var result []*LimitRule
+	for k, limit := range l.rules {
+		channel, method := splitRuleKey(k)
+		result = append(result, &LimitRule{Channel: channel, Method: method, Limit: limit})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return ruleKey(result[i].Channel, result[i].Method) < ruleKey(result[j].Channel, result[j].Method)
+	})
+
+	return result
+}
+
+// admit admits a call of the method by the caller, and returns the
+// function releasing it, or the reason why the call is rejected.
+func (l *limiter) admit(channel, method, caller string) (func(), string) {
+	l.Lock()
+	defer l.Unlock()
+
+	limit, ok := l.rules[ruleKey(channel, method)]
+	if !ok && len(method) != 0 {
+		limit, ok = l.rules[ruleKey(channel, "")]
+	}
+
+	if !ok {
+		return nil, ""
+	}
+
+	now := time.Now()
+	l.prune(now)
+
+	k := ruleKey(channel, method)
+	st := l.states[k]
+	if st == nil {
+		st = &limitState{callers: make(map[string]*bucket)}
+		l.states[k] = st
+	}
+
+	reason := ""
+	switch {
+	case limit.Concurrency > 0 && st.inFlight >= limit.Concurrency:
+		reason = "concurrency limit"
+	case limit.Rate > 0 && !st.caller(caller).take(limit.Rate, limit.Burst, now):
+		reason = "rate limit of caller"
+	case limit.MethodRate > 0 && !st.method.take(limit.MethodRate, limit.MethodBurst, now):
+		reason = "rate limit"
+		if limit.Rate > 0 {
+			st.caller(caller).refund()
+		}
+	}
+
+	if len(reason) != 0 {
+		st.rejected++
+		return nil, reason
+	}
+
+	st.admitted++
+	st.inFlight++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			st.inFlight--
+			l.Unlock()
+		})
+	}, ""
+}
+
+func (st *limitState) caller(name string) *bucket {
+	b := st.callers[name]
+	if b == nil {
+		b = &bucket{}
+		st.callers[name] = b
+	}
+
+	return b
+}
+
+// prune drops buckets of callers idle for limitIdleTimeout,
+// which are full again, and states of methods no longer limited.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < limitIdleTimeout {
+		return
+	}
+
+	l.pruned = now
+	for k, st := range l.states {
+		for name, b := range st.callers {
+			if now.Sub(b.last) > limitIdleTimeout {
+				delete(st.callers, name)
+			}
+		}
+
+		channel, _ := splitRuleKey(k)
+		_, limited := l.rules[k]
+		_, channelLimited := l.rules[channel]
+		if !limited && !channelLimited && st.inFlight == 0 {
+			delete(l.states, k)
+		}
+	}
+}
+
+func (l *limiter) status() []*LimitStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	var result []*LimitStatus
+	for k, st := range l.states {
+		channel, method := splitRuleKey(k)
+		result = append(result, &LimitStatus{
+			Channel:  channel,
+			Method:   method,
+			InFlight: st.inFlight,
+			Callers:  len(st.callers),
+			Admitted: st.admitted,
+			Rejected: st.rejected,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return ruleKey(result[i].Channel, result[i].Method) < ruleKey(result[j].Channel, result[j].Method)
+	})
+
+	return result
+}
+
+// WithLimit limits calls of a channel, or of a JSON-RPC method
+// routed on it if method is not empty, see SetLimit.
+func WithLimit(channel, method string, limit *Limit) Option {
+	return func(s *MetaService) {
+		s.SetLimit(channel, method, limit)
+	}
+}
+
+// WithLimitsConfig loads limits from the config store once, when the
+// service is created, see LoadLimits.
+func WithLimitsConfig(key string) Option {
+	return func(s *MetaService) {
+		if err := s.LoadLimits(key); err != nil {
+			log.Warnf("%s load limits failed: %v", s.Name(), err)
+		}
+	}
+}
+
+// SetLimit limits calls of a channel exposed by the service, or of a
+// JSON-RPC method routed on it if method is not empty, and removes the
+// limit if nil. Limits of methods override the limit of their channel,
+// which applies to each method of the channel on its own.
+//
+// Callers are told apart by their verified identity, see WithIdentity,
+// and anonymous callers share the same buckets.
+//
+// Rejected calls are counted in MetricLimited, and reported, together
+// with admitted ones, in the MetricsLimits section of status metrics.
+func (s *MetaService) SetLimit(channel, method string, limit *Limit) {
+	s.limits.set(channel, method, limit)
+}
+
+// SetLimits replaces all limits of the service.
+func (s *MetaService) SetLimits(rules []*LimitRule) {
+	s.limits.reset(rules)
+	log.Infof("%s limits set, %d rules", s.Name(), len(rules))
+}
+
+// Limits returns limits of the service, sorted by channel and method.
+func (s *MetaService) Limits() []*LimitRule {
+	return s.limits.list()
+}
+
+// LoadLimits replaces limits of the service by the list of LimitRule
+// under the key of the config store, e.g. with key "service.limits":
+//
+//	{"service": {"limits": [
+//		{"channel": "/echo/rpc", "limit": {"rate": 10, "concurrency": 4}},
+//		{"channel": "/echo/rpc", "method": "say", "limit": {"methodRate": 100}}]}}
+//
+// The key is not watched, since the config store does not notify
+// changes, i.e. LoadLimits should be called again to apply changes.
+func (s *MetaService) LoadLimits(key string) error {
+	var rules []*LimitRule
+	if err := config.UnmarshalKey(key, &rules); err != nil {
+		return err
+	}
+
+	s.SetLimits(rules)
+
+	return nil
+}
+
+// admitCall admits a raw call, and returns the function releasing it,
+// or the reply to send if rejected, see busyReply. Channels routed by
+// the JSON-RPC router are admitted by admitRequest instead.
+func (s *MetaService) admitCall(channel string, caller *Caller) (func(), []byte) {
+	if s.exposer.Router().Channel(channel) != nil {
+		return nil, nil
+	}
+
+	release, reason := s.limits.admit(channel, "", callerName(caller))
+	if len(reason) != 0 {
+		s.rejectCall(channel, "", reason)
+		return nil, busyReply(channel + ", " + reason)
+	}
+
+	return release, nil
+}
+
+// busyReply returns the reply to a raw call rejected by limits, which
+// is replied, instead of failing the handler, for callers over NATS not
+// to time out, and is turned into ErrBusy by callers, see openReply.
+func busyReply(detail string) []byte {
+	return sealEnvelope(map[string]string{busyHeader: detail}, nil)
+}
+
+// openReply returns ErrBusy if the reply is a busyReply, ErrAccessDenied
+// if it's a deniedReply, or the reply as is.
+func openReply(data []byte) ([]byte, error) {
+	meta, _ := openEnvelope(data)
+	if detail, ok := meta[busyHeader]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrBusy, detail)
+	}
+
+	if channel, ok := meta[deniedHeader]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAccessDenied, channel)
+	}
+
+	return data, nil
+}
+
+// admitRequest is a jsonrpc2.Admitter enforcing limits of JSON-RPC
+// methods, for callers verified by authorizeRequest.
+func (s *MetaService) admitRequest(channel string, req *jsonrpc2.RPCRequest) (func(), *jsonrpc2.RPCResponse) {
+	release, reason := s.limits.admit(channel, req.Method, callerName(CallerFromContext(req.Context())))
+	if len(reason) == 0 {
+		return release, nil
+	}
+
+	s.rejectCall(channel, req.Method, reason)
+	rsp := jsonrpc2.NewErrorResponse(jsonrpc2.ErrServerBusy,
+		fmt.Sprintf("%s: %s, %s", jsonrpc2.ErrCodeString[jsonrpc2.ErrServerBusy], ruleKey(channel, req.Method), reason))
+	rsp.ID = req.ID
+
+	return nil, rsp
+}
+
+func (s *MetaService) rejectCall(channel, method, reason string) {
+	log.Debugf("%s reject call to %s: %s", s.Name(), ruleKey(channel, method), reason)
+	limitedTotal.Inc(s.name, channel, reason)
+}
+
+// splitRuleKey returns the channel and method of the key, see ruleKey.
+func splitRuleKey(k string) (string, string) {
+	i := strings.LastIndex(k, "#")
+	if i < 0 {
+		return k, ""
+	}
+
+	return k[:i], k[i+1:]
+}
+
+func callerName(c *Caller) string {
+	if c == nil {
+		return ""
+	}
+
+	return c.Service
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/config"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"github.com/zourva/pareto/ipc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &bucket{}
+	assert.True(t, b.take(2, 0, now))
+	assert.True(t, b.take(2, 0, now))
+	assert.False(t, b.take(2, 0, now))
+
+	// refilled at the rate, up to the burst
+	assert.True(t, b.take(2, 0, now.Add(500*time.Millisecond)))
+	assert.False(t, b.take(2, 0, now.Add(500*time.Millisecond)))
+	later := now.Add(time.Hour)
+	assert.True(t, b.take(2, 0, later))
+	assert.True(t, b.take(2, 0, later))
+	assert.False(t, b.take(2, 0, later))
+
+	b = &bucket{}
+	assert.True(t, b.take(0.5, 3, now))
+	assert.True(t, b.take(0.5, 3, now))
+	assert.True(t, b.take(0.5, 3, now))
+	assert.False(t, b.take(0.5, 3, now.Add(time.Second)))
+	assert.True(t, b.take(0.5, 3, now.Add(2*time.Second)))
+
+	// tokens of callers are given back if the method rate rejects the call
+	l := newLimiter()
+	l.set("/ch", "", &Limit{Rate: 1, Burst: 2, MethodRate: 1})
+	release, reason := l.admit("/ch", "", "a")
+	require.Empty(t, reason)
+	release()
+	_, reason = l.admit("/ch", "", "a")
+	assert.Equal(t, "rate limit", reason)
+	assert.InDelta(t, 1, l.states["/ch"].callers["a"].tokens, 0.01)
+
+	// rejections of raw calls are replied, and turned into ErrBusy
+	_, err := openReply(busyReply("/ch, rate limit"))
+	assert.ErrorIs(t, err, ErrBusy)
+	assert.ErrorContains(t, err, "/ch, rate limit")
+	data, err := openReply([]byte("ok"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(data))
+}
+
+func TestLimits(t *testing.T) {
+	m, err := ipc.NewMessager(&ipc.MessagerConf{
+		BusConf: &ipc.BusConf{Name: "limits-bus", Type: ipc.InnerProcBus},
+		RpcConf: &ipc.RPCConf{Name: "limits-rpc", Type: ipc.InnerProcRpc},
+	})
+	require.Nil(t, err)
+
+	key := []byte("secret")
+	s := NewMetaService(&Descriptor{Name: "limited", Registry: "inproc", Limits: []*LimitRule{
+		{Channel: "/limited/rpc", Limit: &Limit{Rate: 2}},
+	}}, WithMessager(m), WithIdentity(key))
+	alpha := NewMetaService(&Descriptor{Name: "alpha", Registry: "inproc"}, WithMessager(m), WithIdentity(key))
+	beta := NewMetaService(&Descriptor{Name: "beta", Registry: "inproc"}, WithMessager(m), WithIdentity(key))
+
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	echo := NewMethod[echoReq, echoRsp]("/limited/rpc", "echo")
+	echo.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		return &echoRsp{Text: req.Text}, nil
+	})
+	slow := NewMethod[echoReq, echoRsp]("/limited/rpc", "slow")
+	slow.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-unblock
+		return &echoRsp{Text: req.Text}, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+	require.Nil(t, s.ExposeMethod("/limited/raw", func(data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	busy := func(err error) bool {
+		var rpcErr *jsonrpc2.RPCError
+		return errors.As(err, &rpcErr) && rpcErr.Code == jsonrpc2.ErrServerBusy
+	}
+
+	// each caller has a bucket of its own
+	for i := 0; i < 2; i++ {
+		_, err = echo.Invoke(alpha, &echoReq{Text: "hi"}, time.Second)
+		require.Nil(t, err)
+	}
+	_, err = echo.Invoke(alpha, &echoReq{Text: "hi"}, time.Second)
+	assert.True(t, busy(err), "%v", err)
+	assert.Contains(t, err.Error(), "rate limit of caller")
+	_, err = echo.Invoke(beta, &echoReq{Text: "hi"}, time.Second)
+	assert.Nil(t, err)
+
+	// method limits override the channel limit, and the
+	// concurrency is released once requests are handled
+	s.SetLimit("/limited/rpc", "slow", &Limit{Concurrency: 1})
+	done := make(chan error)
+	go func() {
+		_, err := slow.Invoke(alpha, &echoReq{Text: "first"}, time.Second)
+		done <- err
+	}()
+	<-entered
+	_, err = slow.Invoke(beta, &echoReq{Text: "second"}, time.Second)
+	assert.True(t, busy(err), "%v", err)
+	assert.Contains(t, err.Error(), "concurrency limit")
+	close(unblock)
+	require.Nil(t, <-done)
+	_, err = slow.Invoke(beta, &echoReq{Text: "third"}, time.Second)
+	assert.Nil(t, err)
+
+	// raw channels shared by all callers
+	s.SetLimit("/limited/raw", "", &Limit{MethodRate: 1})
+	_, err = alpha.CallMethod("/limited/raw", []byte("hi"), time.Second)
+	require.Nil(t, err)
+	_, err = beta.CallMethod("/limited/raw", []byte("hi"), time.Second)
+	assert.ErrorIs(t, err, ErrBusy)
+
+	status := s.collectMetrics()[MetricsLimits].([]*LimitStatus)
+	require.Len(t, status, 3)
+	assert.Equal(t, &LimitStatus{Channel: "/limited/raw", Admitted: 1, Rejected: 1, Callers: 0}, status[0])
+	assert.Equal(t, "echo", status[1].Method)
+	assert.Equal(t, 2, status[1].Callers)
+	assert.Equal(t, uint64(3), status[1].Admitted)
+	assert.Equal(t, uint64(1), status[1].Rejected)
+	assert.Equal(t, "slow", status[2].Method)
+	assert.Equal(t, 0, status[2].InFlight)
+
+	// limits are loaded from the config store
+	path := filepath.Join(t.TempDir(), "limits.json")
+	require.Nil(t, os.WriteFile(path, []byte(`{"limittest": {"limits": [
+		{"channel": "/limited/rpc", "method": "echo", "limit": {"rate": 0.5, "burst": 3, "concurrency": 2}}
+	]}}`), 0644))
+	require.Nil(t, config.GetStore().Load(path, config.Text, config.Json))
+	require.Nil(t, s.LoadLimits("limittest.limits"))
+	assert.Equal(t, []*LimitRule{{Channel: "/limited/rpc", Method: "echo",
+		Limit: &Limit{Rate: 0.5, Burst: 3, Concurrency: 2}}}, s.Limits())
+
+	_, err = slow.Invoke(beta, &echoReq{Text: "unlimited"}, time.Second)
+	assert.Nil(t, err)
+}
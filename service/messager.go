@@ -1,12 +1,61 @@
 package service
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"github.com/zourva/pareto/endec/jsonrpc2"
 	"github.com/zourva/pareto/ipc"
+	"sync"
 	"time"
 )
 
+// InProcScheme prefixes registry addresses served in-process, by
+// inner-proc messagers shared by services of the same address.
+const InProcScheme = "inproc://"
+
+var (
+	inProcLock      sync.Mutex
+	inProcMessagers = make(map[string]*ipc.Messager)
+)
+
+// inProcMessager returns the messager shared by services
+// of the in-process registry, which is created if not exist.
+//
+// Note: a shared endpoint is served by the instance exposing it
+// last, while NATS delivers requests to any of the instances.
+func inProcMessager(registry string) *ipc.Messager {
+	inProcLock.Lock()
+	defer inProcLock.Unlock()
+
+	if m, ok := inProcMessagers[registry]; ok {
+		return m
+	}
+
+	m, err := ipc.NewMessager(&ipc.MessagerConf{
+		BusConf: &ipc.BusConf{Name: registry + "-bus", Type: ipc.InnerProcBus},
+		RpcConf: &ipc.RPCConf{Name: registry + "-rpc", Type: ipc.InnerProcRpc},
+	})
+	if err != nil {
+		log.Errorf("create in-proc messager for %s failed: %v", registry, err)
+		return nil
+	}
+
+	inProcMessagers[registry] = m
+
+	return m
+}
+
+// ReleaseInProc drops the messager shared by services of the in-process
+// registry, if any, which is collected once all services attached to it
+// are stopped. Services created after are attached to a new messager,
+// i.e. ReleaseInProc should be called after stopping them all.
+func ReleaseInProc(registry string) {
+	inProcLock.Lock()
+	defer inProcLock.Unlock()
+
+	delete(inProcMessagers, registry)
+}
+
 type IngressPusher = func(data []byte) ([]byte, error)
 
 type RelayHandler = func(data []byte) ([]byte, error)
@@ -24,7 +73,14 @@ type Messaging interface {
 
 	// ExposeMethod and CallMethod defines RR-mode messaging methods.
 	ExposeMethod(name string, fn ipc.CalleeHandler) error
-	CallMethod(name string, data []byte, to time.Duration) ([]byte, error)
+	CallMethod(name string, data []byte, to time.Duration, opts ...CallOption) ([]byte, error)
+
+	// Context variants of the methods above propagate the trace
+	// carried by the context, see WithTracer.
+	ListenContext(topic string, fn ContextHandler) error
+	NotifyContext(ctx context.Context, topic string, data []byte) error
+	ExposeMethodContext(name string, fn ContextCalleeHandler) error
+	CallMethodContext(ctx context.Context, name string, data []byte, to time.Duration, opts ...CallOption) ([]byte, error)
 
 	// ForwardTo returns a pusher used to push messages,
 	// which will be forwarded to the target anchor to this service.
@@ -73,7 +129,13 @@ type JsonRpcInvoker struct {
 }
 
 func (i *JsonRpcInvoker) Call(channel string, data []byte, to time.Duration) ([]byte, error) {
-	return i.service.CallMethod(channel, data, to)
+	return i.service.CallMethod(channel, data, to, unsigned())
+}
+
+// CallContext implements jsonrpc2.ContextInvoker, applying CallOptions
+// carried by ctx. The trace is propagated in the request by the client.
+func (i *JsonRpcInvoker) CallContext(ctx context.Context, channel string, data []byte, to time.Duration) ([]byte, error) {
+	return i.service.CallMethod(channel, data, to, append(callOptionsFrom(ctx), unsigned())...)
 }
 
 func NewJsonRpcInvoker(service Service) *JsonRpcInvoker {
@@ -0,0 +1,20 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestInProcMessager(t *testing.T) {
+	registry := InProcScheme + "released"
+	m := inProcMessager(registry)
+	assert.NotNil(t, m)
+	assert.Same(t, m, inProcMessager(registry))
+
+	ReleaseInProc(registry)
+	inProcLock.Lock()
+	assert.NotContains(t, inProcMessagers, registry)
+	inProcLock.Unlock()
+	assert.NotSame(t, m, inProcMessager(registry))
+	ReleaseInProc(registry)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"time"
+)
+
+// MethodHandler handles requests of a typed method.
+//
+// Returning a *jsonrpc2.RPCError, possibly wrapped, passes the
+// code, message and data to the caller as is, and any other error
+// is returned to the caller as jsonrpc2.ErrServerInternal.
+type MethodHandler[Req, Rsp any] func(req *Req) (*Rsp, error)
+
+// MethodContextHandler is like MethodHandler, and receives the
+// context of the trace the request belongs to, if any.
+type MethodContextHandler[Req, Rsp any] func(ctx context.Context, req *Req) (*Rsp, error)
+
+// Method defines a JSON-RPC method with typed request and response,
+// routed on a channel of the built-in rpc server of a service.
+//
+// A method is usually declared once and shared by both sides:
+//
+//	var Echo = service.NewMethod[EchoReq, EchoRsp]("/echo/rpc", "echo")
+//
+//	// callee side, before RpcServer().Serve() is called
+//	Echo.Expose(s, func(req *EchoReq) (*EchoRsp, error) {...})
+//
+//	// caller side
+//	rsp, err := Echo.Invoke(s, &EchoReq{...}, time.Second)
+type Method[Req, Rsp any] struct {
+	channel string
+	name    string
+}
+
+// NewMethod creates a typed method of the given name on the channel.
+func NewMethod[Req, Rsp any](channel, name string) *Method[Req, Rsp] {
+	return &Method[Req, Rsp]{
+		channel: channel,
+		name:    name,
+	}
+}
+
+// Channel returns the channel the method is routed on.
+func (m *Method[Req, Rsp]) Channel() string {
+	return m.channel
+}
+
+// Name returns name of the method.
+func (m *Method[Req, Rsp]) Name() string {
+	return m.name
+}
+
+// Expose routes the handler to the method on the router of the
+// service, creating the channel if not exist.
+//
+// Like other router channels, a new channel is bound to the
+// messager only when RpcServer().Serve() is called.
+func (m *Method[Req, Rsp]) Expose(s Messaging, handler MethodHandler[Req, Rsp]) {
+	m.ExposeContext(s, func(_ context.Context, req *Req) (*Rsp, error) {
+		return handler(req)
+	})
+}
+
+// ExposeContext is like Expose, with a handler receiving the context.
+func (m *Method[Req, Rsp]) ExposeContext(s Messaging, handler MethodContextHandler[Req, Rsp]) {
+	s.RpcServer().Router().
+		AddChannel(m.channel, map[string]jsonrpc2.Handler{}).
+		Add(m.name, m.handle(handler))
+}
+
+func (m *Method[Req, Rsp]) handle(handler MethodContextHandler[Req, Rsp]) jsonrpc2.Handler {
+	return func(r *jsonrpc2.RPCRequest) *jsonrpc2.RPCResponse {
+		req := new(Req)
+		if r.Params != nil {
+			if err := r.GetObject(req); err != nil {
+				return m.respondError(r, jsonrpc2.NewError(jsonrpc2.ErrServerInvalidParameters))
+			}
+		}
+
+		rsp, err := handler(r.Context(), req)
+		if err != nil {
+			var rpcErr *jsonrpc2.RPCError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = jsonrpc2.NewErrorWithMsg(jsonrpc2.ErrServerInternal, err.Error())
+			}
+
+			return m.respondError(r, rpcErr)
+		}
+
+		return jsonrpc2.NewResponse(r, rsp)
+	}
+}
+
+func (m *Method[Req, Rsp]) respondError(r *jsonrpc2.RPCRequest, err *jsonrpc2.RPCError) *jsonrpc2.RPCResponse {
+	rsp := jsonrpc2.NewErrorResponseWithErr(err)
+	rsp.ID = r.ID
+	return rsp
+}
+
+// Invoke calls the method with the given request and decodes the
+// response. CallOptions, e.g. ToInstance, select the target instance.
+//
+// Errors returned by the callee are of type *jsonrpc2.RPCError,
+// whose data can be decoded using ErrorData.
+func (m *Method[Req, Rsp]) Invoke(s Messaging, req *Req, timeout time.Duration, opts ...CallOption) (*Rsp, error) {
+	return m.InvokeContext(context.Background(), s, req, timeout, opts...)
+}
+
+// InvokeContext is like Invoke, and propagates the trace
+// carried by ctx, if any, to the callee.
+func (m *Method[Req, Rsp]) InvokeContext(ctx context.Context, s Messaging, req *Req,
+	timeout time.Duration, opts ...CallOption) (*Rsp, error) {
+	rsp, err := s.RpcClient().InvokeContext(withCallOptions(ctx, opts), m.channel, m.name, timeout, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(Rsp)
+	if rsp.Result != nil {
+		if err = rsp.GetObject(result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// ErrorData decodes data carried by err, which is expected to
+// be a *jsonrpc2.RPCError returned by Method.Invoke, as type T.
+// Returns false if err carries no data or data is not of type T.
+func ErrorData[T any](err error) (*T, bool) {
+	var rpcErr *jsonrpc2.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Data == nil {
+		return nil, false
+	}
+
+	data := new(T)
+	if rpcErr.GetData(data) != nil {
+		return nil, false
+	}
+
+	return data, true
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"testing"
+	"time"
+)
+
+type echoReq struct {
+	Text string `json:"text"`
+}
+
+type echoRsp struct {
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+type quotaExceeded struct {
+	Limit int `json:"limit"`
+}
+
+const errQuotaExceeded = 1001
+
+func TestTypedMethod(t *testing.T) {
+	s := newInProcService(t, "typed")
+
+	echo := NewMethod[echoReq, echoRsp]("/typed/rpc", "echo")
+	echo.Expose(s, func(req *echoReq) (*echoRsp, error) {
+		switch req.Text {
+		case "":
+			return nil, errors.New("empty text")
+		case "quota":
+			return nil, jsonrpc2.NewErrorWithData(errQuotaExceeded, "quota exceeded", &quotaExceeded{Limit: 3})
+		}
+
+		return &echoRsp{Text: req.Text, Count: len(req.Text)}, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+
+	rsp, err := echo.Invoke(s, &echoReq{Text: "hello"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, &echoRsp{Text: "hello", Count: 5}, rsp)
+
+	// calls the instance-specific endpoint
+	rsp, err = echo.Invoke(s, &echoReq{Text: "hi"}, time.Second, ToInstance(s.Instance()))
+	require.Nil(t, err)
+	assert.Equal(t, 2, rsp.Count)
+
+	_, err = echo.Invoke(s, &echoReq{}, time.Second)
+	var rpcErr *jsonrpc2.RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, jsonrpc2.ErrServerInternal, rpcErr.Code)
+	assert.Equal(t, "empty text", rpcErr.Message)
+	_, ok := ErrorData[quotaExceeded](err)
+	assert.False(t, ok)
+
+	_, err = echo.Invoke(s, &echoReq{Text: "quota"}, time.Second)
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, errQuotaExceeded, rpcErr.Code)
+	data, ok := ErrorData[quotaExceeded](err)
+	require.True(t, ok)
+	assert.Equal(t, 3, data.Limit)
+
+	// unknown method
+	_, err = NewMethod[echoReq, echoRsp]("/typed/rpc", "none").Invoke(s, &echoReq{}, time.Second)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"fmt"
+	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/ipc"
+	"github.com/zourva/pareto/metrics"
+	"github.com/zourva/pareto/trace"
+	"sync"
+	"time"
+)
+
+// Metric names exported by services and the registry.
+const (
+	MetricCallsTotal       = "pareto_service_calls_total"
+	MetricCallDuration     = "pareto_service_call_duration_seconds"
+	MetricHandledTotal     = "pareto_service_handled_total"
+	MetricHandleDuration   = "pareto_service_handle_duration_seconds"
+	MetricNotifiesTotal    = "pareto_service_notifies_total"
+	MetricReceivedTotal    = "pareto_service_received_total"
+	MetricServiceUp        = "pareto_service_up"
+	MetricRegistryServices = "pareto_registry_services"
+	MetricRegistryLag      = "pareto_registry_heartbeat_lag_seconds"
+	MetricRegistryTimeouts = "pareto_registry_timeouts_total"
+	MetricRegistryReports  = "pareto_registry_status_reports_total"
+	MetricRestartsTotal    = "pareto_service_restarts_total"
+	MetricJobRunsTotal     = "pareto_service_job_runs_total"
+	MetricAccessDenied     = "pareto_service_access_denied_total"
+	MetricFaultsInjected   = "pareto_service_faults_injected_total"
+	MetricVersionCalls     = "pareto_service_version_calls_total"
+	MetricLimited          = "pareto_service_limited_total"
+)
+
+const (
+	resultOk    = "ok"
+	resultError = "error"
+)
+
+// messaging metrics shared by all services of the process
+var (
+	callsTotal = metrics.Default.MustCounter(MetricCallsTotal,
+		"Number of outgoing rpc calls.", "service", "method", "result")
+	callDuration = metrics.Default.MustHistogram(MetricCallDuration,
+		"Duration of outgoing rpc calls.", nil, "service", "method")
+	handledTotal = metrics.Default.MustCounter(MetricHandledTotal,
+		"Number of incoming rpc calls handled.", "service", "method", "result")
+	handleDuration = metrics.Default.MustHistogram(MetricHandleDuration,
+		"Duration of handling incoming rpc calls.", nil, "service", "method")
+	notifiesTotal = metrics.Default.MustCounter(MetricNotifiesTotal,
+		"Number of messages published.", "service", "topic", "result")
+	receivedTotal = metrics.Default.MustCounter(MetricReceivedTotal,
+		"Number of messages received from subscribed topics.", "service", "topic")
+	registryTimeouts = metrics.Default.MustCounter(MetricRegistryTimeouts,
+		"Number of service instances forced offline due to heartbeat timeout.", "service")
+	registryReports = metrics.Default.MustCounter(MetricRegistryReports,
+		"Number of status reports received by the registry.", "service")
+	restartsTotal = metrics.Default.MustCounter(MetricRestartsTotal,
+		"Number of service restarts by supervisor.", "service", "reason")
+	jobRunsTotal = metrics.Default.MustCounter(MetricJobRunsTotal,
+		"Number of scheduled job runs.", "service", "job", "result")
+	accessDeniedTotal = metrics.Default.MustCounter(MetricAccessDenied,
+		"Number of calls denied by access rules.", "service", "channel", "caller")
+	faultsInjected = metrics.Default.MustCounter(MetricFaultsInjected,
+		"Number of faults injected into messages.", "service", "point", "kind")
+	versionCallsTotal = metrics.Default.MustCounter(MetricVersionCalls,
+		"Number of balanced calls by version of the instance called.", "service", "target", "version", "result")
+	limitedTotal = metrics.Default.MustCounter(MetricLimited,
+		"Number of calls rejected by limits.", "service", "channel", "reason")
+)
+
+func resultOf(err error) string {
+	if err != nil {
+		return resultError
+	}
+
+	return resultOk
+}
+
+func observeCall(service, method string, begin time.Time, err error) {
+	callsTotal.Inc(service, method, resultOf(err))
+	callDuration.Observe(time.Since(begin).Seconds(), service, method)
+}
+
+// observeVersionCall records a call balanced over instances of a service,
+// by version of the instance picked, where JSON-RPC error responses
+// count as failures, to compare versions split by a TrafficSplit.
+func observeVersionCall(service string, target *Status, rsp []byte, err error) {
+	if err == nil {
+		err = rpcFailure(rsp)
+	}
+
+	versionCallsTotal.Inc(service, target.Name, target.Version, resultOf(err))
+}
+
+// instrumentCallee wraps an rpc handler to record handling metrics,
+// and a span if the request carries a trace context. The handler is
+// passed the verified caller, and is not called if access is denied.
+// A panic of the handler is recovered and reported as a failure of
+// the service, see MetaService.Fail.
+func (s *MetaService) instrumentCallee(name string, fn ContextCalleeHandler) ipc.CalleeHandler {
+	return func(data []byte) (rsp []byte, err error) {
+		begin := time.Now()
+		meta, data := openEnvelope(data)
+		ctx, span := s.startRemote(meta, name, trace.KindServer)
+		caller, err := s.identify(name, meta, data)
+		var rejected error //replied as denied or busy, see openReply
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic in handler of %s: %v", name, r)
+				s.Fail(err)
+			}
+
+			failure := err
+			if rejected != nil {
+				failure = rejected
+			}
+
+			handledTotal.Inc(s.name, name, resultOf(failure))
+			handleDuration.Observe(time.Since(begin).Seconds(), s.name, name)
+			span.SetError(failure)
+			span.End()
+		}()
+
+		if err != nil {
+			rejected = err
+			return deniedReply(name), nil
+		}
+
+		release, busy := s.admitCall(name, caller)
+		if busy != nil {
+			_, rejected = openReply(busy)
+			return busy, nil
+		}
+
+		if release != nil {
+			defer release()
+		}
+
+		return s.injectHandle(name, data, func(data []byte) ([]byte, error) {
+			return fn(contextWithCaller(ctx, caller), data)
+		})
+	}
+}
+
+// instrumentHandler wraps a subscription handler to record receiving
+// metrics, and a span if the notice carries a trace context.
+// A panic of the handler is recovered and reported as a failure of
+// the service, see MetaService.Fail.
+func (s *MetaService) instrumentHandler(topic string, fn ContextHandler) ipc.Handler {
+	return func(data []byte) {
+		meta, data := openEnvelope(data)
+		ctx, span := s.startRemote(meta, topic, trace.KindConsumer)
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("panic in handler of %s: %v", topic, r)
+				span.SetError(err)
+				s.Fail(err)
+			}
+
+			span.End()
+		}()
+
+		receivedTotal.Inc(s.name, topic)
+		fn(ctx, data)
+	}
+}
+
+// liveServices holds started services of the process.
+var liveServices sync.Map
+
+// liveRegistries holds started registries of the process.
+var liveRegistries sync.Map
+
+func init() {
+	registerServiceMetrics()
+	registerRegistryMetrics()
+}
+
+// registerServiceMetrics exports liveness of started services.
+func registerServiceMetrics() {
+	metrics.Default.MustGaugeFunc(MetricServiceUp,
+		"Whether the service instance is servicing(1) or not(0).",
+		func(emit func(v float64, labelValues ...string)) {
+			liveServices.Range(func(key, value any) bool {
+				s := value.(*MetaService)
+				up := 0.0
+				if s.State() == Servicing {
+					up = 1
+				}
+				emit(up, s.name, s.instance)
+				return true
+			})
+		}, "service", "instance")
+}
+
+// registerRegistryMetrics exports registry-level metrics computed
+// on each scraping, over all started registries of the process,
+// where an instance tracked by several registries is reported once,
+// with the lag of the latest heartbeat.
+func registerRegistryMetrics() {
+	metrics.Default.MustGaugeFunc(MetricRegistryServices,
+		"Number of service instances per liveness state.",
+		func(emit func(v float64, labelValues ...string)) {
+			counts := make(map[State]int)
+			for _, reg := range liveRegistrations() {
+				counts[reg.state]++
+			}
+
+			for _, state := range []State{Offline, Starting, Servicing, Stopping, Stopped} {
+				emit(float64(counts[state]), state.String())
+			}
+		}, "state")
+
+	metrics.Default.MustGaugeFunc(MetricRegistryLag,
+		"Seconds since the last heartbeat of each service instance.",
+		func(emit func(v float64, labelValues ...string)) {
+			now := box.TimeNowMs()
+			for _, reg := range liveRegistrations() {
+				lag := 0.0
+				if now > reg.updateTime {
+					lag = float64(now-reg.updateTime) / 1000
+				}
+				emit(lag, reg.name, reg.instance)
+			}
+		}, "service", "instance")
+}
+
+// liveRegistrations returns registrations of all started registries,
+// keeping the latest updated one of each instance.
+func liveRegistrations() []*registry {
+	latest := make(map[string]*registry)
+	liveRegistries.Range(func(key, value any) bool {
+		for _, reg := range value.(*RegistryManager).all() {
+			k := reg.name + "#" + reg.instance
+			if r, ok := latest[k]; !ok || r.updateTime < reg.updateTime {
+				latest[k] = reg
+			}
+		}
+		return true
+	})
+
+	list := make([]*registry, 0, len(latest))
+	for _, reg := range latest {
+		list = append(list, reg)
+	}
+
+	return list
+}
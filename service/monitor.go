@@ -10,6 +10,7 @@ import (
 // report alerts if required.
 type Monitor struct {
 	registry *RegistryManager
+	alerter  *Alerter
 }
 
 // GetStatus returns status of the given service and nil
@@ -20,35 +21,56 @@ func (m *Monitor) GetStatus(name string) *Status {
 		return nil
 	}
 
-	return &Status{
-		Name:   reg.name,
-		Domain: reg.domain,
-		State:  reg.state,
-		Time:   reg.updateTime,
-		Ready:  reg.ready,
+	return reg.toStatus()
+}
+
+// GetInstances returns status of all instances of the given service.
+func (m *Monitor) GetInstances(name string) []*Status {
+	var list []*Status
+	for _, reg := range m.registry.instances(name) {
+		list = append(list, reg.toStatus())
 	}
+
+	return list
 }
 
-// GetStatusList returns full list of status of managed services.
+// GetStatusList returns full list of status of managed service instances.
 func (m *Monitor) GetStatusList() StatusList {
 	var list StatusList
 	all := m.registry.all()
 	for _, reg := range all {
-		list.Services = append(list.Services, &Status{
-			Name:   reg.name,
-			Domain: reg.domain,
-			State:  reg.state,
-			Time:   reg.updateTime,
-			Ready:  reg.ready,
-		})
-
+		list.Services = append(list.Services, reg.toStatus())
 	}
 
 	return list
 }
 
+// Query returns status of instances selected by the filter,
+// e.g. instances with some tags or exposing some method.
+func (m *Monitor) Query(filter *QueryStatusListReq) []*Status {
+	return m.registry.query(filter)
+}
+
+// Alerter returns the alerter bound to this monitor, which is
+// created on first call and needs to be started explicitly, e.g.:
+//
+//	a := m.Alerter()
+//	a.AddRules(confs)
+//	a.AddNotifier(&LogNotifier{})
+//	a.Start(5 * time.Second)
+func (m *Monitor) Alerter() *Alerter {
+	monLock.Lock()
+	defer monLock.Unlock()
+
+	if m.alerter == nil {
+		m.alerter = NewAlerter(m)
+	}
+
+	return m.alerter
+}
+
 // GetNotServicing returns names of services from the given names
-// that are not ready yet.
+// that have no servicing instance yet.
 func (m *Monitor) GetNotServicing(filtered []string) []string {
 	var result []string
 	for _, name := range filtered {
@@ -69,8 +91,8 @@ var monitor *Monitor
 // it needs to inquiry service registry to
 // get service status, so it creates a service registry
 // internally to manage all services registered.
-func NewMonitor(registry string) *Monitor {
-	manager := NewRegistryManager(registry)
+func NewMonitor(registry string, opts ...RegistryOption) *Monitor {
+	manager := NewRegistryManager(registry, opts...)
 	if manager == nil {
 		return nil
 	}
@@ -89,12 +111,15 @@ func GetMonitor() *Monitor {
 // EnableMonitor enables service monitor by creating
 // and attaching a service registry manager to the
 // given service registry address.
-func EnableMonitor(registry string) *Monitor {
+//
+// Options are applied only when the monitor is created,
+// e.g. use WithAdminEndpoint to expose registry over HTTP.
+func EnableMonitor(registry string, opts ...RegistryOption) *Monitor {
 	monLock.Lock()
 	defer monLock.Unlock()
 
 	if monitor == nil {
-		monitor = NewMonitor(registry)
+		monitor = NewMonitor(registry, opts...)
 		if monitor == nil {
 			log.Fatalln("enable monitor failed")
 		}
@@ -115,6 +140,10 @@ func DisableMonitor() {
 	monLock.Lock()
 	defer monLock.Unlock()
 
+	if monitor.alerter != nil {
+		monitor.alerter.Stop()
+	}
+
 	Stop(monitor.registry)
 
 	monitor = nil
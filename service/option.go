@@ -35,3 +35,29 @@ func WithStatusConfig(c *StatusConf) Option {
 		s.conf = c
 	}
 }
+
+// WithCheckpointDir overrides the dir holding the checkpoint
+// file of the service, see MetaService.Checkpoints.
+func WithCheckpointDir(dir string) Option {
+	return func(s *MetaService) {
+		s.checkpoints.dir = dir
+	}
+}
+
+// WithCallPolicy sets the policy of calls to the target method,
+// or the default policy if target is empty, see SetCallPolicy.
+func WithCallPolicy(target string, policy *CallPolicy) Option {
+	return func(s *MetaService) {
+		s.guard.set(target, policy)
+	}
+}
+
+// WithProbeEndpoint enables an HTTP server listening on addr, which
+// exposes /healthz, /readyz and /status of the service for
+// Kubernetes-style probes.
+func WithProbeEndpoint(addr string) Option {
+	return func(s *MetaService) {
+		s.admin = NewAdminServer(addr)
+		s.mountProbes(s.admin)
+	}
+}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	RetryMaxAttempts = 3    //attempts including the first call
+	RetryBackoff     = 100  //milliseconds, delay before the first retry
+	RetryMaxBackoff  = 2000 //milliseconds, max delay between retries
+
+	BreakerFailureThreshold = 5  //consecutive failures to open the circuit
+	BreakerOpenTimeout      = 10 //seconds, to wait before probing an open circuit
+	BreakerHalfOpenProbes   = 1  //successful probes to close the circuit
+
+	MetricsBreakers = "breakers"
+)
+
+// ErrCircuitOpen is returned when a call is short-circuited
+// by the breaker of an unhealthy target.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// RetryPolicy defines how failed calls are retried.
+// Zero values are replaced by defaults.
+type RetryPolicy struct {
+	// MaxAttempts including the first call.
+	MaxAttempts int
+
+	// Backoff before the first retry, doubled for
+	// each subsequent retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter, in [0, 1], randomizes each delay by up to
+	// the given fraction of it, in both directions.
+	Jitter float64
+}
+
+func (p *RetryPolicy) normalize() *RetryPolicy {
+	n := *p
+	if n.MaxAttempts <= 0 {
+		n.MaxAttempts = RetryMaxAttempts
+	}
+
+	if n.Backoff <= 0 {
+		n.Backoff = RetryBackoff * time.Millisecond
+	}
+
+	if n.MaxBackoff <= 0 {
+		n.MaxBackoff = RetryMaxBackoff * time.Millisecond
+	}
+
+	if n.Jitter < 0 {
+		n.Jitter = 0
+	} else if n.Jitter > 1 {
+		n.Jitter = 1
+	}
+
+	return &n
+}
+
+// delay returns the delay before the given retry, starting from 1.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// BreakerPolicy defines when the circuit of a target opens and closes.
+// Zero values are replaced by defaults.
+type BreakerPolicy struct {
+	// FailureThreshold of consecutive failures to open the circuit.
+	FailureThreshold int
+
+	// OpenTimeout to wait before letting probes through.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes that must succeed to close the circuit.
+	HalfOpenProbes int
+}
+
+func (p *BreakerPolicy) normalize() *BreakerPolicy {
+	n := *p
+	if n.FailureThreshold <= 0 {
+		n.FailureThreshold = BreakerFailureThreshold
+	}
+
+	if n.OpenTimeout <= 0 {
+		n.OpenTimeout = BreakerOpenTimeout * time.Second
+	}
+
+	if n.HalfOpenProbes <= 0 {
+		n.HalfOpenProbes = BreakerHalfOpenProbes
+	}
+
+	return &n
+}
+
+// CallPolicy defines how calls to a target are guarded.
+//
+// Only transport failures, e.g. timeout or no responder, count
+// as failures, while errors carried in responses do not.
+type CallPolicy struct {
+	// Retry, if not nil, retries failed calls which are idempotent.
+	Retry *RetryPolicy
+
+	// Idempotent hints that all calls to the target are safe to
+	// retry, otherwise only calls with the Idempotent option are.
+	Idempotent bool
+
+	// Breaker, if not nil, short-circuits calls to the target
+	// with ErrCircuitOpen after consecutive failures. Each instance
+	// called, directly or balanced, has a circuit of its own.
+	Breaker *BreakerPolicy
+}
+
+func (p *CallPolicy) normalize() *CallPolicy {
+	n := &CallPolicy{Idempotent: p.Idempotent}
+	if p.Retry != nil {
+		n.Retry = p.Retry.normalize()
+	}
+
+	if p.Breaker != nil {
+		n.Breaker = p.Breaker.normalize()
+	}
+
+	return n
+}
+
+// Idempotent hints that the call is safe to retry.
+func Idempotent() CallOption {
+	return func(o *callOptions) {
+		o.idempotent = true
+	}
+}
+
+// BreakerState defines state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls pass through
+	BreakerOpen                         // calls are short-circuited
+	BreakerHalfOpen                     // probes pass through
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// BreakerStatus is exported in the breakers section of Status.Metrics.
+type BreakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`           //consecutive failures
+	OpenedAt uint64 `json:"openedAt,omitempty"` //timestamp in milliseconds
+}
+
+// breaker is a circuit breaker of one target.
+type breaker struct {
+	sync.Mutex
+	policy *BreakerPolicy
+
+	state     BreakerState
+	failures  int //consecutive failures when closed
+	successes int //successful probes when half-open
+	probing   int //probes in flight when half-open
+	openedAt  time.Time
+}
+
+func newBreaker(policy *BreakerPolicy) *breaker {
+	return &breaker{policy: policy}
+}
+
+// allow returns ErrCircuitOpen if the call is short-circuited.
+func (b *breaker) allow() error {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return ErrCircuitOpen
+		}
+
+		b.state = BreakerHalfOpen
+		b.successes = 0
+		b.probing = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing >= b.policy.HalfOpenProbes {
+			return ErrCircuitOpen
+		}
+
+		b.probing++
+	}
+
+	return nil
+}
+
+// record records result of an allowed call.
+func (b *breaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		if err == nil {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.policy.FailureThreshold {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		b.probing--
+		if err != nil {
+			b.open()
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.policy.HalfOpenProbes {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	}
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *breaker) status() *BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	s := &BreakerStatus{State: b.state.String(), Failures: b.failures}
+	if b.state != BreakerClosed {
+		s.OpenedAt = uint64(b.openedAt.UnixMilli())
+	}
+
+	return s
+}
+
+// guard holds call policies and breakers of targets.
+type guard struct {
+	sync.RWMutex
+	policies map[string]*CallPolicy //target -> policy, "" for default
+	breakers map[string]*breaker    //scoped target -> breaker
+}
+
+func newGuard() *guard {
+	return &guard{
+		policies: make(map[string]*CallPolicy),
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func (g *guard) set(target string, policy *CallPolicy) {
+	g.Lock()
+	defer g.Unlock()
+
+	if policy == nil {
+		delete(g.policies, target)
+	} else {
+		g.policies[target] = policy.normalize()
+	}
+
+	// breakers are recreated using the new policy
+	for key := range g.breakers {
+		delete(g.breakers, key)
+	}
+}
+
+// policy returns policy of the target, or the default one.
+func (g *guard) policy(target string) *CallPolicy {
+	g.RLock()
+	defer g.RUnlock()
+
+	if p, ok := g.policies[target]; ok {
+		return p
+	}
+
+	return g.policies[""]
+}
+
+// breaker returns breaker of the scoped target, or nil if not required.
+func (g *guard) breaker(scoped string, policy *CallPolicy) *breaker {
+	if policy == nil || policy.Breaker == nil {
+		return nil
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	b, ok := g.breakers[scoped]
+	if !ok {
+		b = newBreaker(policy.Breaker)
+		g.breakers[scoped] = b
+	}
+
+	return b
+}
+
+// status returns status of breakers, or nil if there is none.
+func (g *guard) status() map[string]*BreakerStatus {
+	g.RLock()
+	defer g.RUnlock()
+
+	if len(g.breakers) == 0 {
+		return nil
+	}
+
+	m := make(map[string]*BreakerStatus, len(g.breakers))
+	for target, b := range g.breakers {
+		m[target] = b.status()
+	}
+
+	return m
+}
+
+// SetCallPolicy sets the policy of calls to the target method, or the
+// default policy of all targets if target is empty. The policy of the
+// target is removed if policy is nil.
+func (s *MetaService) SetCallPolicy(target string, policy *CallPolicy) {
+	s.guard.set(target, policy)
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallRetry(t *testing.T) {
+	s := newInProcService(t, "retried")
+
+	var calls int32
+	require.Nil(t, s.ExposeMethod("/flaky", func(data []byte) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			return nil, errors.New("unavailable")
+		}
+		return data, nil
+	}))
+
+	s.SetCallPolicy("/flaky", &CallPolicy{Retry: &RetryPolicy{Backoff: time.Millisecond, Jitter: 0.5}})
+
+	// not idempotent, never retried
+	_, err := s.CallMethod("/flaky", nil, time.Second)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	rsp, err := s.CallMethod("/flaky", []byte("ok"), time.Second, Idempotent())
+	require.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// signed retries are not rejected as replayed
+	WithIdentity([]byte("secret"))(s)
+	s.SetAccessRule("/flaky", "", &AccessRule{Services: []string{"retried"}})
+	atomic.StoreInt32(&calls, 0)
+	rsp, err = s.CallMethod("/flaky", []byte("ok"), time.Second, Idempotent())
+	require.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// retries stop once the context is done
+	s.SetCallPolicy("/flaky", &CallPolicy{Retry: &RetryPolicy{MaxAttempts: 5, Backoff: time.Minute}})
+	atomic.StoreInt32(&calls, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = s.CallMethodContext(ctx, "/flaky", []byte("ok"), time.Second, Idempotent())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	_, err = s.CallMethodContext(ctx, "/flaky", []byte("ok"), time.Second, Idempotent())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	p := (&RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}).normalize()
+	assert.Equal(t, 10*time.Millisecond, p.delay(1))
+	assert.Equal(t, 20*time.Millisecond, p.delay(2))
+	assert.Equal(t, 30*time.Millisecond, p.delay(5))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := newInProcService(t, "guarded")
+
+	var healthy atomic.Bool
+	require.Nil(t, s.ExposeMethod("/down", func(data []byte) ([]byte, error) {
+		if !healthy.Load() {
+			return nil, errors.New("unavailable")
+		}
+		return data, nil
+	}))
+
+	s.SetCallPolicy("", &CallPolicy{Breaker: &BreakerPolicy{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond}})
+
+	for i := 0; i < 2; i++ {
+		_, err := s.CallMethod("/down", nil, time.Second)
+		assert.NotNil(t, err)
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+
+	_, err := s.CallMethod("/down", nil, time.Second)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	breakers := s.collectMetrics()[MetricsBreakers].(map[string]*BreakerStatus)
+	assert.Equal(t, "open", breakers["/down"].State)
+
+	// a failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	_, err = s.CallMethod("/down", nil, time.Second)
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	_, err = s.CallMethod("/down", nil, time.Second)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// a successful probe closes it
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	_, err = s.CallMethod("/down", nil, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "closed", s.guard.status()["/down"].State)
+}
+
+func TestCircuitBreakerPerInstance(t *testing.T) {
+	s := newInProcService(t, "balanced")
+	s.balancer = newBalancer(func(domain int, service string) ([]*Status, error) {
+		return []*Status{
+			{Name: service, Instance: "a", State: Servicing, Ready: true},
+			{Name: service, Instance: "b", State: Servicing, Ready: true},
+		}, nil
+	})
+
+	require.Nil(t, s.ExposeMethod(InstanceEndpoint("/work", "a"), func(data []byte) ([]byte, error) {
+		return nil, errors.New("unavailable")
+	}))
+	require.Nil(t, s.ExposeMethod(InstanceEndpoint("/work", "b"), func(data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	s.SetCallPolicy("", &CallPolicy{Breaker: &BreakerPolicy{FailureThreshold: 1, OpenTimeout: time.Minute}})
+
+	_, err := s.CallMethod("/work", nil, time.Second, ToAnyInstance("svc", RoundRobin))
+	assert.NotNil(t, err)
+
+	// the dead instance does not open the circuit of healthy ones
+	for i := 0; i < 4; i++ {
+		_, err = s.CallMethod("/work", nil, time.Second, ToAnyInstance("svc", RoundRobin))
+		assert.Nil(t, err)
+	}
+
+	breakers := s.guard.status()
+	assert.Equal(t, "open", breakers[InstanceEndpoint("/work", "a")].State)
+	assert.Equal(t, "closed", breakers[InstanceEndpoint("/work", "b")].State)
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Orders of instances queried, see QueryStatusListReq.SortBy.
+const (
+	SortByName    = "name"
+	SortByState   = "state"
+	SortByTime    = "time"
+	SortByVersion = "version"
+)
+
+var errBadCursor = errors.New("malformed cursor")
+
+// statusCursor is the position of the last instance of a page,
+// holding fields compared by all orders.
+type statusCursor struct {
+	Name     string `json:"n"`
+	Instance string `json:"i"`
+	State    State  `json:"s,omitempty"`
+	Time     uint64 `json:"t,omitempty"`
+	Version  string `json:"v,omitempty"`
+}
+
+func (c *statusCursor) encode() string {
+	buf, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(s string) (*statusCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	c := &statusCursor{}
+	if err = json.Unmarshal(buf, c); err != nil {
+		return nil, errBadCursor
+	}
+
+	return c, nil
+}
+
+func cursorOf(s *Status) *statusCursor {
+	return &statusCursor{
+		Name:     s.Name,
+		Instance: s.InstanceId(),
+		State:    s.State,
+		Time:     s.Time,
+		Version:  s.Version,
+	}
+}
+
+// statusLess returns the order of instances, by the field
+// of sortBy and then by name and instance.
+func statusLess(sortBy string, desc bool) (func(a, b *statusCursor) bool, error) {
+	var primary func(a, b *statusCursor) int
+	switch sortBy {
+	case "", SortByName:
+		primary = func(a, b *statusCursor) int { return 0 }
+	case SortByState:
+		primary = func(a, b *statusCursor) int { return compare(a.State, b.State) }
+	case SortByTime:
+		primary = func(a, b *statusCursor) int { return compare(a.Time, b.Time) }
+	case SortByVersion:
+		primary = func(a, b *statusCursor) int { return compareVersions(a.Version, b.Version) }
+	default:
+		return nil, errors.New("unknown sort field " + sortBy)
+	}
+
+	return func(a, b *statusCursor) bool {
+		c := primary(a, b)
+		if c == 0 {
+			c = compare(a.Name, b.Name)
+		}
+		if c == 0 {
+			c = compare(a.Instance, b.Instance)
+		}
+
+		if desc {
+			return c > 0
+		}
+
+		return c < 0
+	}, nil
+}
+
+func compare[T State | int | uint64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// paginate sorts the instances as ordered by the filter, and returns
+// the page following the cursor of the filter, if any, limited to
+// Limit instances.
+func paginate(list []*Status, filter *QueryStatusListReq) (*StatusList, error) {
+	less, err := statusLess(filter.SortBy, filter.Desc)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := make(map[*Status]*statusCursor, len(list))
+	for _, s := range list {
+		cursors[s] = cursorOf(s)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return less(cursors[list[i]], cursors[list[j]])
+	})
+
+	if len(filter.Cursor) != 0 {
+		last, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		// instances after the last one of the previous page
+		list = list[sort.Search(len(list), func(i int) bool {
+			return less(last, cursors[list[i]])
+		}):]
+	}
+
+	page := &StatusList{Services: list}
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		page.Services = list[:filter.Limit]
+		page.Next = cursors[list[filter.Limit-1]].encode()
+	}
+
+	return page, nil
+}
@@ -12,11 +12,20 @@ type Registrar interface {
 	DisableStatusExport()
 	QueryStatus(name string) *Status
 	QueryStatusList(namesWhitelist []string) *StatusList
+	Query(filter *QueryStatusListReq) *StatusList
+	QueryDomain(domain int, filter *QueryStatusListReq) *StatusList
+	QueryInstances(name string) []*Status
+	QueryEvents(filter *QueryEventsReq) (*QueryEventsRsp, error)
+	QueryTrafficSplit(domain int, service string) (*TrafficSplit, error)
+	SetTrafficSplit(split *TrafficSplit) (*TrafficSplit, error)
 	StatusList() *StatusList
+	ReportStatus() error
 	Register() bool
 	Unregister()
 }
 
+var queryStatusListMethod = NewMethod[QueryStatusListReq, QueryStatusListRsp](EndpointServiceInfo, QueryStatusList)
+
 // Registrar acts as a registry delegator,
 // helping service instances
 // interacting with service server.
@@ -59,7 +68,10 @@ func (r *registrar) DisableStatusExport() {
 	// always report stop
 	_ = r.report()
 
-	r.exporter.Stop()
+	if r.exporter != nil {
+		r.exporter.Stop()
+		r.exporter = nil
+	}
 }
 
 // QueryStatus returns status of the given service and nil
@@ -87,25 +99,76 @@ func (r *registrar) QueryStatus(name string) *Status {
 // its Status will not be included in the returned list.
 // All list is returned if namesWhitelist is nil or its length is 0.
 func (r *registrar) QueryStatusList(namesWhitelist []string) *StatusList {
-	client := r.service.RpcClient()
-
 	req := &QueryStatusListReq{}
 	req.Observed = append(req.Observed, namesWhitelist...)
 
-	rsp, err := client.Invoke(EndpointServiceInfo, QueryStatusList, StatusQueryTimeout*time.Second, req)
+	return r.Query(req)
+}
+
+// Query returns status list of service instances selected
+// by the filter, e.g. instances with some tags or exposing
+// some method, and nil if any error occurs.
+//
+// Only instances in the domain of the service are visible.
+func (r *registrar) Query(filter *QueryStatusListReq) *StatusList {
+	return r.QueryDomain(r.service.Domain(), filter)
+}
+
+// QueryDomain works as Query, but asks the registry of the given domain.
+func (r *registrar) QueryDomain(domain int, filter *QueryStatusListReq) *StatusList {
+	rsp, err := queryStatusListMethod.Invoke(r.service, filter, StatusQueryTimeout*time.Second, InDomain(domain))
 	if err != nil {
-		log.Warnf("query status list of services %s failed, %v", namesWhitelist, err)
+		log.Warnf("query status list of services %s in domain %d failed, %v", filter.Observed, domain, err)
 		return nil
 	}
 
-	var list QueryStatusListRsp
-	err = rsp.GetObject(&list)
-	if err != nil {
-		log.Errorf("query status of services %s failed, %v", namesWhitelist, err)
+	return rsp.List
+}
+
+// QueryInstances returns status of all instances of the given
+// service and nil if the service does not exist or query failed.
+func (r *registrar) QueryInstances(name string) []*Status {
+	list := r.QueryStatusList([]string{name})
+	if list == nil {
 		return nil
 	}
 
-	return list.List
+	return list.Services
+}
+
+// QueryEvents returns events recorded by the registry, in the domain
+// of the service, selected by the filter, see WithEventLog.
+func (r *registrar) QueryEvents(filter *QueryEventsReq) (*QueryEventsRsp, error) {
+	return queryEventsMethod.Invoke(r.service, filter, StatusQueryTimeout*time.Second, InDomain(r.service.Domain()))
+}
+
+// QueryTrafficSplit returns the traffic split of the service set in
+// the registry of the domain, or nil if calls are not split.
+func (r *registrar) QueryTrafficSplit(domain int, service string) (*TrafficSplit, error) {
+	rsp, err := queryTrafficSplitMethod.Invoke(r.service, &TrafficSplitReq{Service: service},
+		StatusQueryTimeout*time.Second, InDomain(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Split != nil {
+		if err = rsp.Split.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rsp.Split, nil
+}
+
+// SetTrafficSplit sets the traffic split of a service in the registry,
+// in the domain of the service, and returns the split in effect.
+func (r *registrar) SetTrafficSplit(split *TrafficSplit) (*TrafficSplit, error) {
+	rsp, err := setTrafficSplitMethod.Invoke(r.service, split, StatusQueryTimeout*time.Second, InDomain(r.service.Domain()))
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Split, nil
 }
 
 // StatusList returns cached status list copy of recently queried.
@@ -143,6 +206,12 @@ func (r *registrar) Unregister() {
 	//r.messager.CallV2("/ew1/service/deregister", []byte(s.Name()), time.Second)
 }
 
+// ReportStatus reports status of the service immediately,
+// without waiting for the next export tick.
+func (r *registrar) ReportStatus() error {
+	return r.report()
+}
+
 func (r *registrar) report() error {
 	err := r.service.Notify(EndpointServiceStatus, r.service.MarshalStatus())
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/zourva/pareto/box"
 	"github.com/zourva/pareto/endec/jsonrpc2"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -38,15 +39,26 @@ import (
 //	Detached(name string) bool
 //}
 
-// service registry info
+// service registry info of an instance
 type registry struct {
 	//service name
-	name   string
-	domain int
+	name string
+	//instance id
+	instance string
+	domain   int
 	//liveness state
 	state State
 	//readiness
 	ready bool
+	//number of restarts by supervisor
+	restarts uint32
+	//metadata published by the service
+	version   string
+	tags      []string
+	labels    map[string]string
+	endpoints []*ChannelInfo
+	leads     []string
+	metrics   any
 	//timestamp in ms when up
 	onlineTime uint64
 	//timestamp in ms when down
@@ -74,13 +86,13 @@ func (r *registry) offline() {
 	r.ready = false
 	r.updateTime = box.TimeNowMs()
 	r.offlineTime = r.updateTime
-	log.Infof("force service %s offline", r.name)
+	log.Infof("force service %s(%s) offline", r.name, r.instance)
 }
 
 func (r *registry) update(s *Status) {
 	// update check conditions
 	if s.CheckInterval != 0 {
-		r.interval = uint64(s.CheckInterval)
+		r.interval = uint64(s.CheckInterval) * 1000
 	}
 
 	if s.AllowFailures != 0 {
@@ -88,25 +100,154 @@ func (r *registry) update(s *Status) {
 	}
 
 	r.state = s.State
+	r.ready = s.Ready
 	r.updateTime = box.TimeNowMs()
+	r.describe(s)
+}
+
+// describe saves metadata published by the service.
+func (r *registry) describe(s *Status) {
+	r.restarts = s.Restarts
+	r.version = s.Version
+	r.tags = s.Tags
+	r.labels = s.Labels
+	r.endpoints = s.Endpoints
+	r.leads = s.Leads
+	r.metrics = s.Metrics
 }
 
 func (r *registry) toStatus() *Status {
 	return &Status{
-		Name:   r.name,
-		Domain: r.domain,
-		State:  r.state,
-		Ready:  r.ready,
-		Time:   r.updateTime,
+		Name:     r.name,
+		Instance: r.instance,
+		Domain:   r.domain,
+		State:    r.state,
+		Ready:    r.ready,
+		Restarts: r.restarts,
+		Time:     r.updateTime,
+
+		Version:   r.version,
+		Tags:      r.tags,
+		Labels:    r.labels,
+		Endpoints: r.endpoints,
+		Leads:     r.leads,
+		Metrics:   r.metrics,
+
+		CheckInterval: uint32(r.interval / 1000),
+		AllowFailures: uint32(r.threshold),
 	}
 }
 
+// registryGroup holds registry info of all
+// instances sharing the same service name.
+type registryGroup struct {
+	sync.RWMutex
+	name      string
+	instances map[string]*registry
+}
+
+func newRegistryGroup(name string) *registryGroup {
+	return &registryGroup{
+		name:      name,
+		instances: make(map[string]*registry),
+	}
+}
+
+func (g *registryGroup) get(instance string) *registry {
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.instances[instance]
+}
+
+func (g *registryGroup) put(r *registry) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.instances[r.instance] = r
+}
+
+// remove deletes the instance and returns
+// number of instances left.
+func (g *registryGroup) remove(instance string) int {
+	g.Lock()
+	defer g.Unlock()
+
+	delete(g.instances, instance)
+	return len(g.instances)
+}
+
+func (g *registryGroup) size() int {
+	g.RLock()
+	defer g.RUnlock()
+
+	return len(g.instances)
+}
+
+func (g *registryGroup) list() []*registry {
+	g.RLock()
+	defer g.RUnlock()
+
+	var list []*registry
+	for _, r := range g.instances {
+		list = append(list, r)
+	}
+
+	return list
+}
+
+// pick returns the representative instance of the group,
+// preferring servicing and ready ones, or nil if empty.
+func (g *registryGroup) pick() *registry {
+	g.RLock()
+	defer g.RUnlock()
+
+	var best *registry
+	for _, r := range g.instances {
+		if best == nil || rankOf(r) > rankOf(best) ||
+			(rankOf(r) == rankOf(best) && r.updateTime > best.updateTime) {
+			best = r
+		}
+	}
+
+	return best
+}
+
+func rankOf(r *registry) int {
+	rank := 0
+	if r.state == Servicing {
+		rank += 2
+	}
+
+	if r.ready {
+		rank++
+	}
+
+	return rank
+}
+
 // RegistryManager manages all services as service clients.
 type RegistryManager struct {
 	*MetaService
-	services sync.Map      //registry repository
+	services sync.Map      //registry repository, name -> *registryGroup
 	timer    *time.Timer   //timeout check timer
 	duration time.Duration //timeout check timer duration, 5s by default
+	domain   int           //domain served, status of other domains are ignored
+	leases   *leaseTable   //leases granted to instances, see Elector
+	splits   sync.Map      //traffic splits of services, name -> *TrafficSplit
+
+	// events records changes of instances if enabled, see WithEventLog
+	events     *EventLog
+	eventPath  string
+	eventAge   time.Duration
+	eventLimit int
+
+	// updating serializes changes of instances, which are replaced
+	// rather than modified, so that readers hold consistent snapshots
+	updating sync.Mutex
+
+	mutex     sync.RWMutex             //guards observers
+	observers []func(old, new *Status) //status change observers
 
 	//watchers map[string][]*Watcher
 	//mutex    sync.RWMutex
@@ -120,6 +261,19 @@ func (s *RegistryManager) Startup() bool {
 			QueryStatus:     s.handleQueryStatus,
 			QueryStatusList: s.handleQueryStatusList,
 		})
+	s.exposeLeases()
+	s.exposeEvents()
+	s.exposeSplits()
+
+	if len(s.eventPath) != 0 {
+		events, err := OpenEventLog(s.eventPath, s.eventAge, s.eventLimit)
+		if err != nil {
+			log.Errorln("registry manager open event log failed:", err)
+			return false
+		}
+
+		s.events = events
+	}
 
 	err := s.RpcServer().Serve()
 	if err != nil {
@@ -133,6 +287,7 @@ func (s *RegistryManager) Startup() bool {
 	//_ = s.ExposeMethod(EndpointServiceNotice, s.handleWatch)
 
 	s.timer = time.AfterFunc(s.duration, s.checkTimeout)
+	liveRegistries.Store(s, s)
 
 	log.Infoln("registry manager started")
 
@@ -157,16 +312,23 @@ func (s *RegistryManager) Shutdown() {
 	//	}
 	//}
 	s.timer.Stop()
+	liveRegistries.Delete(s)
+
+	if s.events != nil {
+		if err := s.events.Close(); err != nil {
+			log.Warnf("close event log %s failed: %v", s.events.Path(), err)
+		}
+	}
 
 	log.Infoln("registry manager shutdown")
 }
 
-// Registered returns true if the service is
-// registered to the center and false otherwise.
+// Registered returns true if any instance of the service
+// is registered to the center and false otherwise.
 //
 //	This method is goroutine-safe.
 func (s *RegistryManager) Registered(name string) bool {
-	if _, ok := s.services.Load(name); ok {
+	if g := s.group(name); g != nil && g.size() != 0 {
 		return true
 	}
 
@@ -184,23 +346,60 @@ func (s *RegistryManager) Count() int {
 	return counter
 }
 
-// GetService returns the service associated with the
-// given name or nil if not found.
+// InstanceCount returns number of instances registered
+// for the given service.
+func (s *RegistryManager) InstanceCount(name string) int {
+	if g := s.group(name); g != nil {
+		return g.size()
+	}
+
+	return 0
+}
+
+func (s *RegistryManager) group(name string) *registryGroup {
+	if g, ok := s.services.Load(name); ok {
+		return g.(*registryGroup)
+	}
+
+	return nil
+}
+
+// get returns the representative instance of the service
+// associated with the given name or nil if not found.
 //
 //	This method is goroutine-safe.
 func (s *RegistryManager) get(name string) *registry {
-	if sd, ok := s.services.Load(name); ok {
-		return sd.(*registry)
+	if g := s.group(name); g != nil {
+		return g.pick()
 	}
 
 	return nil
 }
 
+// getInstance returns the given instance of the service
+// or nil if not found.
+func (s *RegistryManager) getInstance(name, instance string) *registry {
+	if g := s.group(name); g != nil {
+		return g.get(instance)
+	}
+
+	return nil
+}
+
+// instances returns all instances of the given service.
+func (s *RegistryManager) instances(name string) []*registry {
+	if g := s.group(name); g != nil {
+		return g.list()
+	}
+
+	return nil
+}
+
+// all returns all instances of all services.
 func (s *RegistryManager) all() []*registry {
 	var list []*registry
 	s.services.Range(func(key, value any) bool {
-		reg := value.(*registry)
-		list = append(list, reg)
+		list = append(list, value.(*registryGroup).list()...)
 		return true
 	})
 
@@ -213,6 +412,7 @@ func (s *RegistryManager) registry(status *Status) *registry {
 
 	r := &registry{
 		name:       status.Name,
+		instance:   status.InstanceId(),
 		domain:     status.Domain,
 		state:      status.State,
 		ready:      status.Ready,
@@ -222,6 +422,8 @@ func (s *RegistryManager) registry(status *Status) *registry {
 		threshold:  uint64(status.AllowFailures),
 	}
 
+	r.describe(status)
+
 	box.SetIfEq(&r.interval, 0, StatusReportInterval*1000)
 	box.SetIfEq(&r.threshold, 0, StatusLostThreshold)
 	box.SetIfEq(&r.purgeDelay, 0, ReviveWaitThreshold)
@@ -229,14 +431,18 @@ func (s *RegistryManager) registry(status *Status) *registry {
 	return r
 }
 
-// Up saves a service with the given name and set
-// state to online.
+// register saves an instance of the service with the
+// given name and set state to online.
 //
 //	This method is goroutine-safe.
 func (s *RegistryManager) register(status *Status) {
-	s.services.Store(status.Name, s.registry(status))
+	reg := s.registry(status)
+	g, _ := s.services.LoadOrStore(status.Name, newRegistryGroup(status.Name))
+	g.(*registryGroup).put(reg)
+	s.record(EventRegistered, &registry{}, reg)
 
-	log.Infof("service %s registered, state = %s", status.Name, status.State.String())
+	log.Infof("service %s(%s) registered, state = %s",
+		status.Name, status.InstanceId(), status.State.String())
 }
 
 func (s *RegistryManager) update(reg *registry, status *Status) {
@@ -247,30 +453,60 @@ func (s *RegistryManager) update(reg *registry, status *Status) {
 	}
 
 	// overwrite states
-	reg.update(status)
+	next := *reg
+	next.update(status)
+
+	if reg.state != next.state {
+		s.record(EventStateChanged, reg, &next)
+	}
+
+	if reg.ready != next.ready {
+		s.record(EventReadyChanged, reg, &next)
+	}
 
 	// de-register if stopped normally
-	if reg.state == Stopped {
-		s.unregister(reg.name)
+	if next.state == Stopped {
+		s.unregister(next.name, next.instance)
+		s.record(EventUnregistered, &next, &next)
+	} else if g := s.group(next.name); g != nil {
+		g.put(&next)
 	}
 }
 
-// Down de-registers a service and sets state to offline.
+// unregister de-registers an instance of a service, and the service
+// itself is removed when no instances left.
 // Does nothing when the service is not found.
 //
 //	This method is goroutine-safe.
-func (s *RegistryManager) unregister(name string) {
-	s.services.Delete(name)
-	log.Infof("service %s unregistered", name)
+func (s *RegistryManager) unregister(name, instance string) {
+	g := s.group(name)
+	if g == nil {
+		return
+	}
+
+	if g.remove(instance) == 0 {
+		s.services.Delete(name)
+	}
+
+	log.Infof("service %s(%s) unregistered", name, instance)
 }
 
 func (s *RegistryManager) notifyWatched(reg *registry, status *Status) {
-	log.Infof("service %s state changed(%s -> %s)",
-		reg.name, reg.state, status.State)
+	log.Infof("service %s(%s) state changed(%s -> %s)",
+		reg.name, reg.instance, reg.state, status.State)
 
 	data, _ := json.Marshal(status)
 	_ = s.Notify(EndpointServiceNotice, data)
 
+	s.mutex.RLock()
+	observers := s.observers
+	s.mutex.RUnlock()
+
+	old := reg.toStatus()
+	for _, fn := range observers {
+		fn(old, status)
+	}
+
 	//s.mutex.RLock()
 	//defer s.mutex.RUnlock()
 	//
@@ -291,6 +527,54 @@ func (s *RegistryManager) notifyWatched(reg *registry, status *Status) {
 	//}
 }
 
+// record appends the change of an instance from old to next
+// to the event log, if enabled.
+func (s *RegistryManager) record(typ EventType, old, next *registry) {
+	if s.events == nil {
+		return
+	}
+
+	err := s.events.Append(&RegistryEvent{
+		Type:      typ,
+		Service:   next.name,
+		Instance:  next.instance,
+		Domain:    next.domain,
+		PrevState: old.state,
+		State:     next.state,
+		PrevReady: old.ready,
+		Ready:     next.ready,
+		Version:   next.version,
+	})
+	if err != nil {
+		log.Warnf("record %s event of service %s(%s) failed: %v", typ, next.name, next.instance, err)
+	}
+}
+
+// exposeEvents routes QueryEvents on the info channel of the registry.
+func (s *RegistryManager) exposeEvents() {
+	queryEventsMethod.Expose(s, func(req *QueryEventsReq) (*QueryEventsRsp, error) {
+		if s.events == nil {
+			return nil, ErrEventLogDisabled
+		}
+
+		return s.events.Query(req)
+	})
+}
+
+// Events returns the event log of the registry, or nil if disabled.
+func (s *RegistryManager) Events() *EventLog {
+	return s.events
+}
+
+// observe registers fn to be called, within the registry
+// goroutine, when state or readiness of a service changes.
+func (s *RegistryManager) observe(fn func(old, new *Status)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observers = append(s.observers, fn)
+}
+
 func (s *RegistryManager) handleStatus(data []byte) {
 	status := &Status{}
 	if err := json.Unmarshal(data, status); err != nil {
@@ -298,8 +582,18 @@ func (s *RegistryManager) handleStatus(data []byte) {
 		return
 	}
 
-	if ss, ok := s.services.Load(status.Name); ok {
-		reg := ss.(*registry)
+	if status.Domain != s.domain {
+		log.Warnf("registry manager: ignore status of %s(%s) in domain %d",
+			status.Name, status.InstanceId(), status.Domain)
+		return
+	}
+
+	registryReports.Inc(status.Name)
+
+	s.updating.Lock()
+	defer s.updating.Unlock()
+
+	if reg := s.getInstance(status.Name, status.InstanceId()); reg != nil {
 		s.update(reg, status)
 	} else {
 		s.register(status)
@@ -351,21 +645,18 @@ func (s *RegistryManager) handleQueryStatus(req *jsonrpc2.RPCRequest) *jsonrpc2.
 		return jsonrpc2.NewErrorResponseWithCodeOnly(jsonrpc2.ErrServerInvalidParameters)
 	}
 
-	reg := s.get(reqObj.Name)
+	var reg *registry
+	if len(reqObj.Instance) != 0 {
+		reg = s.getInstance(reqObj.Name, reqObj.Instance)
+	} else {
+		reg = s.get(reqObj.Name)
+	}
+
 	if reg == nil {
 		return jsonrpc2.NewErrorResponse(jsonrpc2.ErrServerInvalid, "service name does not exist")
 	}
 
-	return jsonrpc2.NewResponse(req, &QueryStatusRsp{Status: &Status{
-		Name:   reg.name,
-		Domain: reg.domain,
-		State:  reg.state,
-		Time:   reg.updateTime,
-		Ready:  reg.ready,
-		//Metrics: reg.metrics,
-		//CheckInterval: uint32(reg.interval),
-		//AllowFailures: uint32(reg.threshold),
-	}})
+	return jsonrpc2.NewResponse(req, &QueryStatusRsp{Status: reg.toStatus()})
 }
 
 func (s *RegistryManager) handleQueryStatusList(req *jsonrpc2.RPCRequest) *jsonrpc2.RPCResponse {
@@ -375,60 +666,70 @@ func (s *RegistryManager) handleQueryStatusList(req *jsonrpc2.RPCRequest) *jsonr
 		return jsonrpc2.NewErrorResponseWithCodeOnly(jsonrpc2.ErrServerInvalidParameters)
 	}
 
-	var list StatusList
-	all := s.all()
-	whitelist := reqObj.Observed
-	if whitelist != nil && len(whitelist) != 0 {
-		// if given whitelist, return them
-		for _, name := range whitelist {
-			for _, reg := range all {
-				if reg.name == name {
-					list.Services = append(list.Services, &Status{
-						Name:   reg.name,
-						Domain: reg.domain,
-						State:  reg.state,
-						Time:   reg.updateTime,
-						Ready:  reg.ready,
-					})
-				}
-			}
+	if _, err = ParseVersionRange(reqObj.Version); err != nil {
+		return jsonrpc2.NewErrorResponse(jsonrpc2.ErrServerInvalidParameters, err.Error())
+	}
+
+	list, err := paginate(s.query(&reqObj), &reqObj)
+	if err != nil {
+		return jsonrpc2.NewErrorResponse(jsonrpc2.ErrServerInvalidParameters, err.Error())
+	}
+
+	return jsonrpc2.NewResponse(req, &QueryStatusListRsp{List: list})
+}
+
+// query returns status of instances selected by the filter.
+func (s *RegistryManager) query(filter *QueryStatusListReq) []*Status {
+	var regs []*registry
+	if len(filter.Observed) != 0 {
+		// if given whitelist, return instances of them
+		for _, name := range filter.Observed {
+			regs = append(regs, s.instances(name)...)
 		}
 	} else {
 		// if no whitelist, return all
-		for _, reg := range all {
-			list.Services = append(list.Services, &Status{
-				Name:   reg.name,
-				Domain: reg.domain,
-				State:  reg.state,
-				Time:   reg.updateTime,
-				Ready:  reg.ready,
-			})
+		regs = s.all()
+	}
+
+	var result []*Status
+	for _, reg := range regs {
+		if status := reg.toStatus(); filter.match(status) {
+			result = append(result, status)
 		}
 	}
 
-	return jsonrpc2.NewResponse(req, &QueryStatusListRsp{List: &list})
+	return result
 }
 
-// checkTimeout iterates over each service
+// checkTimeout iterates over each service instance
 // and checks if its state is deprecated.
 func (s *RegistryManager) checkTimeout() {
+	s.updating.Lock()
+	defer s.updating.Unlock()
+
 	s.services.Range(func(key, value any) bool {
-		service := value.(*registry)
-		if service.state == Offline {
-			if service.dead() {
-				//remove dead entries
-				s.services.Delete(key)
-			} else {
-				//wait for revival or dead
-			}
-		} else { //not Offline but heart-beating stopped
-			if service.timeout() {
-				//save old state to notify diff
-				old := *service
-				//force offline to change state
-				service.offline()
-				//notify based on both old and new status
-				s.notifyWatched(&old, service.toStatus())
+		g := value.(*registryGroup)
+		for _, service := range g.list() {
+			if service.state == Offline {
+				if service.dead() {
+					//remove dead entries
+					s.unregister(service.name, service.instance)
+					s.record(EventUnregistered, service, service)
+				} else {
+					//wait for revival or dead
+				}
+			} else { //not Offline but heart-beating stopped
+				if service.timeout() {
+					registryTimeouts.Inc(service.name)
+					//force offline to change state
+					next := *service
+					next.offline()
+					g.put(&next)
+					s.record(EventTimeout, service, &next)
+					//leases are left to expire, leaders may still renew them
+					//notify based on both old and new status
+					s.notifyWatched(service, next.toStatus())
+				}
 			}
 		}
 
@@ -446,6 +747,50 @@ func WithTimeoutCheckDuration(d time.Duration) RegistryOption {
 	}
 }
 
+// WithDomain makes the registry serve services of the given domain
+// only, i.e. it listens on endpoints scoped to the domain and ignores
+// status reported by services of other domains.
+func WithDomain(domain int) RegistryOption {
+	return func(m *RegistryManager) {
+		m.domain = domain
+		m.MetaService.domain = domain
+		m.status.Domain = domain
+	}
+}
+
+// WithAdminEndpoint enables an HTTP server listening on addr, which
+// exposes /healthz, /readyz, /services and /services/{name} of the registry.
+func WithAdminEndpoint(addr string) RegistryOption {
+	return func(m *RegistryManager) {
+		m.admin = NewAdminServer(addr)
+		(&Monitor{registry: m}).mountRegistry(m.admin)
+	}
+}
+
+// WithEventLog makes the registry record registrations, state and
+// readiness changes, and timeouts of instances into an event log at
+// path, which defaults to EventLogFile under EventLogDir of the working
+// dir if empty. Events are queried by QueryEvents of the registry,
+// and kept for EventLogRetention by default, see WithEventRetention.
+func WithEventLog(path string) RegistryOption {
+	return func(m *RegistryManager) {
+		if len(path) == 0 {
+			path = filepath.Join(box.GetWorkingDir(), EventLogDir, EventLogFile)
+		}
+
+		m.eventPath = path
+	}
+}
+
+// WithEventRetention overrides the max age, and the max number,
+// of events kept in the event log. Zero values disable the limit.
+func WithEventRetention(maxAge time.Duration, maxEvents int) RegistryOption {
+	return func(m *RegistryManager) {
+		m.eventAge = maxAge
+		m.eventLimit = maxEvents
+	}
+}
+
 // NewRegistryManager creates a service registry, which itself is also a service,
 // and nil is returned if the meta service creation failed.
 func NewRegistryManager(registry string, opts ...RegistryOption) *RegistryManager {
@@ -461,6 +806,9 @@ func NewRegistryManager(registry string, opts ...RegistryOption) *RegistryManage
 	s := &RegistryManager{
 		MetaService: regMgr,
 		duration:    StatusCheckInterval * time.Second, // default
+		leases:      newLeaseTable(),
+		eventAge:    EventLogRetention,
+		eventLimit:  EventLogMaxEvents,
 		//watchers:    make(map[string][]*Watcher),
 	}
 
@@ -45,3 +45,129 @@ func TestMonitorConcurrent(t *testing.T) {
 func TestMonitorNil(t *testing.T) {
 	DisableMonitor()
 }
+
+func TestRegistryInstances(t *testing.T) {
+	s := &RegistryManager{}
+
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"ready":true}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"b","state":1}`))
+	s.handleStatus([]byte(`{"name":"legacy","state":2}`))
+
+	assert.Equal(t, 2, s.Count())
+	assert.Equal(t, 2, s.InstanceCount("svc"))
+	assert.Len(t, s.all(), 3)
+	assert.Equal(t, "a", s.get("svc").instance)
+	assert.Equal(t, "legacy", s.get("legacy").instance)
+
+	s.unregister("svc", "a")
+	assert.Equal(t, "b", s.get("svc").instance)
+
+	s.unregister("svc", "b")
+	assert.False(t, s.Registered("svc"))
+	assert.Equal(t, 1, s.Count())
+}
+
+func TestRegistryHeartbeatTimeout(t *testing.T) {
+	s := &RegistryManager{}
+
+	// intervals are reported in seconds, on registration and updates
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"checkInterval":10,"allowFailures":3}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"checkInterval":10,"allowFailures":3}`))
+	r := s.getInstance("svc", "a")
+	assert.Equal(t, uint64(10*1000), r.interval)
+	assert.Equal(t, uint32(10), r.toStatus().CheckInterval)
+
+	r.updateTime -= 29 * 1000
+	assert.False(t, r.timeout())
+	r.updateTime -= 2 * 1000
+	assert.True(t, r.timeout())
+}
+
+func TestRegistryQuery(t *testing.T) {
+	s := &RegistryManager{}
+
+	s.handleStatus([]byte(`{"name":"svc","instance":"a","state":2,"version":"1.2.0","tags":["edge","gpu"],` +
+		`"labels":{"zone":"z1"},"endpoints":[{"channel":"/svc/rpc","methods":["echo","ping"]}]}`))
+	s.handleStatus([]byte(`{"name":"svc","instance":"b","state":2,"tags":["edge"],"labels":{"zone":"z2"}}`))
+	s.handleStatus([]byte(`{"name":"other","state":2,"endpoints":[{"channel":"/other/relay"}]}`))
+
+	assert.Len(t, s.query(&QueryStatusListReq{}), 3)
+	assert.Len(t, s.query(&QueryStatusListReq{Tags: []string{"edge"}}), 2)
+	assert.Len(t, s.query(&QueryStatusListReq{Labels: map[string]string{"zone": "z2"}}), 1)
+
+	found := s.query(&QueryStatusListReq{Tags: []string{"edge", "gpu"}, Method: "ping"})
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "a", found[0].Instance)
+		assert.Equal(t, "1.2.0", found[0].Version)
+	}
+
+	found = s.query(&QueryStatusListReq{Method: "/other/relay"})
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "other", found[0].Name)
+	}
+
+	assert.Empty(t, s.query(&QueryStatusListReq{Observed: []string{"other"}, Tags: []string{"edge"}}))
+}
+
+func TestRegistryQueryFilters(t *testing.T) {
+	s := &RegistryManager{}
+
+	s.handleStatus([]byte(`{"name":"edge-a","instance":"1","state":2,"ready":true,"version":"2.0","checkInterval":2,"metrics":{"qps":10}}`))
+	s.handleStatus([]byte(`{"name":"edge-a","instance":"2","state":1,"version":"1.0"}`))
+	s.handleStatus([]byte(`{"name":"edge-b","instance":"1","state":2,"ready":true,"version":"1.5"}`))
+	s.handleStatus([]byte(`{"name":"core","instance":"1","state":2,"version":"3.0","allowFailures":5}`))
+	s.getInstance("core", "1").updateTime -= 60 * 1000
+
+	names := func(list []*Status) []string {
+		var result []string
+		for _, st := range list {
+			result = append(result, st.Name+"/"+st.Instance)
+		}
+		return result
+	}
+
+	ready := true
+	assert.Len(t, s.query(&QueryStatusListReq{Prefix: "edge-"}), 3)
+	assert.Len(t, s.query(&QueryStatusListReq{Pattern: "*-b"}), 1)
+	assert.Len(t, s.query(&QueryStatusListReq{States: []State{Starting}}), 1)
+	assert.Len(t, s.query(&QueryStatusListReq{Ready: &ready}), 2)
+	assert.Len(t, s.query(&QueryStatusListReq{MaxAge: 30 * 1000}), 3)
+	assert.Len(t, s.query(&QueryStatusListReq{Domains: []int{1}}), 0)
+
+	found := s.query(&QueryStatusListReq{Observed: []string{"edge-a", "core"}, Pattern: "edge-?", Ready: &ready})
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, uint32(2), found[0].CheckInterval)
+		assert.Equal(t, uint32(StatusLostThreshold), found[0].AllowFailures)
+		assert.Equal(t, map[string]any{"qps": float64(10)}, found[0].Metrics)
+	}
+
+	page, err := paginate(s.query(&QueryStatusListReq{}), &QueryStatusListReq{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"core/1", "edge-a/1", "edge-a/2", "edge-b/1"}, names(page.Services))
+	assert.Empty(t, page.Next)
+
+	filter := &QueryStatusListReq{SortBy: SortByVersion, Desc: true, Limit: 3}
+	page, err = paginate(s.query(filter), filter)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"core/1", "edge-a/1", "edge-b/1"}, names(page.Services))
+	assert.NotEmpty(t, page.Next)
+
+	filter.Cursor = page.Next
+	page, err = paginate(s.query(filter), filter)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"edge-a/2"}, names(page.Services))
+	assert.Empty(t, page.Next)
+
+	// pages follow the cursor even if instances before it are gone
+	filter = &QueryStatusListReq{Limit: 2}
+	page, _ = paginate(s.query(filter), filter)
+	s.unregister("core", "1")
+	filter.Cursor = page.Next
+	page, _ = paginate(s.query(filter), filter)
+	assert.Equal(t, []string{"edge-a/2", "edge-b/1"}, names(page.Services))
+
+	_, err = paginate(s.query(filter), &QueryStatusListReq{Cursor: "garbage"})
+	assert.Equal(t, errBadCursor, err)
+	_, err = paginate(s.query(filter), &QueryStatusListReq{SortBy: "size"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	StopTimeout     = 10 //seconds, to wait for a service to stop
+	ShutdownTimeout = 30 //seconds, to wait for all services to stop
+)
+
+// MultiError aggregates errors of several services.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the aggregated errors.
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+// errorOrNil returns nil if no error is aggregated.
+func (e MultiError) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// StopWithTimeout stops the service as Stop does, but gives up waiting
+// when the timeout expires. In that case, the service is marked as
+// Stopped and reported to the registry, and an error is returned.
+func StopWithTimeout(s Service, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Stop(s)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		log.Errorf("stop service %s timeout after %v", s.Name(), timeout)
+		s.SetState(Stopped)
+		_ = s.Registrar().ReportStatus()
+		return fmt.Errorf("stop service %s timeout after %v", s.Name(), timeout)
+	}
+}
+
+// RunOption customizes the behavior of Runner.
+type RunOption func(*Runner)
+
+// WithStopTimeout overrides the per-service stop timeout, 10s by default.
+func WithStopTimeout(d time.Duration) RunOption {
+	return func(r *Runner) {
+		r.stopTimeout = d
+	}
+}
+
+// WithShutdownTimeout overrides the global shutdown timeout, 30s by default.
+func WithShutdownTimeout(d time.Duration) RunOption {
+	return func(r *Runner) {
+		r.shutdownTimeout = d
+	}
+}
+
+// WithReloadHandler sets the handler called on SIGHUP.
+// If not set, SIGHUP triggers shutdown as SIGINT and SIGTERM do.
+func WithReloadHandler(fn func()) RunOption {
+	return func(r *Runner) {
+		r.reload = fn
+	}
+}
+
+// Runner runs a group of services until the context
+// is done or a termination signal is received.
+type Runner struct {
+	stopTimeout     time.Duration
+	shutdownTimeout time.Duration
+	reload          func()
+}
+
+// NewRunner creates a runner with the given options.
+func NewRunner(opts ...RunOption) *Runner {
+	r := &Runner{
+		stopTimeout:     StopTimeout * time.Second,
+		shutdownTimeout: ShutdownTimeout * time.Second,
+	}
+
+	for _, fn := range opts {
+		fn(r)
+	}
+
+	return r
+}
+
+// Run starts services in order, waits for ctx to be done or SIGINT,
+// SIGTERM or SIGHUP to be received, and stops them in reverse order.
+//
+// If any service fails to start, those already started are stopped
+// and Run returns. Errors of starting and stopping are aggregated.
+func (r *Runner) Run(ctx context.Context, services ...Service) error {
+	var started []Service
+	for _, s := range services {
+		if !Start(s) {
+			errs := MultiError{fmt.Errorf("start service %s failed", s.Name())}
+			if err := r.shutdown(started); err != nil {
+				errs = append(errs, err.(MultiError)...)
+			}
+
+			return errs
+		}
+
+		started = append(started, s)
+	}
+
+	log.Infof("%d services started", len(started))
+
+	r.wait(ctx)
+
+	return r.shutdown(started)
+}
+
+func (r *Runner) wait(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infoln("context done, shutting down")
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP && r.reload != nil {
+				log.Infoln("SIGHUP received, reloading")
+				r.reload()
+				continue
+			}
+
+			log.Infof("%v received, shutting down", sig)
+			return
+		}
+	}
+}
+
+// shutdown stops services in reverse order, within both
+// the per-service and the global deadlines.
+func (r *Runner) shutdown(services []Service) error {
+	var errs MultiError
+
+	deadline := time.Now().Add(r.shutdownTimeout)
+	for i := len(services) - 1; i >= 0; i-- {
+		s := services[i]
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			s.SetState(Stopped)
+			_ = s.Registrar().ReportStatus()
+			errs = append(errs, fmt.Errorf("stop service %s skipped: shutdown timeout", s.Name()))
+			continue
+		}
+
+		timeout := r.stopTimeout
+		if remaining < timeout {
+			timeout = remaining
+		}
+
+		if err := StopWithTimeout(s, timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs.errorOrNil()
+}
+
+// Run starts the services and blocks until termination, using
+// default timeouts. See Runner.Run for details.
+//
+// It replaces the common pattern of:
+//
+//	service.Start(s)
+//	<-signals
+//	service.Stop(s)
+func Run(ctx context.Context, services ...Service) error {
+	return NewRunner().Run(ctx, services...)
+}
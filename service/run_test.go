@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type hangingService struct {
+	*MetaService
+	release chan struct{}
+}
+
+func (s *hangingService) Shutdown() {
+	<-s.release
+}
+
+func TestRunShutdown(t *testing.T) {
+	first := newInProcService(t, "run-first")
+	second := newInProcService(t, "run-second")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, first, second)
+	}()
+
+	assert.Eventually(t, func() bool { return second.State() == Servicing }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, Servicing, first.State())
+
+	cancel()
+	require.Nil(t, <-done)
+	assert.Equal(t, Stopped, first.State())
+	assert.Equal(t, Stopped, second.State())
+}
+
+func TestRunStopTimeout(t *testing.T) {
+	hanging := &hangingService{
+		MetaService: newInProcService(t, "run-hanging"),
+		release:     make(chan struct{}),
+	}
+	defer close(hanging.release)
+
+	other := newInProcService(t, "run-other")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewRunner(WithStopTimeout(50*time.Millisecond)).Run(ctx, other, hanging)
+	require.NotNil(t, err)
+
+	var errs MultiError
+	require.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 1)
+	assert.Contains(t, err.Error(), "run-hanging")
+	assert.Equal(t, Stopped, hanging.State())
+	assert.Equal(t, Stopped, other.State())
+}
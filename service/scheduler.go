@@ -0,0 +1,473 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box/meta"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SchedulerTick    = 100              //milliseconds, resolution of schedulers
+	MissedRunsMax    = 10               //max missed runs caught up by MissedRunAll
+	JobCheckpointKey = "scheduler/job/" //checkpoint key prefix of jobs, see Scheduler.checkpointKey
+
+	MetricsJobs = "jobs"
+)
+
+// ErrJobExists is returned when scheduling a job whose name is taken.
+var ErrJobExists = errors.New("job already exists")
+
+// OverlapPolicy defines what happens when a job is due
+// while its previous run is still in progress.
+type OverlapPolicy int
+
+const (
+	OverlapSkip  OverlapPolicy = iota // skip the run
+	OverlapQueue                      // run after the previous run finishes
+	OverlapAllow                      // run concurrently
+)
+
+// MissedPolicy defines what happens to runs missed while the
+// service was down, based on the last run saved in the checkpoint
+// store of the service.
+type MissedPolicy int
+
+const (
+	MissedSkip    MissedPolicy = iota // skip missed runs, nothing is saved
+	MissedRunOnce                     // run once for all missed runs
+	MissedRunAll                      // run once for each missed run, up to MissedRunsMax
+)
+
+// Job defines a scheduled task.
+type Job struct {
+	// Name identifies the job within the service.
+	Name string
+
+	// Schedule of the job, see Every and ParseCron.
+	Schedule Schedule
+
+	// Run is called when the job is due, with a context canceled
+	// when the scheduler stops or Timeout expires.
+	Run func(ctx context.Context) error
+
+	// Timeout, if positive, limits the duration of each run.
+	Timeout time.Duration
+
+	// Jitter, if positive, delays each run randomly by up to Jitter,
+	// to spread the load of jobs sharing the same schedule.
+	Jitter time.Duration
+
+	Overlap OverlapPolicy
+	Missed  MissedPolicy
+
+	// Singleton runs the job on one instance only across replicas of
+	// the service, i.e. the leader of the election named by the service
+	// and the job, see Elector.
+	Singleton bool
+}
+
+// JobStatus is exported in the jobs section of Status.Metrics.
+type JobStatus struct {
+	Next      uint64 `json:"next,omitempty"`    //timestamp in milliseconds
+	LastRun   uint64 `json:"lastRun,omitempty"` //timestamp in milliseconds
+	LastError string `json:"lastError,omitempty"`
+	Runs      uint64 `json:"runs"`
+	Failures  uint64 `json:"failures"`
+	Skipped   uint64 `json:"skipped"` //runs skipped due to overlapping
+	Running   int    `json:"running"`
+	Queued    int    `json:"queued,omitempty"`
+	Leader    bool   `json:"leader,omitempty"` //true if leading a singleton job
+}
+
+// jobState is the checkpoint of a job.
+type jobState struct {
+	LastRun uint64 `json:"lastRun"` //timestamp in milliseconds
+}
+
+type jobEntry struct {
+	*Job
+	elector *Elector //for singleton jobs
+
+	due     time.Time //the run due without jitter
+	next    time.Time //the run due with jitter
+	status  JobStatus
+	running int
+	queued  int
+}
+
+// Scheduler runs jobs of a service, driven by a meta.Loop ticking
+// every SchedulerTick. Jobs run only while the service is Servicing,
+// and runs due otherwise are delayed until then.
+//
+// Note: all methods are goroutine-safe.
+type Scheduler struct {
+	sync.Mutex
+	service *MetaService
+	jobs    map[string]*jobEntry
+	loop    meta.Loop
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newScheduler(s *MetaService) *Scheduler {
+	return &Scheduler{
+		service: s,
+		jobs:    make(map[string]*jobEntry),
+	}
+}
+
+// Scheduler returns the scheduler hosted by the service, which is
+// started and stopped together with the service.
+func (s *MetaService) Scheduler() *Scheduler {
+	return s.scheduler
+}
+
+// Schedule adds a job to the scheduler of the service.
+func (s *MetaService) Schedule(job *Job) error {
+	return s.scheduler.Add(job)
+}
+
+// Add adds a job, which is scheduled immediately if the scheduler is running.
+func (c *Scheduler) Add(job *Job) error {
+	if len(job.Name) == 0 || job.Schedule == nil || job.Run == nil {
+		return fmt.Errorf("job must have name, schedule and run func")
+	}
+
+	c.Lock()
+	if _, ok := c.jobs[job.Name]; ok {
+		c.Unlock()
+		return ErrJobExists
+	}
+
+	e := &jobEntry{Job: job}
+	if job.Singleton {
+		e.elector = NewElector(c.service, c.service.Name()+"/"+job.Name,
+			OnElected(func(uint64) { c.catchUp(e) }),
+			OnRevoked(func() { c.dropQueued(e) }))
+	}
+
+	c.jobs[job.Name] = e
+
+	running := c.loop != nil
+	if running {
+		c.prepare(e, time.Now())
+	}
+	c.Unlock()
+
+	if running && !job.Singleton {
+		c.catchUp(e)
+	}
+
+	return nil
+}
+
+// Remove removes a job, and waits for nothing, i.e. runs in
+// progress are canceled only when the scheduler stops.
+func (c *Scheduler) Remove(name string) {
+	c.Lock()
+	e, ok := c.jobs[name]
+	delete(c.jobs, name)
+	c.Unlock()
+
+	if ok && e.elector != nil {
+		e.elector.Stop()
+	}
+}
+
+// Jobs returns status of jobs, keyed by job name.
+func (c *Scheduler) Jobs() map[string]*JobStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.jobs) == 0 {
+		return nil
+	}
+
+	m := make(map[string]*JobStatus, len(c.jobs))
+	for name, e := range c.jobs {
+		st := e.status
+		st.Running = e.running
+		st.Queued = e.queued
+		if !e.next.IsZero() {
+			st.Next = uint64(e.next.UnixMilli())
+		}
+
+		st.Leader = e.elector != nil && e.elector.IsLeader()
+		m[name] = &st
+	}
+
+	return m
+}
+
+// start starts the loop, and handles runs missed while stopped,
+// of singleton jobs once elected.
+func (c *Scheduler) start() {
+	c.Lock()
+	if c.loop != nil {
+		c.Unlock()
+		return
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.loop = meta.NewLoop(c.service.Name()+"-scheduler", meta.LoopConfig{Tick: SchedulerTick})
+
+	now := time.Now()
+	var entries []*jobEntry
+	for _, e := range c.jobs {
+		c.prepare(e, now)
+		if e.elector == nil {
+			entries = append(entries, e)
+		}
+	}
+
+	c.loop.Run(meta.LoopRunHook{Working: c.tick})
+	c.Unlock()
+
+	// checkpoints are loaded without holding the lock
+	for _, e := range entries {
+		c.catchUp(e)
+	}
+}
+
+// stop stops the loop, cancels runs in progress and waits for them.
+func (c *Scheduler) stop() {
+	c.Lock()
+	loop := c.loop
+	c.loop = nil
+	var electors []*Elector
+	for _, e := range c.jobs {
+		if e.elector != nil {
+			electors = append(electors, e.elector)
+		}
+	}
+	c.Unlock()
+
+	if loop == nil {
+		return
+	}
+
+	loop.Stop()
+	c.cancel()
+	c.wg.Wait()
+
+	for _, e := range electors {
+		e.Stop()
+	}
+}
+
+// prepare computes the next run of the job, must be called with lock held.
+func (c *Scheduler) prepare(e *jobEntry, now time.Time) {
+	if e.elector != nil {
+		e.elector.Start()
+	}
+
+	e.due = e.Schedule.Next(now)
+	e.next = c.jittered(e)
+}
+
+// checkpointKey returns the checkpoint key of the job, in format
+// prefix + name for singleton jobs, run by one instance at a time, and
+// prefix + name + "/" + instance for others, since checkpoints are
+// shared by instances, see MetaService.Checkpoints. Runs missed by
+// other jobs are thus caught up across restarts only if the instance
+// is given by Descriptor.Instance.
+func (c *Scheduler) checkpointKey(e *jobEntry) string {
+	if e.Singleton {
+		return JobCheckpointKey + e.Name
+	}
+
+	return JobCheckpointKey + e.Name + "/" + c.service.Instance()
+}
+
+// catchUp queues runs of the job missed since the last run according
+// to the missed policy, which is called, for singleton jobs, only once
+// the instance is elected.
+func (c *Scheduler) catchUp(e *jobEntry) {
+	if e.Missed == MissedSkip {
+		return
+	}
+
+	state := &jobState{}
+	if _, err := c.service.LoadCheckpoint(c.checkpointKey(e), state); err != nil {
+		if !errors.Is(err, ErrCheckpointNotFound) {
+			log.Warnf("%s load checkpoint of job %s failed: %v", c.service.Name(), e.Name, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	missed := 0
+	for t := e.Schedule.Next(time.UnixMilli(int64(state.LastRun))); !t.IsZero() && !t.After(now); t = e.Schedule.Next(t) {
+		if missed++; missed >= MissedRunsMax {
+			break
+		}
+	}
+
+	if missed == 0 {
+		return
+	}
+
+	if e.Missed == MissedRunOnce {
+		missed = 1
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.loop == nil {
+		return
+	}
+
+	log.Infof("%s job %s missed %d runs, catch up", c.service.Name(), e.Name, missed)
+
+	// missed runs are queued and run one by one
+	e.next = now
+	e.queued += missed - 1
+}
+
+// dropQueued drops queued runs of a singleton job no longer led.
+func (c *Scheduler) dropQueued(e *jobEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	e.queued = 0
+}
+
+// advance computes the next run due of the job from the run due
+// instead of the tick, so that ticks and jitter do not drift the
+// schedule, and skips runs already past, e.g. when not servicing.
+func (c *Scheduler) advance(e *jobEntry, now time.Time) {
+	if now.Before(e.due) {
+		// dispatched early to catch up
+		return
+	}
+
+	e.due = e.Schedule.Next(e.due)
+	if !e.due.IsZero() && !e.due.After(now) {
+		e.due = e.Schedule.Next(now)
+	}
+}
+
+// jittered returns the dispatch time of the run due.
+func (c *Scheduler) jittered(e *jobEntry) time.Time {
+	if e.due.IsZero() || e.Jitter <= 0 {
+		return e.due
+	}
+
+	return e.due.Add(time.Duration(rand.Int63n(int64(e.Jitter))))
+}
+
+// tick dispatches due jobs.
+func (c *Scheduler) tick() error {
+	if c.service.State() != Servicing {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	names := make([]string, 0, len(c.jobs))
+	for name := range c.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := c.jobs[name]
+		if e.next.IsZero() || now.Before(e.next) {
+			continue
+		}
+
+		c.advance(e, now)
+		e.next = c.jittered(e)
+		if e.elector != nil && !e.elector.IsLeader() {
+			continue
+		}
+
+		if e.running > 0 {
+			switch e.Overlap {
+			case OverlapSkip:
+				e.status.Skipped++
+				log.Debugf("%s job %s still running, skipped", c.service.Name(), e.Name)
+				continue
+			case OverlapQueue:
+				e.queued++
+				continue
+			}
+		}
+
+		e.running++
+		c.wg.Add(1)
+		go c.run(e)
+	}
+
+	return nil
+}
+
+// run runs the job, followed by queued runs if any.
+func (c *Scheduler) run(e *jobEntry) {
+	defer c.wg.Done()
+
+	for {
+		err := c.runOnce(e)
+
+		c.Lock()
+		e.status.Runs++
+		e.status.LastRun = uint64(time.Now().UnixMilli())
+		e.status.LastError = ""
+		if err != nil {
+			e.status.Failures++
+			e.status.LastError = err.Error()
+		}
+
+		lastRun := e.status.LastRun
+		again := e.queued > 0 && c.ctx.Err() == nil
+		if again {
+			e.queued--
+		} else {
+			e.running--
+		}
+		c.Unlock()
+
+		if e.Missed != MissedSkip {
+			if _, err := c.service.SaveCheckpoint(c.checkpointKey(e), &jobState{LastRun: lastRun}); err != nil {
+				log.Warnf("%s save checkpoint of job %s failed: %v", c.service.Name(), e.Name, err)
+			}
+		}
+
+		if !again {
+			return
+		}
+	}
+}
+
+func (c *Scheduler) runOnce(e *jobEntry) (err error) {
+	ctx := c.ctx
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in job %s: %v", e.Name, r)
+		}
+
+		jobRunsTotal.Inc(c.service.Name(), e.Name, resultOf(err))
+		if err != nil {
+			log.Warnf("%s job %s failed: %v", c.service.Name(), e.Name, err)
+		}
+	}()
+
+	return e.Run(ctx)
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRuns(t *testing.T) {
+	s := newInProcService(t, "scheduler")
+
+	var runs int32
+	require.Nil(t, s.Schedule(&Job{
+		Name:     "tick",
+		Schedule: Every(50 * time.Millisecond),
+		Run: func(ctx context.Context) error {
+			if atomic.AddInt32(&runs, 1) == 2 {
+				return errors.New("oops")
+			}
+			return nil
+		},
+	}))
+
+	assert.Equal(t, ErrJobExists, s.Schedule(&Job{Name: "tick", Schedule: Every(time.Second), Run: func(context.Context) error { return nil }}))
+	assert.NotNil(t, s.Schedule(&Job{Name: "empty"}))
+
+	s.scheduler.start()
+	defer s.scheduler.stop()
+
+	// not run until servicing
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runs))
+
+	s.SetState(Servicing)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) >= 3 }, 2*time.Second, 10*time.Millisecond)
+
+	st := s.Scheduler().Jobs()["tick"]
+	require.NotNil(t, st)
+	assert.GreaterOrEqual(t, st.Runs, uint64(2))
+	assert.Equal(t, uint64(1), st.Failures)
+	assert.NotZero(t, st.Next)
+
+	s.Scheduler().Remove("tick")
+	assert.Nil(t, s.Scheduler().Jobs())
+}
+
+func TestSchedulerNoDrift(t *testing.T) {
+	c := &Scheduler{}
+	e := &jobEntry{Job: &Job{Name: "drift", Schedule: Every(time.Minute), Jitter: 10 * time.Second}}
+
+	base := time.Now()
+	c.prepare(e, base)
+	for i := 1; i <= 3; i++ {
+		due := base.Add(time.Duration(i) * time.Minute)
+		assert.Equal(t, due, e.due)
+		assert.False(t, e.next.Before(due))
+		assert.True(t, e.next.Before(due.Add(e.Jitter)))
+
+		// dispatched later than the jittered time by a tick
+		c.advance(e, e.next.Add(SchedulerTick*time.Millisecond))
+		e.next = c.jittered(e)
+	}
+
+	// dispatched early to catch up
+	due := e.due
+	c.advance(e, due.Add(-time.Second))
+	assert.Equal(t, due, e.due)
+
+	// runs already past are skipped
+	now := due.Add(5*time.Minute + time.Second)
+	c.advance(e, now)
+	assert.Equal(t, now.Add(time.Minute), e.due)
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	s := newInProcService(t, "scheduler")
+	s.SetState(Servicing)
+
+	release := make(chan struct{})
+	var skipRuns, queueRuns int32
+	blocking := func(runs *int32) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			atomic.AddInt32(runs, 1)
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil
+		}
+	}
+
+	require.Nil(t, s.Schedule(&Job{Name: "skip", Schedule: Every(50 * time.Millisecond), Run: blocking(&skipRuns)}))
+	require.Nil(t, s.Schedule(&Job{Name: "queue", Schedule: Every(50 * time.Millisecond), Overlap: OverlapQueue, Run: blocking(&queueRuns)}))
+
+	s.scheduler.start()
+	defer s.scheduler.stop()
+
+	require.Eventually(t, func() bool {
+		jobs := s.Scheduler().Jobs()
+		return jobs["skip"].Skipped >= 2 && jobs["queue"].Queued >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	jobs := s.Scheduler().Jobs()
+	assert.Equal(t, 1, jobs["skip"].Running)
+	assert.Equal(t, 1, jobs["queue"].Running)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&skipRuns))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queueRuns))
+
+	// queued runs follow the one in progress
+	close(release)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&queueRuns) >= 3 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSchedulerMissedRuns(t *testing.T) {
+	s := newInProcService(t, "scheduler")
+	s.checkpoints.dir = t.TempDir()
+	defer s.checkpoints.close()
+	s.SetState(Servicing)
+
+	lastRun := uint64(time.Now().Add(-55 * time.Minute).UnixMilli())
+	for _, name := range []string{"all", "once", "skip"} {
+		_, err := s.SaveCheckpoint(JobCheckpointKey+name+"/"+s.Instance(), &jobState{LastRun: lastRun})
+		require.Nil(t, err)
+	}
+
+	var all, once, skip int32
+	counter := func(runs *int32) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			atomic.AddInt32(runs, 1)
+			return nil
+		}
+	}
+
+	require.Nil(t, s.Schedule(&Job{Name: "all", Schedule: Every(10 * time.Minute), Missed: MissedRunAll, Run: counter(&all)}))
+	require.Nil(t, s.Schedule(&Job{Name: "once", Schedule: Every(10 * time.Minute), Missed: MissedRunOnce, Run: counter(&once)}))
+	require.Nil(t, s.Schedule(&Job{Name: "skip", Schedule: Every(10 * time.Minute), Run: counter(&skip)}))
+
+	s.scheduler.start()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&all) == 5 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(3 * SchedulerTick * time.Millisecond)
+	s.scheduler.stop()
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&all))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&once))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&skip))
+
+	// last run is saved
+	state := &jobState{}
+	_, err := s.LoadCheckpoint(JobCheckpointKey+"all/"+s.Instance(), state)
+	require.Nil(t, err)
+	assert.Greater(t, state.LastRun, lastRun)
+
+	// runs of other instances are not taken as runs of this one
+	_, err = s.LoadCheckpoint(JobCheckpointKey+"all", state)
+	assert.ErrorIs(t, err, ErrCheckpointNotFound)
+}
+
+func TestSchedulerSingleton(t *testing.T) {
+	reg := &RegistryManager{MetaService: newInProcService(t, Registry), leases: newLeaseTable()}
+	reg.exposeLeases()
+	require.Nil(t, reg.RpcServer().Serve())
+	reg.SetState(Servicing)
+
+	var runs int32
+	require.Nil(t, reg.Schedule(&Job{
+		Name:      "compact",
+		Schedule:  Every(50 * time.Millisecond),
+		Singleton: true,
+		Run: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		},
+	}))
+
+	reg.scheduler.start()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) >= 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, reg.Scheduler().Jobs()["compact"].Leader)
+	assert.Equal(t, []string{Registry + "/compact"}, reg.leads())
+
+	// leadership is given up when stopped
+	reg.scheduler.stop()
+	assert.Empty(t, reg.Leases())
+}
+
+func TestSchedulerSingletonMissedRuns(t *testing.T) {
+	reg := &RegistryManager{MetaService: newInProcService(t, Registry), leases: newLeaseTable()}
+	reg.checkpoints.dir = t.TempDir()
+	defer reg.checkpoints.close()
+	reg.exposeLeases()
+	require.Nil(t, reg.RpcServer().Serve())
+	reg.SetState(Servicing)
+
+	lastRun := uint64(time.Now().Add(-35 * time.Minute).UnixMilli())
+	_, err := reg.SaveCheckpoint(JobCheckpointKey+"report", &jobState{LastRun: lastRun})
+	require.Nil(t, err)
+
+	var runs int32
+	require.Nil(t, reg.Schedule(&Job{
+		Name:      "report",
+		Schedule:  Every(10 * time.Minute),
+		Missed:    MissedRunAll,
+		Singleton: true,
+		Run: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		},
+	}))
+	reg.scheduler.jobs["report"].elector.ttl = 150 * time.Millisecond
+
+	// missed runs are not counted while led by another replica
+	reg.leases.acquire(&LeaseReq{Name: Registry + "/report", Holder: "other", TTL: 60000})
+	reg.scheduler.start()
+	defer reg.scheduler.stop()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runs))
+	assert.Equal(t, 0, reg.Scheduler().Jobs()["report"].Queued)
+
+	// and caught up once elected
+	reg.leases.revoke("other")
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) == 3 }, 2*time.Second, 10*time.Millisecond)
+}
@@ -1,12 +1,20 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/zourva/pareto/box"
+	"github.com/zourva/pareto/builder"
 	"github.com/zourva/pareto/endec/jsonrpc2"
 	"github.com/zourva/pareto/ipc"
+	"github.com/zourva/pareto/trace"
+	"github.com/zourva/pareto/uuid"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,6 +31,12 @@ type Service interface {
 	// Name returns the name of the service.
 	Name() string
 
+	// Instance returns the instance id of the service.
+	Instance() string
+
+	// Domain returns the domain the service belongs to.
+	Domain() int
+
 	//Messager returns internal messager instance.
 	Messager() *ipc.Messager
 
@@ -93,18 +107,38 @@ type Service interface {
 // provides a bunch of methods for inheritance.
 type MetaService struct {
 	name        string //name of this service
+	instance    string //instance id of this service
+	domain      int    //domain this service belongs to
 	registry    string //registry this service registered to
 	enableTrace bool   //enable trace of service messaging
 
-	conf   *StatusConf //status report config
-	status *Status     //status snapshot
+	conf       *StatusConf  //status report config
+	status     *Status      //status snapshot
+	statusLock sync.RWMutex //guards status
 
 	invoker  *jsonrpc2.Client  //JSON rpc caller
 	exposer  *jsonrpc2.Server  //JSON rpc callee
 	messager *ipc.Messager     //raw messager bound to
 	handler  ipc.CalleeHandler //private RR channel handler
 
-	registrar Registrar //registry client
+	registrar Registrar      //registry client
+	balancer  *balancer      //instance balancer of outgoing calls
+	health    *healthChecker //health checks runner
+	admin     *AdminServer   //optional HTTP admin server
+
+	checkpoints *checkpointer  //checkpoint store, opened on demand
+	guard       *guard         //call policies and breakers of targets
+	tracer      *trace.Tracer  //optional tracer
+	scheduler   *Scheduler     //hosted job scheduler
+	acl         *accessControl //identity and access rules of methods
+	faults      *faultInjector //fault rules of messages, see SetFaults
+	limits      *limiter       //limits of exposed channels and methods
+
+	mutex    sync.RWMutex          //guards the fields below
+	metrics  map[string]func() any //metrics sections exported in status
+	failure  func(err error)       //failure hook installed by supervisor
+	exposed  map[string]bool       //channels exposed by ExposeMethod
+	electors map[string]*Elector   //electors by election name
 
 	watched []string //watched service list, not thread-safe
 	//locker  sync.Locker
@@ -114,6 +148,19 @@ func (s *MetaService) Name() string {
 	return s.name
 }
 
+func (s *MetaService) Instance() string {
+	return s.instance
+}
+
+func (s *MetaService) Domain() int {
+	return s.domain
+}
+
+// AdminServer returns the HTTP admin server, or nil if not enabled.
+func (s *MetaService) AdminServer() *AdminServer {
+	return s.admin
+}
+
 func (s *MetaService) Messager() *ipc.Messager {
 	return s.messager
 }
@@ -146,26 +193,75 @@ func (s *MetaService) Startup() bool {
 // this service manually. Use it carefully
 // since liveness may cause cascade failures.
 func (s *MetaService) SetState(state State) {
+	s.statusLock.Lock()
 	s.status.State = state
+	s.statusLock.Unlock()
+
+	// readiness checks take effect once servicing
+	if state == Servicing {
+		s.onHealthChanged(s.health.report())
+	}
 }
 
 // State returns liveness of this service.
 func (s *MetaService) State() State {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+
 	return s.status.State
 }
 
 func (s *MetaService) SetReady(r bool) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
 	s.status.Ready = r
 }
 
 // Ready returns readiness of this service.
 func (s *MetaService) Ready() bool {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+
 	return s.status.Ready
 }
 
 func (s *MetaService) Shutdown() {
 }
 
+// Fail reports a fatal error of the service, e.g. a lost connection
+// which can't be recovered. Panics inside handlers are reported too.
+//
+// If the service is supervised, the supervisor restarts it according
+// to its RestartPolicy, otherwise the error is only logged.
+func (s *MetaService) Fail(err error) {
+	log.Errorf("service %s failed: %v", s.Name(), err)
+
+	s.mutex.RLock()
+	fn := s.failure
+	s.mutex.RUnlock()
+
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// setFailureHook installs the hook called by Fail.
+func (s *MetaService) setFailureHook(fn func(err error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failure = fn
+}
+
+// setRestarts sets the number of restarts exported in status.
+func (s *MetaService) setRestarts(n uint32) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	s.status.Restarts = n
+}
+
 func (s *MetaService) AfterRegistered() {
 	if s.handler != nil {
 		err := s.ExposeMethod(EndpointServiceRRHandlePrefix+s.Name(), s.handler)
@@ -198,8 +294,59 @@ func (s *MetaService) AfterStopping() {
 	log.Debugln("finish shutdown service", s.Name())
 }
 
+// RegisterMetrics adds a named section to Status.Metrics, whose
+// value is produced by fn each time the status is marshaled.
+// The section is replaced if already exists, and removed if fn is nil.
+//
+// Once any section is registered, Status.Metrics is managed by the
+// service and is always a map of section names to values.
+func (s *MetaService) RegisterMetrics(section string, fn func() any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if fn == nil {
+		delete(s.metrics, section)
+		return
+	}
+
+	s.metrics[section] = fn
+}
+
+// collectMetrics returns non-nil values of all metrics sections,
+// or nil if there is none.
+func (s *MetaService) collectMetrics() map[string]any {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var m map[string]any
+	for section, fn := range s.metrics {
+		if v := fn(); v != nil {
+			if m == nil {
+				m = make(map[string]any)
+			}
+
+			m[section] = v
+		}
+	}
+
+	return m
+}
+
 func (s *MetaService) MarshalStatus() []byte {
+	m := s.collectMetrics()
+	channels := s.channels()
+	leads := s.leads()
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
 	s.status.Time = box.TimeNowMs()
+	s.status.Endpoints = channels
+	s.status.Leads = leads
+	if m != nil {
+		s.status.Metrics = m
+	}
+
 	//s.status.Conf = s.conf
 	buf, err := json.Marshal(s.status)
 	if err != nil {
@@ -214,32 +361,330 @@ func (s *MetaService) MarshalStatus() []byte {
 //	log.Infoln("about to destroy service", s.Name())
 //}
 
-// Listen binds a handler to a subscribed topic.
+// Listen binds a handler to a subscribed topic of the domain of this service.
 // Old handler will be replaced if already bounded.
 func (s *MetaService) Listen(topic string, fn ipc.Handler) error {
-	log.Infof("%s subscribe to %s", s.Name(), topic)
-	return s.Messager().Subscribe(topic, fn)
+	return s.ListenDomain(s.domain, topic, fn)
+}
+
+// ListenContext is like Listen, and passes the handler the context
+// of the trace the notice belongs to, if any.
+func (s *MetaService) ListenContext(topic string, fn ContextHandler) error {
+	return s.listen(s.domain, topic, fn)
+}
+
+// ListenDomain binds a handler to a subscribed topic of the given domain.
+func (s *MetaService) ListenDomain(domain int, topic string, fn ipc.Handler) error {
+	return s.listen(domain, topic, func(_ context.Context, data []byte) {
+		fn(data)
+	})
+}
+
+func (s *MetaService) listen(domain int, topic string, fn ContextHandler) error {
+	scoped := DomainTopic(domain, topic)
+	log.Infof("%s subscribe to %s", s.Name(), scoped)
+	return s.Messager().Subscribe(scoped, s.instrumentHandler(topic, fn))
 }
 
-// Notify broadcasts a notice message to all subscribers and assumes no replies.
+// Notify broadcasts a notice message to all subscribers in the domain
+// of this service and assumes no replies.
 func (s *MetaService) Notify(topic string, data []byte) error {
+	return s.NotifyDomain(s.domain, topic, data)
+}
+
+// NotifyContext is like Notify, and propagates the trace
+// carried by ctx, if any, to the subscribers.
+func (s *MetaService) NotifyContext(ctx context.Context, topic string, data []byte) error {
+	return s.notify(ctx, s.domain, topic, data)
+}
+
+// NotifyDomain broadcasts a notice message to all subscribers
+// in the given domain and assumes no replies.
+func (s *MetaService) NotifyDomain(domain int, topic string, data []byte) error {
+	return s.notify(context.Background(), domain, topic, data)
+}
+
+func (s *MetaService) notify(ctx context.Context, domain int, topic string, data []byte) error {
+	scoped := DomainTopic(domain, topic)
 	if s.enableTrace {
-		log.Tracef("%s publish to %s", s.Name(), topic)
+		log.Tracef("%s publish to %s", s.Name(), scoped)
 	}
 
-	return s.Messager().Publish(topic, data)
+	data, publish, err := s.injectNotify(topic, data)
+	if !publish {
+		return err
+	}
+
+	_, span := s.startChild(ctx, topic, trace.KindProducer)
+	if span != nil {
+		data = sealEnvelope(map[string]string{trace.TraceParentHeader: span.Context().TraceParent()}, data)
+	}
+
+	err = s.Messager().Publish(scoped, data)
+	notifiesTotal.Inc(s.name, topic, resultOf(err))
+	span.SetError(err)
+	span.End()
+
+	return err
 }
 
 // ExposeMethod registers a server-side method, identified by name, with the given handler.
+// The method is bound both on the shared endpoint and on the instance-specific
+// endpoint, see InstanceEndpoint, both scoped to the domain of this service.
 func (s *MetaService) ExposeMethod(name string, fn ipc.CalleeHandler) error {
-	log.Infof("%s expose method at %s", s.Name(), name)
-	return s.Messager().ExposeV2(name, fn)
+	return s.ExposeMethodContext(name, func(_ context.Context, data []byte) ([]byte, error) {
+		return fn(data)
+	})
+}
+
+// ExposeMethodContext is like ExposeMethod, and passes the handler
+// the context of the trace the request belongs to, if any, and the
+// verified caller, see CallerFromContext.
+func (s *MetaService) ExposeMethodContext(name string, fn ContextCalleeHandler) error {
+	if err := s.expose(name, fn); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.exposed[name] = true
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// expose exposes the channel, in the domain of this service and
+// on the instance endpoint, without listing it in Status.Endpoints.
+func (s *MetaService) expose(name string, fn ContextCalleeHandler) error {
+	scoped := DomainTopic(s.domain, name)
+	log.Infof("%s expose method at %s", s.Name(), scoped)
+	handler := s.instrumentCallee(name, fn)
+	if err := s.Messager().ExposeV2(scoped, handler); err != nil {
+		return err
+	}
+
+	return s.Messager().ExposeV2(InstanceEndpoint(scoped, s.instance), handler)
+}
+
+// channels returns channels exposed by this service, together with
+// JSON-RPC methods routed on them, sorted by channel name.
+func (s *MetaService) channels() []*ChannelInfo {
+	s.mutex.RLock()
+	names := make(map[string]bool, len(s.exposed))
+	for name := range s.exposed {
+		names[name] = true
+	}
+	s.mutex.RUnlock()
+
+	router := s.exposer.Router()
+	for _, name := range router.Channels() {
+		names[name] = true
+	}
+
+	var result []*ChannelInfo
+	for name := range names {
+		info := &ChannelInfo{Channel: name}
+		if c := router.Channel(name); c != nil {
+			info.Methods = c.Methods()
+		}
+
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Channel < result[j].Channel
+	})
+
+	return result
 }
 
 // CallMethod calls a remote method identified by id.
-func (s *MetaService) CallMethod(name string, data []byte, to time.Duration) ([]byte, error) {
-	log.Tracef("%s invoke rpc %s", s.Name(), name)
-	return s.Messager().CallV2(name, data, to)
+//
+// By default, the call is delivered to any instance exposing the method
+// in the domain of this service. Use ToInstance to target a specific
+// instance, ToAnyInstance to balance over healthy instances of a service
+// known by the registry, and InDomain to call across domains. Balanced
+// calls are restricted to versions by WithVersion, and are split between
+// versions by the TrafficSplit of the service set in the registry.
+//
+// Calls are guarded by the CallPolicy of the method, if any, see SetCallPolicy.
+func (s *MetaService) CallMethod(name string, data []byte, to time.Duration, opts ...CallOption) ([]byte, error) {
+	return s.CallMethodContext(context.Background(), name, data, to, opts...)
+}
+
+// CallMethodContext is like CallMethod, and propagates the trace
+// carried by ctx, if any, to the callee.
+//
+// The payload is sent with the signed identity of the service,
+// if enabled by WithIdentity, see SetAccessRule.
+func (s *MetaService) CallMethodContext(ctx context.Context, name string, data []byte,
+	to time.Duration, opts ...CallOption) (rsp []byte, err error) {
+	o := newCallOptions(opts)
+	var versions *VersionRange
+	if len(o.version) != 0 {
+		if versions, err = ParseVersionRange(o.version); err != nil {
+			return nil, err
+		}
+	}
+
+	meta := make(map[string]string)
+	_, span := s.startChild(ctx, name, trace.KindClient)
+	if span != nil {
+		meta[trace.TraceParentHeader] = span.Context().TraceParent()
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+	}
+
+	if data, err = s.injectCall(name, data, to); err != nil {
+		return nil, err
+	}
+
+	domain := s.domain
+	if o.scoped {
+		domain = o.domain
+	}
+
+	policy := s.guard.policy(name)
+
+	attempts := 1
+	if policy != nil && policy.Retry != nil && (o.idempotent || policy.Idempotent) {
+		attempts = policy.Retry.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		// callers may give up, e.g. requests dropped by the gateway
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// identities are accepted once, sign each attempt
+		if attempt > 1 && o.unsigned {
+			data = s.resignRequest(name, data)
+		}
+
+		rsp, err := s.callOnce(name, s.sealCall(name, meta, data, o), to, domain, o, versions, policy)
+		if err == nil || attempt >= attempts || errors.Is(err, ErrCircuitOpen) {
+			return rsp, err
+		}
+
+		delay := policy.Retry.delay(attempt)
+		log.Debugf("%s retry rpc %s in %v, attempt %d failed: %v", s.Name(), name, delay, attempt, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// sealCall returns the payload sealed with the metadata, and the
+// signed identity of the service unless unsigned.
+func (s *MetaService) sealCall(name string, meta map[string]string, data []byte, o *callOptions) []byte {
+	if !o.unsigned {
+		if identity := s.signPayload(name, data); len(identity) != 0 {
+			signed := make(map[string]string, len(meta)+1)
+			for k, v := range meta {
+				signed[k] = v
+			}
+
+			signed[IdentityHeader] = identity
+			meta = signed
+		}
+	}
+
+	if len(meta) == 0 {
+		return data
+	}
+
+	return sealEnvelope(meta, data)
+}
+
+// callOnce delivers the call to the target resolved in the given
+// domain, guarded by the breaker of the target if the policy has any,
+// where instances of open circuits are skipped when balancing.
+func (s *MetaService) callOnce(name string, data []byte, to time.Duration,
+	domain int, o *callOptions, versions *VersionRange, policy *CallPolicy) ([]byte, error) {
+	begin := time.Now()
+	target := DomainTopic(domain, name)
+	var picked *Status
+	var br *breaker
+	if len(o.service) != 0 && len(o.instance) == 0 {
+		var err error
+		picked, target, br, err = s.pickTarget(target, domain, o, versions, policy)
+		if err != nil {
+			log.Warnf("%s invoke rpc %s failed: %v", s.Name(), name, err)
+			observeCall(s.name, name, begin, err)
+			return nil, err
+		}
+	} else {
+		if len(o.instance) != 0 {
+			target = InstanceEndpoint(target, o.instance)
+		}
+
+		br = s.guard.breaker(target, policy)
+		if br != nil {
+			if err := br.allow(); err != nil {
+				err = fmt.Errorf("%s: %w", target, err)
+				observeCall(s.name, name, begin, err)
+				return nil, err
+			}
+		}
+	}
+
+	log.Tracef("%s invoke rpc %s", s.Name(), target)
+	rsp, err := s.Messager().CallV2(target, data, to)
+	if err == nil {
+		rsp, err = openReply(rsp)
+	}
+
+	if br != nil {
+		br.record(err)
+	}
+
+	observeCall(s.name, name, begin, err)
+	if picked != nil {
+		observeVersionCall(s.name, picked, rsp, err)
+	}
+
+	if err != nil && len(o.service) != 0 {
+		// instance may be gone, refresh on next call
+		s.balancer.invalidate(domain, o.service)
+	}
+
+	return rsp, err
+}
+
+// pickTarget picks an instance of the service to call, and returns
+// it together with its endpoint of the target and the breaker of the
+// endpoint, which has admitted the call. Instances of open circuits
+// are skipped until all are picked once.
+func (s *MetaService) pickTarget(target string, domain int, o *callOptions,
+	versions *VersionRange, policy *CallPolicy) (*Status, string, *breaker, error) {
+	picked := make(map[string]bool)
+	for {
+		instance, err := s.balancer.pick(domain, o.service, o.policy, versions)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		endpoint := InstanceEndpoint(target, instance.InstanceId())
+		br := s.guard.breaker(endpoint, policy)
+		if br == nil {
+			return instance, endpoint, nil, nil
+		}
+
+		err = br.allow()
+		if err == nil {
+			return instance, endpoint, br, nil
+		}
+
+		if picked[endpoint] {
+			return nil, "", nil, fmt.Errorf("service %s: %w", o.service, err)
+		}
+
+		picked[endpoint] = true
+	}
 }
 
 // ForwardTo returns a pusher used to push messages,
@@ -323,7 +768,46 @@ func (s *MetaService) serviceWatched(name string) bool {
 	return false
 }
 
+// builtin defines components built into MetaService,
+// which follow the lifecycle of the service. It's satisfied
+// by any service embedding MetaService.
+type builtin interface {
+	startBuiltins()
+	stopBuiltins()
+}
+
+// startBuiltins starts built-in components before the service registers.
+func (s *MetaService) startBuiltins() {
+	liveServices.Store(s, s)
+	s.health.start()
+	s.scheduler.start()
+
+	if s.admin != nil {
+		if err := s.admin.Start(); err != nil {
+			log.Errorf("service %s start admin server failed: %v", s.Name(), err)
+		}
+	}
+}
+
+// stopBuiltins stops built-in components after the service is stopped.
+func (s *MetaService) stopBuiltins() {
+	s.scheduler.stop()
+	s.stopElectors()
+
+	if s.admin != nil {
+		s.admin.Stop()
+	}
+
+	s.health.stop()
+	s.checkpoints.close()
+	liveServices.Delete(s)
+}
+
 func (s *MetaService) initialize() bool {
+	if s.messager == nil && strings.HasPrefix(s.registry, InProcScheme) {
+		s.messager = inProcMessager(s.registry)
+	}
+
 	if s.messager == nil { // create a default messager
 		busName := fmt.Sprintf("%s-bus", s.name)
 		rpcName := fmt.Sprintf("%s-rpc", s.name)
@@ -349,8 +833,58 @@ func (s *MetaService) initialize() bool {
 		s.registrar = reg
 	}
 
+	s.health = newHealthChecker(s.onHealthChanged)
+	s.scheduler = newScheduler(s)
+	s.RegisterMetrics(MetricsHealth, func() any {
+		if s.health.empty(Readiness) && s.health.empty(Liveness) {
+			return nil
+		}
+
+		return s.health.report()
+	})
+
+	s.RegisterMetrics(MetricsJobs, func() any {
+		if jobs := s.scheduler.Jobs(); jobs != nil {
+			return jobs
+		}
+
+		return nil
+	})
+
+	s.RegisterMetrics(MetricsLimits, func() any {
+		if status := s.limits.status(); status != nil {
+			return status
+		}
+
+		return nil
+	})
+
+	s.RegisterMetrics(MetricsBreakers, func() any {
+		if status := s.guard.status(); status != nil {
+			return status
+		}
+
+		return nil
+	})
+
+	s.balancer = newBalancer(func(domain int, service string) ([]*Status, error) {
+		rsp, err := queryStatusListMethod.Invoke(s, &QueryStatusListReq{Observed: []string{service}},
+			StatusQueryTimeout*time.Second, InDomain(domain))
+		if err != nil || rsp.List == nil {
+			return nil, err
+		}
+
+		return rsp.List.Services, nil
+	})
+	s.balancer.splitter = s.registrar.QueryTrafficSplit
+
 	s.invoker = jsonrpc2.NewClient(NewJsonRpcInvoker(s))
+	s.invoker.AddHooks(s.traceCall, s.signCall)
 	s.exposer = jsonrpc2.NewServer(jsonrpc2.NewRouter(NewJsonRpcBinder(s)))
+	s.exposer.Router().AddServeHooks(s.traceServe)
+	s.exposer.Router().AddAuthorizers(s.authorizeRequest)
+	s.exposer.Router().AddAdmitters(s.admitRequest)
+	s.exposeFaults()
 
 	if s.conf == nil {
 		s.conf = getDefaultStatusConf()
@@ -363,11 +897,20 @@ func (s *MetaService) initialize() bool {
 //  1. registers the service to manager.
 //  2. invokes the user callback service.Start and related hooks.
 //  3. starts the status exporter of Registrar.
+//  4. restores state from checkpoints if the service is Recoverable.
 func Start(s Service) bool {
 	s.SetState(Offline)
 
+	b, hasBuiltins := s.(builtin)
+	if hasBuiltins {
+		b.startBuiltins()
+	}
+
 	if !s.Registrar().Register() {
 		log.Errorf("register service %s failed", s.Name())
+		if hasBuiltins {
+			b.stopBuiltins()
+		}
 		return false
 	}
 
@@ -375,14 +918,30 @@ func Start(s Service) bool {
 
 	s.SetState(Starting)
 
+	failed := func() bool {
+		s.SetState(Stopped)
+		s.Registrar().DisableStatusExport()
+		if hasBuiltins {
+			b.stopBuiltins()
+		}
+		return false
+	}
+
 	s.BeforeStarting()
 	if !s.Startup() {
-		return false
+		log.Errorf("startup service %s failed", s.Name())
+		return failed()
 	}
 	s.AfterStarting()
 
 	s.CheckRecovery(s.Registrar().StatusList())
 
+	if err := recoverService(s); err != nil {
+		log.Errorf("recover service %s failed: %v", s.Name(), err)
+		s.Shutdown()
+		return failed()
+	}
+
 	s.SetState(Servicing)
 
 	return true
@@ -394,6 +953,7 @@ func Start(s Service) bool {
 //  3. unregisters the service from manager.
 func Stop(s Service) {
 	s.SetState(Stopping)
+	_ = s.Registrar().ReportStatus()
 
 	s.BeforeStopping()
 	s.Shutdown()
@@ -404,9 +964,16 @@ func Stop(s Service) {
 	s.Registrar().DisableStatusExport()
 
 	s.Registrar().Unregister()
+
+	if b, ok := s.(builtin); ok {
+		b.stopBuiltins()
+	}
 }
 
 // New creates a service with the given name, registry and options.
+//
+// Several instances of the same service may coexist, each identified
+// by Descriptor.Instance, which is generated when not provided.
 func New(desc *Descriptor, options ...Option) Service {
 	return NewMetaService(desc, options...)
 }
@@ -421,6 +988,10 @@ func New(desc *Descriptor, options ...Option) Service {
 //  3. names for BUS & RPC created from the service name with a format of
 //     {service name}-bus and {service name}-rpc
 //
+// If the registry address starts with InProcScheme, e.g. inproc://test,
+// an inner-proc messager shared by all services of the same address is
+// used instead, which needs no broker, see the servicetest package.
+//
 // A default register is also created associating with the default messager.
 func NewMetaService(desc *Descriptor, options ...Option) *MetaService {
 	name := desc.Name
@@ -431,20 +1002,45 @@ func NewMetaService(desc *Descriptor, options ...Option) *MetaService {
 		return nil
 	}
 
+	instance := desc.Instance
+	if len(instance) == 0 {
+		instance = uuid.UUID()[:8]
+	}
+
+	version := desc.Version
+	if len(version) == 0 {
+		version = builder.Version
+	}
+
 	s := &MetaService{
 		name:        name,
+		instance:    instance,
+		domain:      domain,
 		registry:    reg,
 		enableTrace: false,
+		metrics:     make(map[string]func() any),
+		exposed:     make(map[string]bool),
+		electors:    make(map[string]*Elector),
+		checkpoints: &checkpointer{name: name},
+		guard:       newGuard(),
+		acl:         newAccessControl(),
+		faults:      &faultInjector{rules: desc.Faults},
+		limits:      newLimiter(),
 		//locker:      concurrent.NewSpinLock(),
 		status: &Status{
-			Name:   name,
-			Domain: domain,
-			State:  Offline,
-			Time:   box.TimeNowMs(),
-			Ready:  false,
+			Name:     name,
+			Instance: instance,
+			Domain:   domain,
+			State:    Offline,
+			Time:     box.TimeNowMs(),
+			Ready:    false,
+			Version:  version,
+			Tags:     desc.Tags,
+			Labels:   desc.Labels,
 		},
 	}
 
+	s.limits.reset(desc.Limits)
 	for _, fn := range options {
 		fn(s)
 	}
@@ -1,9 +1,13 @@
 package service
 
 import (
+	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/builder"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"github.com/zourva/pareto/ipc"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,9 +16,9 @@ import (
 )
 
 func TestNewMetaService(t *testing.T) {
-	assert.Nil(t, NewMetaService(&Descriptor{"", ""}))
-	assert.Nil(t, NewMetaService(&Descriptor{"test", ""}))
-	s := NewMetaService(&Descriptor{"test", "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
+	assert.Nil(t, NewMetaService(&Descriptor{Name: "", Registry: ""}))
+	assert.Nil(t, NewMetaService(&Descriptor{Name: "test", Registry: ""}))
+	s := NewMetaService(&Descriptor{Name: "test", Registry: "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
 	assert.NotNil(t, s)
 	assert.Equal(t, s.Name(), "test")
 }
@@ -27,16 +31,16 @@ func TestWatch(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 
-	w := NewMetaService(&Descriptor{"watcher", "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
+	w := NewMetaService(&Descriptor{Name: "watcher", Registry: "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
 	require.NotNil(t, w)
 
-	w1 := NewMetaService(&Descriptor{"watched1", "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
+	w1 := NewMetaService(&Descriptor{Name: "watched1", Registry: "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
 	require.NotNil(t, w1)
 
-	w2 := NewMetaService(&Descriptor{"watched2", "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
+	w2 := NewMetaService(&Descriptor{Name: "watched2", Registry: "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"})
 	require.NotNil(t, w2)
 
-	w3 := New(&Descriptor{"watched3", "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"},
+	w3 := New(&Descriptor{Name: "watched3", Registry: "nats://dag0HTXl4RGg7dXdaJwbC8@localhost:4222"},
 		WithPrivateChannelHandler(func(data []byte) ([]byte, error) {
 			return nil, nil
 		}))
@@ -69,3 +73,30 @@ func TestWatch(t *testing.T) {
 	Stop(w)
 	DisableMonitor()
 }
+
+func TestServiceMetadata(t *testing.T) {
+	m, err := ipc.NewMessager(&ipc.MessagerConf{
+		BusConf: &ipc.BusConf{Name: "meta-bus", Type: ipc.InnerProcBus},
+		RpcConf: &ipc.RPCConf{Name: "meta-rpc", Type: ipc.InnerProcRpc},
+	})
+	require.Nil(t, err)
+
+	s := NewMetaService(&Descriptor{Name: "meta", Registry: "inproc", Tags: []string{"edge"}}, WithMessager(m))
+	require.NotNil(t, s)
+
+	handler := func(req *jsonrpc2.RPCRequest) *jsonrpc2.RPCResponse { return nil }
+	s.RpcServer().Router().AddChannel("/meta/rpc", map[string]jsonrpc2.Handler{"ping": handler, "echo": handler})
+	require.Nil(t, s.RpcServer().Serve())
+	require.Nil(t, s.BindRelay("/meta/relay", func(data []byte) ([]byte, error) { return data, nil }))
+
+	status := &Status{}
+	require.Nil(t, json.Unmarshal(s.MarshalStatus(), status))
+	assert.Equal(t, builder.Version, status.Version)
+	assert.True(t, status.HasTags("edge"))
+	assert.Equal(t, []*ChannelInfo{
+		{Channel: "/meta/relay"},
+		{Channel: "/meta/rpc", Methods: []string{"echo", "ping"}},
+	}, status.Endpoints)
+	assert.True(t, status.Exposes("ping"))
+	assert.False(t, status.Exposes("pong"))
+}
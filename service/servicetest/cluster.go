@@ -0,0 +1,288 @@
+// Package servicetest provides a harness to test services, running a
+// registry and services attached to it within the test process.
+package servicetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zourva/pareto/broker"
+	"github.com/zourva/pareto/service"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	CheckInterval = 200 * time.Millisecond //default timeout check interval of the registry
+	WaitTimeout   = 5 * time.Second        //default timeout of waiting helpers
+)
+
+// clusters counts clusters created, to make unique in-proc addresses.
+var clusters int32
+
+type config struct {
+	nats     bool
+	domain   int
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// Option customizes a Cluster.
+type Option func(*config)
+
+// WithNats runs the cluster on an embedded NATS broker listening on
+// a random port, instead of in-proc messagers, which is slower but
+// exercises the wire.
+func WithNats() Option {
+	return func(c *config) {
+		c.nats = true
+	}
+}
+
+// WithDomain runs the registry and services in the given domain.
+func WithDomain(domain int) Option {
+	return func(c *config) {
+		c.domain = domain
+	}
+}
+
+// WithCheckInterval overrides CheckInterval, the interval the
+// registry checks for instances having stopped reporting status.
+func WithCheckInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithWaitTimeout overrides WaitTimeout of waiting helpers.
+func WithWaitTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// Cluster is a registry, and services attached to it, running within
+// the test process. By default, the registry and services exchange
+// messages using an in-proc messager shared by all of them, see
+// service.InProcScheme.
+//
+// All services started by the cluster, and the registry, are stopped
+// when the test ends.
+type Cluster struct {
+	Registry *service.RegistryManager
+
+	t       testing.TB
+	conf    *config
+	address string
+	nats    *broker.EmbeddedNats
+
+	// observer is a client service injecting reports and
+	// recording notices, which is not registered itself
+	observer *service.MetaService
+
+	mutex   sync.Mutex
+	notices []*service.Status
+	arrived chan struct{} //closed and recreated when a notice arrives
+}
+
+// NewCluster creates a cluster and starts its registry.
+func NewCluster(t testing.TB, opts ...Option) *Cluster {
+	t.Helper()
+
+	conf := &config{interval: CheckInterval, timeout: WaitTimeout}
+	for _, fn := range opts {
+		fn(conf)
+	}
+
+	c := &Cluster{t: t, conf: conf, arrived: make(chan struct{})}
+	if conf.nats {
+		nats, err := broker.NewEmbeddedNats(broker.WithRandomPort())
+		if err != nil {
+			t.Fatalf("create nats broker failed: %v", err)
+		}
+
+		if err = nats.Startup(); err != nil {
+			t.Fatalf("start nats broker failed: %v", err)
+		}
+
+		t.Cleanup(func() { _ = nats.Shutdown() })
+		c.nats = nats
+		c.address = nats.ClientURL()
+	} else {
+		c.address = fmt.Sprintf("%stest-%d", service.InProcScheme, atomic.AddInt32(&clusters, 1))
+
+		// cleanups run in reverse order, i.e. after services stopped
+		t.Cleanup(func() { service.ReleaseInProc(c.address) })
+	}
+
+	c.Registry = service.NewRegistryManager(c.address,
+		service.WithDomain(conf.domain), service.WithTimeoutCheckDuration(conf.interval))
+	if c.Registry == nil {
+		t.Fatalf("create registry at %s failed", c.address)
+	}
+
+	c.observer = c.NewService(&service.Descriptor{Name: "servicetest"})
+	if err := c.observer.Listen(service.EndpointServiceNotice, c.record); err != nil {
+		t.Fatalf("listen to notices failed: %v", err)
+	}
+
+	c.Start(c.Registry)
+
+	return c
+}
+
+// Address returns the registry address of the cluster.
+func (c *Cluster) Address() string {
+	return c.address
+}
+
+// NewService creates a service attached to the registry of the cluster,
+// in its domain, which overrides Registry and Domain of desc.
+func (c *Cluster) NewService(desc *service.Descriptor, opts ...service.Option) *service.MetaService {
+	c.t.Helper()
+
+	d := *desc
+	d.Registry = c.address
+	d.Domain = c.conf.domain
+
+	s := service.NewMetaService(&d, opts...)
+	if s == nil {
+		c.t.Fatalf("create service %s failed", desc.Name)
+	}
+
+	return s
+}
+
+// Start starts the service, which is stopped when the test ends.
+func (c *Cluster) Start(s service.Service) {
+	c.t.Helper()
+
+	if !service.Start(s) {
+		c.t.Fatalf("start service %s failed", s.Name())
+	}
+
+	c.t.Cleanup(func() { service.Stop(s) })
+}
+
+// Instances returns status of instances of the service known by the registry.
+func (c *Cluster) Instances(name string) []*service.Status {
+	return c.observer.Registrar().QueryInstances(name)
+}
+
+// WaitState waits until an instance of the service, or the given
+// instance if not empty, is in the state according to the registry,
+// and returns its status. The test fails if timed out.
+func (c *Cluster) WaitState(name, instance string, state service.State) *service.Status {
+	c.t.Helper()
+
+	return c.wait(name, instance, state.String(), func(st *service.Status) bool {
+		return st.State == state
+	})
+}
+
+// WaitHealthy is like WaitState, and waits until the instance is
+// servicing and ready, i.e. eligible for balanced calls.
+func (c *Cluster) WaitHealthy(name, instance string) *service.Status {
+	c.t.Helper()
+
+	return c.wait(name, instance, "healthy", (*service.Status).Healthy)
+}
+
+func (c *Cluster) wait(name, instance, desc string, match func(*service.Status) bool) *service.Status {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.conf.timeout)
+	for {
+		for _, st := range c.Instances(name) {
+			if (len(instance) == 0 || st.Instance == instance) && match(st) {
+				return st
+			}
+		}
+
+		if time.Now().After(deadline) {
+			c.t.Fatalf("wait for service %s(%s) to be %s timed out", name, instance, desc)
+			return nil
+		}
+
+		time.Sleep(c.conf.interval / 4)
+	}
+}
+
+// Report injects a status report to the registry, as if reported
+// by the instance identified by the status, in the cluster domain.
+func (c *Cluster) Report(status *service.Status) {
+	c.t.Helper()
+
+	status.Domain = c.conf.domain
+	if status.Time == 0 {
+		status.Time = uint64(time.Now().UnixMilli())
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		c.t.Fatalf("marshal status failed: %v", err)
+	}
+
+	if err = c.observer.Notify(service.EndpointServiceStatus, data); err != nil {
+		c.t.Fatalf("report status of %s failed: %v", status.Name, err)
+	}
+}
+
+// record saves a notice published by the registry.
+func (c *Cluster) record(data []byte) {
+	status := &service.Status{}
+	if err := json.Unmarshal(data, status); err != nil {
+		c.t.Errorf("malformed notice: %v", err)
+		return
+	}
+
+	c.mutex.Lock()
+	c.notices = append(c.notices, status)
+	close(c.arrived)
+	c.arrived = make(chan struct{})
+	c.mutex.Unlock()
+}
+
+// Notices returns notices of state changes published by the registry, in order.
+func (c *Cluster) Notices() []*service.Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*service.Status(nil), c.notices...)
+}
+
+// WaitNotice waits for a notice matched, including those already
+// received, and returns the first one. The test fails if timed out.
+func (c *Cluster) WaitNotice(match func(status *service.Status) bool) *service.Status {
+	c.t.Helper()
+
+	timer := time.NewTimer(c.conf.timeout)
+	defer timer.Stop()
+
+	for {
+		c.mutex.Lock()
+		arrived := c.arrived
+		for _, st := range c.notices {
+			if match(st) {
+				c.mutex.Unlock()
+				return st
+			}
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-arrived:
+		case <-timer.C:
+			c.t.Fatalf("wait for notice timed out")
+			return nil
+		}
+	}
+}
+
+// StateNotice returns a matcher of notices on the service changing to the state.
+func StateNotice(name string, state service.State) func(*service.Status) bool {
+	return func(status *service.Status) bool {
+		return status.Name == name && status.State == state
+	}
+}
@@ -0,0 +1,51 @@
+package servicetest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/service"
+	"testing"
+	"time"
+)
+
+type echoReq struct {
+	Text string `json:"text"`
+}
+
+var echo = service.NewMethod[echoReq, echoReq]("/echo/rpc", "echo")
+
+func testCluster(t *testing.T, c *Cluster) {
+	s := c.NewService(&service.Descriptor{Name: "echo"},
+		service.WithStatusConfig(&service.StatusConf{Interval: 1, Threshold: 3}))
+	echo.Expose(s, func(req *echoReq) (*echoReq, error) {
+		return req, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+	s.SetReady(true)
+	c.Start(s)
+
+	st := c.WaitHealthy("echo", "")
+	assert.Equal(t, s.Instance(), st.Instance)
+	c.WaitState("echo", s.Instance(), service.Servicing)
+
+	// services of the cluster reach each other
+	client := c.NewService(&service.Descriptor{Name: "client"})
+	rsp, err := echo.Invoke(client, &echoReq{Text: "hi"}, time.Second, service.ToAnyInstance("echo", service.RoundRobin))
+	require.Nil(t, err)
+	assert.Equal(t, "hi", rsp.Text)
+
+	// an injected instance goes offline once it stops reporting
+	c.Report(&service.Status{Name: "ghost", Instance: "g1", State: service.Servicing, CheckInterval: 1, AllowFailures: 1})
+	c.WaitState("ghost", "g1", service.Servicing)
+	notice := c.WaitNotice(StateNotice("ghost", service.Offline))
+	assert.Equal(t, "g1", notice.Instance)
+	assert.NotEmpty(t, c.Notices())
+}
+
+func TestInProcCluster(t *testing.T) {
+	testCluster(t, NewCluster(t, WithDomain(3)))
+}
+
+func TestNatsCluster(t *testing.T) {
+	testCluster(t, NewCluster(t, WithNats()))
+}
@@ -0,0 +1,532 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SocketSendQueue    = 64               //default number of messages queued per connection
+	SocketReadLimit    = 64 << 10         //bytes, default max size of messages from clients
+	SocketWriteTimeout = 10 * time.Second //to write a message to a client
+	SocketPingInterval = 30 * time.Second //clients not answering pings in two intervals are closed
+)
+
+// Operations of messages exchanged with socket clients, see SocketMessage.
+const (
+	SocketOpSubscribe   = "subscribe"   //client -> server, subscribe to topics matching Topic
+	SocketOpUnsubscribe = "unsubscribe" //client -> server, cancel a subscription of Topic
+	SocketOpPublish     = "publish"     //client -> server, publish Data on Topic
+	SocketOpMessage     = "message"     //server -> client, Data published on Topic
+	SocketOpAck         = "ack"         //server -> client, request of ID succeeded
+	SocketOpError       = "error"       //server -> client, request of ID failed
+)
+
+// SlowClientPolicy defines what the socket gateway does to
+// clients not reading fast enough, whose send queue is full.
+type SlowClientPolicy int
+
+const (
+	DropMessages     SlowClientPolicy = iota // drop messages not fitting in the queue
+	DisconnectClient                         // close the connection
+)
+
+// SocketMessage is exchanged, as JSON text frames, between
+// the socket gateway and its clients, e.g.:
+//
+//	{"op":"subscribe","id":"1","topic":"/app/*/alarm","match":{"level":"major"}}
+//	{"op":"message","topic":"/app/door/alarm","data":{"level":"major"}}
+//	{"op":"publish","id":"2","topic":"/app/door/command","data":{"open":true}}
+//
+// Topics of subscriptions are glob patterns, in the syntax of path.Match.
+// Match, if provided, selects messages whose data is a JSON object having
+// all the fields of Match, compared by value.
+type SocketMessage struct {
+	Op    string          `json:"op"`
+	ID    string          `json:"id,omitempty"`
+	Topic string          `json:"topic,omitempty"`
+	Match map[string]any  `json:"match,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// SocketOption customizes a SocketGateway.
+type SocketOption func(*SocketGateway)
+
+// WithSubscribable sets topics of the bus clients may subscribe to,
+// using patterns matching some of them.
+//
+// Topics must be exact names, since handlers of the bus are not told
+// the topic of messages, and entries having glob meta characters are
+// ignored, i.e. clients may use patterns, while the gateway may not.
+func WithSubscribable(topics ...string) SocketOption {
+	return func(g *SocketGateway) {
+		for _, topic := range topics {
+			if strings.ContainsAny(topic, `*?[\`) {
+				log.Warnf("socket gateway ignores subscribable pattern %s", topic)
+				continue
+			}
+
+			g.subscribable = append(g.subscribable, topic)
+		}
+	}
+}
+
+// WithPublishable sets patterns of topics clients may publish to.
+func WithPublishable(patterns ...string) SocketOption {
+	return func(g *SocketGateway) {
+		g.publishable = append(g.publishable, patterns...)
+	}
+}
+
+// WithSendQueue overrides SocketSendQueue, and sets what to
+// do to slow clients whose queue is full, DropMessages by default.
+func WithSendQueue(size int, policy SlowClientPolicy) SocketOption {
+	return func(g *SocketGateway) {
+		g.queue = size
+		g.policy = policy
+	}
+}
+
+// WithReadLimit overrides SocketReadLimit.
+func WithReadLimit(n int64) SocketOption {
+	return func(g *SocketGateway) {
+		g.readLimit = n
+	}
+}
+
+// WithSocketAuth sets a hook authorizing upgrade requests,
+// which are rejected with 401 if ErrUnauthorized is returned,
+// or with 403 if any other error is returned.
+func WithSocketAuth(fn func(r *http.Request) error) SocketOption {
+	return func(g *SocketGateway) {
+		g.auth = fn
+	}
+}
+
+// WithCheckOrigin overrides the check of the Origin header of upgrade
+// requests, which by default rejects requests from other hosts.
+func WithCheckOrigin(fn func(r *http.Request) bool) SocketOption {
+	return func(g *SocketGateway) {
+		g.upgrader.CheckOrigin = fn
+	}
+}
+
+// SocketGateway pushes messages of bus topics to WebSocket clients,
+// and publishes messages of clients to the bus, on behalf of the
+// service it's bound to, in the domain of the service.
+//
+// Topics are listened on the bus once any client subscribes to them.
+// The bus cannot remove a single handler, so handlers of a stopped
+// gateway are detached, dropping messages, and removed along with
+// all others when the service stops.
+//
+// SocketGateway is an http.Handler, and can be mounted on any server,
+// or listen on its own by Start.
+type SocketGateway struct {
+	service      *MetaService
+	subscribable []string
+	publishable  []string
+	queue        int
+	policy       SlowClientPolicy
+	readLimit    int64
+	auth         func(r *http.Request) error
+	upgrader     websocket.Upgrader
+
+	mutex     sync.RWMutex
+	conns     map[*socketConn]bool
+	listening map[string]bool //topics listened on the bus
+	stopped   bool
+
+	server *AdminServer
+}
+
+// NewSocketGateway creates a socket gateway bound to the service.
+func NewSocketGateway(s *MetaService, opts ...SocketOption) *SocketGateway {
+	g := &SocketGateway{
+		service:   s,
+		queue:     SocketSendQueue,
+		readLimit: SocketReadLimit,
+		conns:     make(map[*socketConn]bool),
+		listening: make(map[string]bool),
+	}
+
+	for _, fn := range opts {
+		fn(g)
+	}
+
+	return g
+}
+
+// Start listens on addr, in format host:port, and serves
+// requests in another goroutine.
+func (g *SocketGateway) Start(addr string) error {
+	server := NewAdminServer(addr)
+	server.Handle("/", g)
+	if err := server.Start(); err != nil {
+		return err
+	}
+
+	g.server = server
+
+	return nil
+}
+
+// Stop closes all connections, and shuts down the server started by Start.
+func (g *SocketGateway) Stop() {
+	g.mutex.Lock()
+	g.stopped = true
+	conns := g.conns
+	g.conns = make(map[*socketConn]bool)
+	g.listening = make(map[string]bool)
+	g.mutex.Unlock()
+
+	for c := range conns {
+		c.close()
+	}
+
+	if g.server != nil {
+		g.server.Stop()
+		g.server = nil
+	}
+}
+
+// Addr returns the address listened on, or an empty string if not started.
+func (g *SocketGateway) Addr() string {
+	if g.server == nil {
+		return ""
+	}
+
+	return g.server.Addr()
+}
+
+// Clients returns the number of clients connected.
+func (g *SocketGateway) Clients() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return len(g.conns)
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection.
+func (g *SocketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.auth != nil {
+		if err := g.auth(r); err != nil {
+			code := http.StatusForbidden
+			if errors.Is(err, ErrUnauthorized) {
+				code = http.StatusUnauthorized
+			}
+
+			http.Error(w, err.Error(), code)
+			return
+		}
+	}
+
+	ws, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has replied with the error
+		log.Debugln("socket gateway upgrade failed:", err)
+		return
+	}
+
+	c := &socketConn{
+		gateway: g,
+		ws:      ws,
+		send:    make(chan []byte, g.queue),
+		done:    make(chan struct{}),
+		subs:    make(map[string]map[string]any),
+	}
+
+	g.mutex.Lock()
+	if g.stopped {
+		g.mutex.Unlock()
+		_ = ws.Close()
+		return
+	}
+	g.conns[c] = true
+	g.mutex.Unlock()
+
+	log.Debugf("socket client %s connected", ws.RemoteAddr())
+
+	go c.writeLoop()
+	go c.readLoop()
+}
+
+func (g *SocketGateway) remove(c *socketConn) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.conns, c)
+}
+
+// subscribe makes sure topics allowed and matching the
+// pattern are listened, and returns false if there's none.
+func (g *SocketGateway) subscribe(pattern string) (bool, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.stopped {
+		return false, errors.New("socket gateway stopped")
+	}
+
+	found := false
+	for _, topic := range g.subscribable {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+
+		found = true
+		if g.listening[topic] {
+			continue
+		}
+
+		topic := topic
+		if err := g.service.Listen(topic, func(data []byte) { g.broadcast(topic, data) }); err != nil {
+			return found, err
+		}
+
+		g.listening[topic] = true
+	}
+
+	return found, nil
+}
+
+// broadcast pushes data of the topic to clients subscribing to it.
+func (g *SocketGateway) broadcast(topic string, data []byte) {
+	g.mutex.RLock()
+	detached := !g.listening[topic]
+	g.mutex.RUnlock()
+
+	if detached {
+		return
+	}
+
+	msg := &SocketMessage{Op: SocketOpMessage, Topic: topic, Data: data}
+	if !json.Valid(data) {
+		msg.Data, _ = json.Marshal(string(data))
+	}
+
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	g.mutex.RLock()
+	conns := make([]*socketConn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.mutex.RUnlock()
+
+	var fields map[string]any
+	for _, c := range conns {
+		if filter, ok := c.subscribed(topic); ok {
+			if len(filter) != 0 {
+				if fields == nil {
+					fields = make(map[string]any)
+					_ = json.Unmarshal(data, &fields)
+				}
+
+				if !matchFields(filter, fields) {
+					continue
+				}
+			}
+
+			c.push(frame)
+		}
+	}
+}
+
+func (g *SocketGateway) canPublish(topic string) bool {
+	for _, pattern := range g.publishable {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchTopic returns true if the topic matches the glob pattern.
+func matchTopic(pattern, topic string) bool {
+	ok, _ := path.Match(pattern, topic)
+	return ok
+}
+
+// matchFields returns true if fields have all fields of the filter.
+func matchFields(filter, fields map[string]any) bool {
+	for k, v := range filter {
+		if f, ok := fields[k]; !ok || !reflect.DeepEqual(f, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// socketConn is a client connected to the socket gateway.
+type socketConn struct {
+	gateway *SocketGateway
+	ws      *websocket.Conn
+	send    chan []byte //frames queued to write
+	done    chan struct{}
+	once    sync.Once
+
+	mutex   sync.Mutex
+	subs    map[string]map[string]any //pattern -> filter
+	dropped int
+}
+
+func (c *socketConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.ws.Close()
+		c.gateway.remove(c)
+		log.Debugf("socket client %s disconnected", c.ws.RemoteAddr())
+	})
+}
+
+// subscribed returns the filter of the first subscription matching the topic.
+func (c *socketConn) subscribed(topic string) (map[string]any, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for pattern, filter := range c.subs {
+		if matchTopic(pattern, topic) {
+			return filter, true
+		}
+	}
+
+	return nil, false
+}
+
+// push queues the frame, and drops it, or closes the
+// connection, if the queue is full, as the policy says.
+func (c *socketConn) push(frame []byte) {
+	select {
+	case c.send <- frame:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+
+	if c.gateway.policy == DisconnectClient {
+		log.Warnf("socket client %s too slow, disconnected", c.ws.RemoteAddr())
+		c.close()
+		return
+	}
+
+	c.mutex.Lock()
+	c.dropped++
+	if c.dropped == 1 {
+		log.Warnf("socket client %s too slow, dropping messages", c.ws.RemoteAddr())
+	}
+	c.mutex.Unlock()
+}
+
+func (c *socketConn) reply(req *SocketMessage, err error) {
+	rsp := &SocketMessage{Op: SocketOpAck, ID: req.ID}
+	if err != nil {
+		rsp.Op = SocketOpError
+		rsp.Error = err.Error()
+	}
+
+	frame, _ := json.Marshal(rsp)
+	c.push(frame)
+}
+
+func (c *socketConn) readLoop() {
+	defer c.close()
+
+	c.ws.SetReadLimit(c.gateway.readLimit)
+	_ = c.ws.SetReadDeadline(time.Now().Add(2 * SocketPingInterval))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(2 * SocketPingInterval))
+	})
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		req := &SocketMessage{}
+		if err = json.Unmarshal(data, req); err != nil {
+			c.reply(req, errors.New("malformed message"))
+			continue
+		}
+
+		c.reply(req, c.handle(req))
+	}
+}
+
+func (c *socketConn) handle(req *SocketMessage) error {
+	switch req.Op {
+	case SocketOpSubscribe:
+		if _, err := path.Match(req.Topic, ""); err != nil {
+			return err
+		}
+
+		found, err := c.gateway.subscribe(req.Topic)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return errors.New("topic not allowed")
+		}
+
+		c.mutex.Lock()
+		c.subs[req.Topic] = req.Match
+		c.mutex.Unlock()
+
+	case SocketOpUnsubscribe:
+		c.mutex.Lock()
+		delete(c.subs, req.Topic)
+		c.mutex.Unlock()
+
+	case SocketOpPublish:
+		if !c.gateway.canPublish(req.Topic) {
+			return errors.New("topic not allowed")
+		}
+
+		return c.gateway.service.Notify(req.Topic, req.Data)
+
+	default:
+		return errors.New("unknown op " + req.Op)
+	}
+
+	return nil
+}
+
+func (c *socketConn) writeLoop() {
+	ticker := time.NewTicker(SocketPingInterval)
+	defer ticker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case frame := <-c.send:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(SocketWriteTimeout))
+			if err := c.ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(SocketWriteTimeout))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketGateway(t *testing.T) {
+	s := newInProcService(t, "socket")
+
+	published := make(chan string, 1)
+	require.Nil(t, s.Listen("/ws/cmd", func(data []byte) { published <- string(data) }))
+
+	g := NewSocketGateway(s,
+		WithSubscribable("/ws/alarm", "/ws/status", "/internal", "/ws/*/raw"),
+		WithPublishable("/ws/*"),
+		WithSocketAuth(func(r *http.Request) error {
+			if r.URL.Query().Get("token") != "t" {
+				return ErrUnauthorized
+			}
+			return nil
+		}))
+	server := httptest.NewServer(g)
+	defer server.Close()
+	defer g.Stop()
+	assert.Equal(t, []string{"/ws/alarm", "/ws/status", "/internal"}, g.subscribable)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	_, rsp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?token=t", nil)
+	require.Nil(t, err)
+	defer ws.Close()
+
+	request := func(req *SocketMessage) *SocketMessage {
+		require.Nil(t, ws.WriteJSON(req))
+		rsp := &SocketMessage{}
+		_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+		require.Nil(t, ws.ReadJSON(rsp))
+		return rsp
+	}
+
+	rsp1 := request(&SocketMessage{Op: SocketOpSubscribe, ID: "1", Topic: "/ws/*", Match: map[string]any{"level": "major"}})
+	assert.Equal(t, SocketOpAck, rsp1.Op)
+	assert.Equal(t, "1", rsp1.ID)
+
+	rsp1 = request(&SocketMessage{Op: SocketOpSubscribe, ID: "2", Topic: "/nowhere"})
+	assert.Equal(t, SocketOpError, rsp1.Op)
+	rsp1 = request(&SocketMessage{Op: SocketOpPublish, ID: "3", Topic: "/internal", Data: []byte(`{}`)})
+	assert.Equal(t, SocketOpError, rsp1.Op)
+
+	// only messages matching the filter are pushed
+	require.Nil(t, s.Notify("/ws/alarm", []byte(`{"level":"minor"}`)))
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, s.Notify("/ws/alarm", []byte(`{"level":"major"}`)))
+
+	msg := &SocketMessage{}
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	require.Nil(t, ws.ReadJSON(msg))
+	assert.Equal(t, SocketOpMessage, msg.Op)
+	assert.Equal(t, "/ws/alarm", msg.Topic)
+	assert.JSONEq(t, `{"level":"major"}`, string(msg.Data))
+
+	rsp1 = request(&SocketMessage{Op: SocketOpPublish, ID: "4", Topic: "/ws/cmd", Data: []byte(`{"open":true}`)})
+	assert.Equal(t, SocketOpAck, rsp1.Op)
+	select {
+	case data := <-published:
+		assert.Equal(t, `{"open":true}`, data)
+	case <-time.After(time.Second):
+		t.Fatal("publish not received")
+	}
+
+	rsp1 = request(&SocketMessage{Op: SocketOpUnsubscribe, ID: "5", Topic: "/ws/*"})
+	assert.Equal(t, SocketOpAck, rsp1.Op)
+	assert.Equal(t, 1, g.Clients())
+
+	g.Stop()
+	_, _, err = ws.ReadMessage()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, g.Clients())
+
+	// handlers listening on the bus are detached
+	assert.Empty(t, g.listening)
+	_, err = g.subscribe("/ws/*")
+	assert.NotNil(t, err)
+}
+
+func TestSocketSlowClient(t *testing.T) {
+	g := NewSocketGateway(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := g.upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+
+		// a connection whose queue is never drained
+		c := &socketConn{gateway: g, ws: ws, send: make(chan []byte, 1), done: make(chan struct{})}
+		g.policy = DropMessages
+		c.push([]byte("1"))
+		c.push([]byte("2"))
+		assert.Equal(t, 1, c.dropped)
+
+		g.policy = DisconnectClient
+		c.push([]byte("3"))
+		select {
+		case <-c.done:
+		default:
+			t.Error("slow client not disconnected")
+		}
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.Nil(t, err)
+	defer ws.Close()
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+	assert.NotNil(t, err)
+}
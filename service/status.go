@@ -17,11 +17,20 @@ type StatusConf struct {
 
 // Status defines heartbeat info published by a service.
 type Status struct {
-	Name   string `json:"name"`   //name of the service
-	Domain int    `json:"domain"` //domain of the service
-	State  State  `json:"state"`  //liveness state of the service
-	Time   uint64 `json:"time"`   //report timestamp in milliseconds
-	Ready  bool   `json:"ready"`  //readiness state of the service
+	Name     string `json:"name"`               //name of the service
+	Instance string `json:"instance,omitempty"` //instance id of the service
+	Domain   int    `json:"domain"`             //domain of the service
+	State    State  `json:"state"`              //liveness state of the service
+	Time     uint64 `json:"time"`               //report timestamp in milliseconds
+	Ready    bool   `json:"ready"`              //readiness state of the service
+	Restarts uint32 `json:"restarts,omitempty"` //number of restarts by supervisor
+	Version  string `json:"version,omitempty"`  //version of the service
+
+	Leads []string `json:"leads,omitempty"` //names of elections led by the instance
+
+	Tags      []string          `json:"tags,omitempty"`      //tags of the service
+	Labels    map[string]string `json:"labels,omitempty"`    //key-value labels of the service
+	Endpoints []*ChannelInfo    `json:"endpoints,omitempty"` //channels exposed by the service
 
 	Metrics any `json:"metrics,omitempty"` //detail metrics, optional
 
@@ -35,9 +44,83 @@ type Status struct {
 	AllowFailures uint32 `json:"allowFailures,omitempty"`
 }
 
+// InstanceId returns the instance id carried by the status, or the
+// service name if reported by an instance-unaware service client.
+func (s *Status) InstanceId() string {
+	if len(s.Instance) == 0 {
+		return s.Name
+	}
+
+	return s.Instance
+}
+
+// Healthy returns true if the instance is servicing and ready.
+func (s *Status) Healthy() bool {
+	return s.State == Servicing && s.Ready
+}
+
+// HasTags returns true if the status carries all the given tags.
+func (s *Status) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range s.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchLabels returns true if the status carries all the given labels.
+func (s *Status) MatchLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if l, ok := s.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Exposes returns true if the service exposes a channel,
+// or a JSON-RPC method on any channel, of the given name.
+func (s *Status) Exposes(method string) bool {
+	for _, e := range s.Endpoints {
+		if e.Channel == method {
+			return true
+		}
+
+		for _, m := range e.Methods {
+			if m == method {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ChannelInfo describes a channel exposed by a service, with
+// methods routed on it if it's a JSON-RPC channel.
+type ChannelInfo struct {
+	Channel string   `json:"channel"`
+	Methods []string `json:"methods,omitempty"`
+}
+
 // StatusList defines all services status info.
 type StatusList struct {
 	Services []*Status `json:"services"`
+
+	// Next is the cursor of the next page, if any, when
+	// queried with a limit, see QueryStatusListReq.Cursor.
+	Next string `json:"next,omitempty"`
 }
 
 func getDefaultStatusConf() *StatusConf {
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/box"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EndpointServiceRestart = "/registry-center/service/restart"
+
+	RestartBackoff     = 1  //seconds, delay before the first restart
+	RestartMaxBackoff  = 60 //seconds, max delay between restarts
+	RestartMaxRetries  = 5  //max number of restarts within the window
+	RestartRetryWindow = 60 //seconds, window counting restarts
+)
+
+// superviseInterval is the interval to check whether a supervised
+// service exited by itself.
+var superviseInterval = 200 * time.Millisecond
+
+const (
+	restartReasonFailure = "failure"
+	restartReasonExit    = "exit"
+)
+
+// RestartMode defines when a supervised service is restarted.
+type RestartMode int
+
+const (
+	// RestartOnFailure restarts the service only if it failed to start,
+	// reported a failure or panicked inside a handler.
+	RestartOnFailure RestartMode = iota
+	// RestartAlways restarts the service also when it stopped by itself.
+	RestartAlways
+)
+
+var restartModeNames = map[RestartMode]string{
+	RestartOnFailure: "on-failure",
+	RestartAlways:    "always",
+}
+
+func (m RestartMode) String() string {
+	return restartModeNames[m]
+}
+
+// RestartPolicy defines how a supervised service is restarted.
+// Zero values are replaced by defaults.
+type RestartPolicy struct {
+	Mode RestartMode
+
+	// MaxRestarts within Window before giving up.
+	MaxRestarts int
+	Window      time.Duration
+
+	// Backoff before the first restart, doubled for each
+	// subsequent restart within the window, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p *RestartPolicy) normalize() *RestartPolicy {
+	n := &RestartPolicy{}
+	if p != nil {
+		*n = *p
+	}
+
+	if n.MaxRestarts <= 0 {
+		n.MaxRestarts = RestartMaxRetries
+	}
+
+	if n.Window <= 0 {
+		n.Window = RestartRetryWindow * time.Second
+	}
+
+	if n.Backoff <= 0 {
+		n.Backoff = RestartBackoff * time.Second
+	}
+
+	if n.MaxBackoff <= 0 {
+		n.MaxBackoff = RestartMaxBackoff * time.Second
+	}
+
+	if n.MaxBackoff < n.Backoff {
+		n.MaxBackoff = n.Backoff
+	}
+
+	return n
+}
+
+// RestartEvent is published to EndpointServiceRestart each time
+// a supervised service is restarted, or given up.
+type RestartEvent struct {
+	Name     string `json:"name"`
+	Instance string `json:"instance"`
+	Restarts uint32 `json:"restarts"`         //total restarts of the service
+	Reason   string `json:"reason"`           //why the service is restarted
+	Started  bool   `json:"started"`          //whether the restart succeeded
+	GaveUp   bool   `json:"gaveUp,omitempty"` //true if restart limit is reached
+	Time     uint64 `json:"time"`             //timestamp in milliseconds
+}
+
+// supervisable is satisfied by any service embedding MetaService,
+// allowing the supervisor to be notified of failures.
+type supervisable interface {
+	setFailureHook(fn func(err error))
+	setRestarts(n uint32)
+}
+
+// child is a service under supervision.
+type child struct {
+	service Service
+	policy  *RestartPolicy
+
+	failures chan error
+	quit     chan struct{}
+	done     chan struct{}
+
+	restarts uint32
+	history  []time.Time //restart times within the window
+}
+
+func newChild(s Service, policy *RestartPolicy) *child {
+	return &child{
+		service:  s,
+		policy:   policy.normalize(),
+		failures: make(chan error, 1),
+	}
+}
+
+// fail records a failure, and is non-blocking since
+// one pending failure is enough to trigger a restart.
+func (c *child) fail(err error) {
+	select {
+	case c.failures <- err:
+	default:
+	}
+}
+
+func (c *child) drain() {
+	for {
+		select {
+		case <-c.failures:
+		default:
+			return
+		}
+	}
+}
+
+// watch blocks until the service fails, exits by itself or the
+// supervisor stops. Returns false for the latter.
+func (c *child) watch() (bool, error) {
+	ticker := time.NewTicker(superviseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return false, nil
+		case err := <-c.failures:
+			return true, err
+		case <-ticker.C:
+			if c.service.State() == Stopped {
+				return true, nil
+			}
+		}
+	}
+}
+
+// backoff returns delay of the next restart, and false
+// if the restart limit within the window is reached.
+func (c *child) backoff() (time.Duration, bool) {
+	now := time.Now()
+
+	var recent []time.Time
+	for _, t := range c.history {
+		if now.Sub(t) < c.policy.Window {
+			recent = append(recent, t)
+		}
+	}
+
+	c.history = recent
+	if len(c.history) >= c.policy.MaxRestarts {
+		return 0, false
+	}
+
+	delay := c.policy.Backoff
+	for i := 0; i < len(c.history) && delay < c.policy.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > c.policy.MaxBackoff {
+		delay = c.policy.MaxBackoff
+	}
+
+	c.history = append(c.history, now)
+
+	return delay, true
+}
+
+func (c *child) publish(reason string, started, gaveUp bool) {
+	buf, _ := json.Marshal(&RestartEvent{
+		Name:     c.service.Name(),
+		Instance: c.service.Instance(),
+		Restarts: atomic.LoadUint32(&c.restarts),
+		Reason:   reason,
+		Started:  started,
+		GaveUp:   gaveUp,
+		Time:     box.TimeNowMs(),
+	})
+
+	if err := c.service.Notify(EndpointServiceRestart, buf); err != nil {
+		log.Warnf("publish restart event of %s failed: %v", c.service.Name(), err)
+	}
+}
+
+// run supervises the service until the supervisor stops or gives up.
+func (c *child) run(started bool) {
+	defer close(c.done)
+
+	name := c.service.Name()
+	for {
+		var err error
+		if started {
+			var ok bool
+			if ok, err = c.watch(); !ok {
+				if c.service.State() != Stopped {
+					_ = StopWithTimeout(c.service, StopTimeout*time.Second)
+				}
+				return
+			}
+
+			if err == nil && c.policy.Mode == RestartOnFailure {
+				log.Infof("supervised service %s exited", name)
+				return
+			}
+		} else {
+			err = fmt.Errorf("start service %s failed", name)
+		}
+
+		reason := restartReasonExit
+		if err != nil {
+			reason = restartReasonFailure
+		}
+
+		if c.service.State() != Stopped {
+			_ = StopWithTimeout(c.service, StopTimeout*time.Second)
+		}
+
+		delay, ok := c.backoff()
+		if !ok {
+			log.Errorf("service %s restarted %d times within %v, give up",
+				name, c.policy.MaxRestarts, c.policy.Window)
+			c.publish(reason, false, true)
+			return
+		}
+
+		log.Warnf("restart service %s in %v, reason: %v", name, delay, err)
+
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		restarts := atomic.AddUint32(&c.restarts, 1)
+		if sv, ok := c.service.(supervisable); ok {
+			sv.setRestarts(restarts)
+		}
+		restartsTotal.Inc(name, reason)
+
+		c.drain()
+		started = Start(c.service)
+		c.publish(reason, started, false)
+	}
+}
+
+// Supervisor owns several services in one process, starting
+// them in order, and restarting failed ones according to
+// their RestartPolicy.
+//
+// Since a service may be restarted, its Startup and Shutdown
+// must be re-entrant, i.e. Shutdown should release everything
+// Startup acquired.
+type Supervisor struct {
+	sync.Mutex
+	children []*child
+	running  bool
+}
+
+// NewSupervisor creates a supervisor with no service.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Supervise adds a service under supervision.
+// Default policy is used if policy is nil.
+func (sv *Supervisor) Supervise(s Service, policy *RestartPolicy) error {
+	sv.Lock()
+	defer sv.Unlock()
+
+	if sv.running {
+		return errors.New("supervisor already started")
+	}
+
+	for _, c := range sv.children {
+		if c.service == s {
+			return fmt.Errorf("service %s already supervised", s.Name())
+		}
+	}
+
+	sv.children = append(sv.children, newChild(s, policy))
+
+	return nil
+}
+
+// Start starts all supervised services in order. A service
+// failed to start is restarted in background as the policy says.
+func (sv *Supervisor) Start() error {
+	sv.Lock()
+	defer sv.Unlock()
+
+	if sv.running {
+		return errors.New("supervisor already started")
+	}
+
+	sv.running = true
+	for _, c := range sv.children {
+		c.quit = make(chan struct{})
+		c.done = make(chan struct{})
+		c.drain()
+		if s, ok := c.service.(supervisable); ok {
+			s.setFailureHook(c.fail)
+		}
+
+		go c.run(Start(c.service))
+	}
+
+	return nil
+}
+
+// Stop stops all supervised services in reverse order.
+func (sv *Supervisor) Stop() {
+	sv.Lock()
+	defer sv.Unlock()
+
+	if !sv.running {
+		return
+	}
+
+	sv.running = false
+	for i := len(sv.children) - 1; i >= 0; i-- {
+		c := sv.children[i]
+		close(c.quit)
+		<-c.done
+
+		if s, ok := c.service.(supervisable); ok {
+			s.setFailureHook(nil)
+		}
+	}
+}
+
+// Restarts returns the number of restarts of the given service.
+func (sv *Supervisor) Restarts(s Service) uint32 {
+	sv.Lock()
+	defer sv.Unlock()
+
+	for _, c := range sv.children {
+		if c.service == s {
+			return atomic.LoadUint32(&c.restarts)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type flakyService struct {
+	*MetaService
+	failures int32 //number of startups to fail
+	startups int32
+}
+
+func (s *flakyService) Startup() bool {
+	return atomic.AddInt32(&s.startups, 1) > atomic.LoadInt32(&s.failures)
+}
+
+func newFlakyService(t *testing.T, name string, failures int32) *flakyService {
+	s := &flakyService{MetaService: newInProcService(t, name), failures: failures}
+	require.Nil(t, s.Listen("/flaky/panic", func(data []byte) {
+		panic("boom")
+	}))
+
+	return s
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	policy := &RestartPolicy{
+		MaxRestarts: 3,
+		Window:      time.Minute,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  20 * time.Millisecond,
+	}
+
+	flaky := newFlakyService(t, "supervised-flaky", 2)
+	broken := newFlakyService(t, "supervised-broken", 100)
+
+	events := make(chan *RestartEvent, 10)
+	require.Nil(t, broken.Listen(EndpointServiceRestart, func(data []byte) {
+		e := &RestartEvent{}
+		require.Nil(t, json.Unmarshal(data, e))
+		events <- e
+	}))
+
+	sv := NewSupervisor()
+	require.Nil(t, sv.Supervise(flaky, policy))
+	require.Nil(t, sv.Supervise(broken, policy))
+	assert.NotNil(t, sv.Supervise(flaky, nil))
+	require.Nil(t, sv.Start())
+	defer sv.Stop()
+
+	// restarted until startup succeeds
+	assert.Eventually(t, func() bool { return flaky.State() == Servicing }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(2), sv.Restarts(flaky))
+	assert.Equal(t, uint32(2), flaky.Status().Restarts)
+
+	// a panic inside a handler fails the service
+	require.Nil(t, flaky.Notify("/flaky/panic", nil))
+	assert.Eventually(t, func() bool { return sv.Restarts(flaky) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return flaky.State() == Servicing }, time.Second, 10*time.Millisecond)
+
+	// given up after max restarts
+	var last *RestartEvent
+	assert.Eventually(t, func() bool {
+		select {
+		case last = <-events:
+			return last.GaveUp
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(3), last.Restarts)
+	assert.Equal(t, restartReasonFailure, last.Reason)
+	assert.Equal(t, Stopped, broken.State())
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/zourva/pareto/endec/jsonrpc2"
+	"github.com/zourva/pareto/trace"
+)
+
+// EndpointServiceSpans is a PS endpoint where spans are published
+// by exporters created using NewSpanBusExporter, by default.
+const EndpointServiceSpans = "/registry-center/service/spans"
+
+// ContextHandler handles a notice with the context of the
+// trace it belongs to, if any.
+type ContextHandler = func(ctx context.Context, data []byte)
+
+// ContextCalleeHandler handles a request with the context
+// of the trace it belongs to, if any.
+type ContextCalleeHandler = func(ctx context.Context, data []byte) ([]byte, error)
+
+// envelopeMagic prefixes payloads carrying metadata, which is
+// followed by the big-endian length and JSON of the metadata.
+var envelopeMagic = []byte{0x00, 'p', 'm', 0x01}
+
+// sealEnvelope prepends metadata to the payload.
+func sealEnvelope(meta map[string]string, data []byte) []byte {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return data
+	}
+
+	n := len(envelopeMagic)
+	sealed := make([]byte, n+4, n+4+len(buf)+len(data))
+	copy(sealed, envelopeMagic)
+	binary.BigEndian.PutUint32(sealed[n:], uint32(len(buf)))
+	sealed = append(sealed, buf...)
+
+	return append(sealed, data...)
+}
+
+// openEnvelope splits metadata, if any, and the payload.
+// Payloads without an envelope are returned as is.
+func openEnvelope(data []byte) (map[string]string, []byte) {
+	n := len(envelopeMagic)
+	if len(data) < n+4 || !bytes.Equal(data[:n], envelopeMagic) {
+		return nil, data
+	}
+
+	size := int(binary.BigEndian.Uint32(data[n:]))
+	if len(data) < n+4+size {
+		return nil, data
+	}
+
+	var meta map[string]string
+	if err := json.Unmarshal(data[n+4:n+4+size], &meta); err != nil {
+		log.Warnf("malformed envelope metadata: %v", err)
+	}
+
+	return meta, data[n+4+size:]
+}
+
+// WithTracer enables tracing of the service using the given tracer.
+//
+// A trace is started by StartSpan, and spans of Notify, CallMethod and
+// JSON-RPC calls are created as its children when the context carrying
+// it is passed to NotifyContext, CallMethodContext and InvokeContext.
+// The trace context is propagated as a W3C traceparent, and spans are
+// created for handlers receiving it.
+func WithTracer(t *trace.Tracer) Option {
+	return func(s *MetaService) {
+		s.tracer = t
+	}
+}
+
+// Tracer returns the tracer of the service, or nil if tracing is disabled.
+func (s *MetaService) Tracer() *trace.Tracer {
+	return s.tracer
+}
+
+// StartSpan starts a span as a child of the span carried by ctx,
+// or as the root of a new trace. The span returned is nil, which
+// is safe to use, if tracing is disabled.
+func (s *MetaService) StartSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	if s.tracer == nil {
+		return ctx, nil
+	}
+
+	return s.tracer.Start(ctx, name, trace.KindInternal)
+}
+
+// startChild starts a span only if ctx belongs to a trace.
+func (s *MetaService) startChild(ctx context.Context, name string, kind trace.SpanKind) (context.Context, *trace.Span) {
+	if s.tracer == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+
+	return s.tracer.Start(ctx, name, kind)
+}
+
+// startRemote starts a span only if meta carries a valid traceparent.
+func (s *MetaService) startRemote(meta map[string]string, name string, kind trace.SpanKind) (context.Context, *trace.Span) {
+	ctx := context.Background()
+	tp, ok := meta[trace.TraceParentHeader]
+	if s.tracer == nil || !ok {
+		return ctx, nil
+	}
+
+	sc, err := trace.ParseTraceParent(tp)
+	if err != nil {
+		log.Debugf("%s ignore traceparent %q: %v", s.Name(), tp, err)
+		return ctx, nil
+	}
+
+	return s.tracer.Start(trace.ContextWithRemote(ctx, sc), name, kind)
+}
+
+// traceCall is a jsonrpc2.CallHook creating client spans.
+func (s *MetaService) traceCall(ctx context.Context, channel string, req *jsonrpc2.RPCRequest) func(*jsonrpc2.RPCResponse, error) {
+	_, span := s.startChild(ctx, req.Method, trace.KindClient)
+	if span == nil {
+		return nil
+	}
+
+	span.SetAttribute("channel", channel)
+	req.SetMeta(trace.TraceParentHeader, span.Context().TraceParent())
+
+	return func(rsp *jsonrpc2.RPCResponse, err error) {
+		span.SetError(err)
+		span.End()
+	}
+}
+
+// traceServe is a jsonrpc2.ServeHook creating server spans.
+func (s *MetaService) traceServe(req *jsonrpc2.RPCRequest) (context.Context, func(*jsonrpc2.RPCResponse)) {
+	ctx, span := s.startRemote(req.Meta, req.Method, trace.KindServer)
+	if span == nil {
+		return nil, nil
+	}
+
+	return ctx, func(rsp *jsonrpc2.RPCResponse) {
+		if rsp != nil && rsp.Error != nil {
+			span.SetError(rsp.Error)
+		}
+
+		span.End()
+	}
+}
+
+type callOptionsKey struct{}
+
+// withCallOptions returns a copy of ctx carrying CallOptions,
+// which are applied by JsonRpcInvoker.CallContext.
+func withCallOptions(ctx context.Context, opts []CallOption) context.Context {
+	if len(opts) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, callOptionsKey{}, opts)
+}
+
+func callOptionsFrom(ctx context.Context) []CallOption {
+	opts, _ := ctx.Value(callOptionsKey{}).([]CallOption)
+	return opts
+}
+
+// NewSpanBusExporter creates an exporter publishing spans ended in
+// the process on the topic, or EndpointServiceSpans if topic is empty,
+// using the given service, to be collected by other services.
+func NewSpanBusExporter(s Messaging, topic string) *trace.PublishExporter {
+	if len(topic) == 0 {
+		topic = EndpointServiceSpans
+	}
+
+	return trace.NewPublishExporter(topic, s.Notify)
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zourva/pareto/trace"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	meta := map[string]string{trace.TraceParentHeader: "tp"}
+	m, data := openEnvelope(sealEnvelope(meta, []byte("payload")))
+	assert.Equal(t, meta, m)
+	assert.Equal(t, []byte("payload"), data)
+
+	// legacy payloads pass through
+	m, data = openEnvelope([]byte("plain"))
+	assert.Nil(t, m)
+	assert.Equal(t, []byte("plain"), data)
+}
+
+func TestTracingPropagation(t *testing.T) {
+	s := newInProcService(t, "traced")
+	s.tracer = trace.NewTracer(s.Name())
+
+	echo := NewMethod[echoReq, echoRsp]("/traced/rpc", "echo")
+	echo.ExposeContext(s, func(ctx context.Context, req *echoReq) (*echoRsp, error) {
+		rsp := &echoRsp{Text: req.Text}
+		if trace.SpanFromContext(ctx) != nil {
+			rsp.Count = 1
+		}
+
+		return rsp, nil
+	})
+	require.Nil(t, s.RpcServer().Serve())
+
+	require.Nil(t, s.ExposeMethodContext("/traced/raw", func(ctx context.Context, data []byte) ([]byte, error) {
+		assert.NotNil(t, trace.SpanFromContext(ctx))
+		return data, nil
+	}))
+
+	received := make(chan string, 2)
+	require.Nil(t, s.ListenContext("/traced/notice", func(ctx context.Context, data []byte) {
+		defer func() { received <- string(data) }()
+		if trace.SpanFromContext(ctx) == nil {
+			return
+		}
+
+		rsp, err := s.CallMethodContext(ctx, "/traced/raw", []byte("ping"), time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(rsp))
+
+		r, err := echo.InvokeContext(ctx, s, &echoReq{Text: "hi"}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, r.Count)
+	}))
+
+	// untraced messaging creates no spans and leaves payloads untouched
+	require.Nil(t, s.Notify("/traced/notice", []byte("plain")))
+	assert.Equal(t, "plain", <-received)
+	r, err := echo.Invoke(s, &echoReq{Text: "plain"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, 0, r.Count)
+	assert.Empty(t, s.Tracer().Recorder().Spans())
+
+	ctx, root := s.StartSpan(context.Background(), "request")
+	require.Nil(t, s.NotifyContext(ctx, "/traced/notice", []byte("traced")))
+	root.End()
+	assert.Equal(t, "traced", <-received)
+
+	// the consumer span ends after the handler returns
+	var spans []*trace.Span
+	require.Eventually(t, func() bool {
+		spans = s.Tracer().Recorder().Trace(root.TraceID)
+		return len(spans) == 7
+	}, time.Second, 10*time.Millisecond)
+
+	tree := trace.BuildTree(spans)
+	require.Len(t, tree, 1)
+	assert.Equal(t, "request", tree[0].Span.Name)
+
+	producer := tree[0].Children
+	require.Len(t, producer, 1)
+	assert.Equal(t, trace.KindProducer, producer[0].Span.Kind)
+
+	consumer := producer[0].Children
+	require.Len(t, consumer, 1)
+	assert.Equal(t, trace.KindConsumer, consumer[0].Span.Kind)
+
+	calls := consumer[0].Children
+	require.Len(t, calls, 2)
+	assert.Equal(t, "/traced/raw", calls[0].Span.Name)
+	assert.Equal(t, "echo", calls[1].Span.Name)
+	assert.Equal(t, "/traced/rpc", calls[1].Span.Attributes["channel"])
+	for _, call := range calls {
+		assert.Equal(t, trace.KindClient, call.Span.Kind)
+		require.Len(t, call.Children, 1)
+		assert.Equal(t, trace.KindServer, call.Children[0].Span.Kind)
+	}
+}
+
+func TestSpanBusExporter(t *testing.T) {
+	s := newInProcService(t, "spans")
+	s.tracer = trace.NewTracer(s.Name(), trace.WithExporter(NewSpanBusExporter(s, "")))
+
+	spans := make(chan *trace.Span, 1)
+	require.Nil(t, s.Listen(EndpointServiceSpans, func(data []byte) {
+		span := &trace.Span{}
+		assert.Nil(t, json.Unmarshal(data, span))
+		spans <- span
+	}))
+
+	_, span := s.StartSpan(context.Background(), "job")
+	span.SetAttribute("k", "v")
+	span.End()
+
+	select {
+	case got := <-spans:
+		assert.Equal(t, "job", got.Name)
+		assert.Equal(t, "spans", got.Service)
+		assert.Equal(t, span.TraceID, got.TraceID)
+		assert.Equal(t, "v", got.Attributes["k"])
+	case <-time.After(time.Second):
+		t.Fatal("span not published")
+	}
+}
@@ -0,0 +1,379 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version, in format major.minor.patch[-pre][+build],
+// optionally prefixed with "v". Missing minor and patch are taken as 0, and
+// build metadata is ignored.
+type Version struct {
+	Major uint64
+	Minor uint64
+	Patch uint64
+	Pre   string //pre-release, e.g. rc.1
+}
+
+// ParseVersion parses the semantic version, e.g. v1.2.3, 1.2 or 2.0.0-rc.1.
+func ParseVersion(s string) (*Version, error) {
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, fmt.Errorf("malformed version %q", s)
+	}
+
+	return v, nil
+}
+
+// parsePartial parses the version, where trailing components may be
+// missing or wildcards, i.e. x, X or *, and returns the number of
+// components given.
+func parsePartial(s string) (*Version, int, error) {
+	bad := fmt.Errorf("malformed version %q", s)
+	text := strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	text, _, _ = strings.Cut(text, "+")
+	text, pre, hasPre := strings.Cut(text, "-")
+	if len(text) == 0 || (hasPre && len(pre) == 0) {
+		return nil, 0, bad
+	}
+
+	parts := strings.Split(text, ".")
+	if len(parts) > 3 {
+		return nil, 0, bad
+	}
+
+	var nums [3]uint64
+	n := 0
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			continue
+		}
+
+		if n != i {
+			return nil, 0, bad // numbers after wildcards
+		}
+
+		num, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return nil, 0, bad
+		}
+
+		nums[i] = num
+		n++
+	}
+
+	if hasPre && n != 3 {
+		return nil, 0, bad
+	}
+
+	return &Version{Major: nums[0], Minor: nums[1], Patch: nums[2], Pre: pre}, n, nil
+}
+
+// String returns the version in format major.minor.patch[-pre].
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Pre) != 0 {
+		s += "-" + v.Pre
+	}
+
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or
+// higher than o, in the precedence defined by semantic versioning.
+func (v *Version) Compare(o *Version) int {
+	if c := compare(v.Major, o.Major); c != 0 {
+		return c
+	}
+
+	if c := compare(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+
+	if c := compare(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// a pre-release precedes the release
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+
+	a, b := strings.Split(v.Pre, "."), strings.Split(o.Pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := comparePre(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compare(len(a), len(b))
+}
+
+// comparePre compares identifiers of pre-releases, where numeric
+// ones are compared numerically and precede alphanumeric ones.
+func comparePre(a, b string) int {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return compare(x, y)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+
+	return compare(a, b)
+}
+
+// compareVersions compares versions of services, where versions
+// not semantic follow semantic ones, and are compared as strings.
+func compareVersions(a, b string) int {
+	x, errA := ParseVersion(a)
+	y, errB := ParseVersion(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x.Compare(y)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+
+	return compare(a, b)
+}
+
+// comparator is a single condition of a version range.
+type comparator struct {
+	op string
+	v  *Version
+}
+
+func (c *comparator) holds(v *Version) bool {
+	d := v.Compare(c.v)
+	switch c.op {
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "!=":
+		return d != 0
+	}
+
+	return d == 0
+}
+
+// VersionRange is a set of versions, expressed as alternatives separated
+// by "||", each of which is a list of conditions separated by spaces or
+// commas, that versions in the range satisfy all, e.g.
+//
+//	1.2.3          exactly 1.2.3
+//	1.2, 1.2.x     >=1.2.0 <1.3.0
+//	^1.2.3         >=1.2.3 <2.0.0, or <0.3.0 for 0.2.3
+//	~1.2.3         >=1.2.3 <1.3.0
+//	>=1.2 <2       any of the operators <, <=, >, >=, = and !=
+//	^1 || ^2.1     either of the ranges
+//
+// Pre-releases are only in alternatives having a bound which is a
+// pre-release of the same major.minor.patch, e.g. 2.0.0-rc.1 is in
+// >=2.0.0-rc.0 but not in >=1.0.0. An empty range, or "*", contains
+// all versions, including those not semantic.
+type VersionRange struct {
+	expr string
+	sets [][]*comparator //alternatives of conditions
+}
+
+// ParseVersionRange parses the version range, see VersionRange.
+func ParseVersionRange(expr string) (*VersionRange, error) {
+	r := &VersionRange{expr: strings.TrimSpace(expr)}
+	alts := strings.Split(r.expr, "||")
+	for _, alt := range alts {
+		if len(alts) > 1 && len(strings.TrimSpace(alt)) == 0 {
+			return nil, fmt.Errorf("version range %q: empty alternative", expr)
+		}
+
+		set, err := parseConditions(alt)
+		if err != nil {
+			return nil, fmt.Errorf("version range %q: %w", expr, err)
+		}
+
+		r.sets = append(r.sets, set)
+	}
+
+	return r, nil
+}
+
+func parseConditions(alt string) ([]*comparator, error) {
+	terms := strings.Fields(strings.ReplaceAll(alt, ",", " "))
+	if len(terms) == 0 && len(strings.TrimSpace(alt)) != 0 {
+		return nil, errors.New("empty alternative")
+	}
+
+	var set []*comparator
+	for i := 0; i < len(terms); i++ {
+		term := terms[i]
+		if strings.Trim(term, "<>=!^~") == "" && i+1 < len(terms) {
+			// operator separated from the version, e.g. ">= 1.2"
+			i++
+			term += terms[i]
+		}
+
+		conds, err := parseCondition(term)
+		if err != nil {
+			return nil, err
+		}
+
+		set = append(set, conds...)
+	}
+
+	return set, nil
+}
+
+// parseCondition parses the term into conditions, and returns
+// none if the term matches any version.
+func parseCondition(term string) ([]*comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			break
+		}
+	}
+
+	v, n, err := parsePartial(term[len(op):])
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		switch op {
+		case "", "=", ">=", "<=", "^", "~":
+			return nil, nil // any version
+		default:
+			return nil, fmt.Errorf("operator %s of wildcard", op)
+		}
+	}
+
+	lower := &comparator{op: ">=", v: v}
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []*comparator{{op: "=", v: v}}, nil
+		}
+		return []*comparator{lower, {op: "<", v: bump(v, n)}}, nil
+	case "!=":
+		if n != 3 {
+			return nil, errors.New("operator != of partial version " + term)
+		}
+		return []*comparator{{op: op, v: v}}, nil
+	case ">":
+		if n == 3 {
+			return []*comparator{{op: op, v: v}}, nil
+		}
+		return []*comparator{{op: ">=", v: bump(v, n)}}, nil
+	case "<=":
+		if n == 3 {
+			return []*comparator{{op: op, v: v}}, nil
+		}
+		return []*comparator{{op: "<", v: bump(v, n)}}, nil
+	case ">=", "<":
+		return []*comparator{{op: op, v: v}}, nil
+	case "^":
+		switch {
+		case v.Major != 0 || n == 1:
+			n = 1
+		case v.Minor != 0 || n == 2:
+			n = 2
+		}
+		return []*comparator{lower, {op: "<", v: bump(v, n)}}, nil
+	case "~":
+		if n > 2 {
+			n = 2
+		}
+		return []*comparator{lower, {op: "<", v: bump(v, n)}}, nil
+	}
+
+	return nil, errors.New("unknown operator of " + term)
+}
+
+// bump returns the lowest release above all versions
+// having the first n components of v.
+func bump(v *Version, n int) *Version {
+	next := &Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+	switch n {
+	case 1:
+		next.Major, next.Minor, next.Patch = v.Major+1, 0, 0
+	case 2:
+		next.Minor, next.Patch = v.Minor+1, 0
+	default:
+		next.Patch++
+	}
+
+	return next
+}
+
+// Contains returns true if the version is in the range.
+func (r *VersionRange) Contains(v *Version) bool {
+	for _, set := range r.sets {
+		if r.holds(set, v) {
+			return true
+		}
+	}
+
+	return len(r.sets) == 0
+}
+
+func (r *VersionRange) holds(set []*comparator, v *Version) bool {
+	for _, c := range set {
+		if !c.holds(v) {
+			return false
+		}
+	}
+
+	// pre-releases are excluded unless a bound is a pre-release
+	// of the same version, so ^1.0.0 does not pick 1.1.0-rc.1
+	if len(v.Pre) == 0 {
+		return true
+	}
+
+	for _, c := range set {
+		if len(c.v.Pre) != 0 && c.v.Major == v.Major && c.v.Minor == v.Minor && c.v.Patch == v.Patch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns true if the version, in text, is in the range,
+// and false if it is not a semantic version.
+func (r *VersionRange) Match(version string) bool {
+	for _, set := range r.sets {
+		if len(set) == 0 {
+			return true // any, including versions not semantic
+		}
+	}
+
+	v, err := ParseVersion(version)
+	return err == nil && r.Contains(v)
+}
+
+// String returns the expression of the range.
+func (r *VersionRange) String() string {
+	return r.expr
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	v, err := ParseVersion("v1.2")
+	require.Nil(t, err)
+	assert.Equal(t, "1.2.0", v.String())
+
+	v, err = ParseVersion("2.0.0-rc.1+build.7")
+	require.Nil(t, err)
+	assert.Equal(t, &Version{Major: 2, Pre: "rc.1"}, v)
+
+	for _, bad := range []string{"", "dev", "1.2.3.4", "1.x.3", "1.2-rc", "1.2.3-"} {
+		_, err = ParseVersion(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	versions := []string{"dev", "1.10.0", "1.0.0", "1.0.0-rc.10", "1.0.0-rc.2", "1.0.0-beta", "1.9.3", "0.9"}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	assert.Equal(t, []string{"0.9", "1.0.0-beta", "1.0.0-rc.2", "1.0.0-rc.10", "1.0.0", "1.9.3", "1.10.0", "dev"}, versions)
+}
+
+func TestVersionRange(t *testing.T) {
+	cases := []struct {
+		expr string
+		in   []string
+		out  []string
+	}{
+		{"", []string{"1.0.0", "dev"}, nil},
+		{"*", []string{"0.1.0", "dev"}, nil},
+		{"1.2.3", []string{"1.2.3", "v1.2.3"}, []string{"1.2.4", "dev"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.1.9", "1.2.1-rc.1"}},
+		{"1.x", []string{"1.0.0", "1.99.0"}, []string{"2.0.0", "0.9.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0", "2.0.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.8"}, []string{"1.3.0"}},
+		{">= 1.2, <1.5", []string{"1.2.0", "1.4.9"}, []string{"1.5.0", "1.1.0"}},
+		{">1.2 <=2", []string{"1.3.0", "2.9.9"}, []string{"1.2.9", "3.0.0"}},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3", "dev"}},
+		{"^1 || ^3.1", []string{"1.5.0", "3.2.0"}, []string{"2.0.0", "3.0.0"}},
+		{">=2.0.0-rc.1", []string{"2.0.0-rc.2", "2.0.0", "2.1.0"}, []string{"2.0.0-rc.0", "2.1.0-rc.1"}},
+	}
+
+	for _, c := range cases {
+		r, err := ParseVersionRange(c.expr)
+		require.Nil(t, err, c.expr)
+		for _, v := range c.in {
+			assert.True(t, r.Match(v), "%s in %s", v, c.expr)
+		}
+		for _, v := range c.out {
+			assert.False(t, r.Match(v), "%s not in %s", v, c.expr)
+		}
+	}
+
+	for _, bad := range []string{"1.2 ||", "^x.1", ">*", "!=1.2", "=>1", "1,,2 || ,"} {
+		_, err := ParseVersionRange(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,200 @@
+package trace
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultRecorderCapacity defines the default number of
+// ended spans kept by a recorder.
+const DefaultRecorderCapacity = 1024
+
+// Exporter receives ended spans. Export is called synchronously
+// when a span ends, so slow exporters should buffer internally.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Recorder keeps the latest ended spans in memory.
+//
+// Note: all methods are goroutine-safe.
+type Recorder struct {
+	sync.Mutex
+	spans []*Span //ring buffer
+	next  int     //index of the next slot
+	full  bool
+}
+
+var _ Exporter = &Recorder{}
+
+// NewRecorder creates a recorder keeping at most capacity
+// spans, or DefaultRecorderCapacity if capacity <= 0.
+func NewRecorder(capacity int) *Recorder {
+	if capacity <= 0 {
+		capacity = DefaultRecorderCapacity
+	}
+
+	return &Recorder{spans: make([]*Span, capacity)}
+}
+
+// Export records the span, dropping the oldest one if full.
+func (r *Recorder) Export(span *Span) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.spans[r.next] = span
+	r.next = (r.next + 1) % len(r.spans)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Spans returns spans recorded, in the order they ended.
+func (r *Recorder) Spans() []*Span {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.full {
+		return append([]*Span(nil), r.spans[:r.next]...)
+	}
+
+	return append(append([]*Span(nil), r.spans[r.next:]...), r.spans[:r.next]...)
+}
+
+// Trace returns spans recorded of the given trace id.
+func (r *Recorder) Trace(traceID string) []*Span {
+	var result []*Span
+	for _, span := range r.Spans() {
+		if span.TraceID == traceID {
+			result = append(result, span)
+		}
+	}
+
+	return result
+}
+
+// Reset drops all spans recorded.
+func (r *Recorder) Reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.spans = make([]*Span, len(r.spans))
+	r.next = 0
+	r.full = false
+}
+
+// SpanNode is a node of a call tree.
+type SpanNode struct {
+	Span     *Span       `json:"span"`
+	Children []*SpanNode `json:"children,omitempty"`
+}
+
+// BuildTree reconstructs call trees from spans, possibly collected
+// from different services and traces. Spans whose parent is missing
+// become roots. Roots and children are sorted by start time.
+func BuildTree(spans []*Span) []*SpanNode {
+	nodes := make(map[string]*SpanNode, len(spans))
+	for _, span := range spans {
+		nodes[span.TraceID+span.SpanID] = &SpanNode{Span: span}
+	}
+
+	var roots []*SpanNode
+	for _, span := range spans {
+		node := nodes[span.TraceID+span.SpanID]
+		if parent, ok := nodes[span.TraceID+span.ParentID]; ok && len(span.ParentID) != 0 {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	sortNodes(roots)
+
+	return roots
+}
+
+func sortNodes(nodes []*SpanNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Span.StartTime.Before(nodes[j].Span.StartTime)
+	})
+
+	for _, node := range nodes {
+		sortNodes(node.Children)
+	}
+}
+
+// FileExporter appends spans, encoded as JSON lines, to a file.
+type FileExporter struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+var _ Exporter = &FileExporter{}
+
+// NewFileExporter opens, or creates, the file at path for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileExporter{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Export appends the span as a line.
+func (e *FileExporter) Export(span *Span) {
+	e.Lock()
+	defer e.Unlock()
+
+	if err := e.enc.Encode(span); err != nil {
+		log.Warnf("export span to %s failed: %v", e.file.Name(), err)
+	}
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.file.Close()
+}
+
+// PublishFunc publishes data on a topic, e.g. Notify of a service.
+type PublishFunc = func(topic string, data []byte) error
+
+// PublishExporter publishes each span, encoded as JSON,
+// on a bus topic, where collectors may subscribe to.
+type PublishExporter struct {
+	topic   string
+	publish PublishFunc
+}
+
+var _ Exporter = &PublishExporter{}
+
+// NewPublishExporter creates an exporter publishing spans on the topic.
+func NewPublishExporter(topic string, publish PublishFunc) *PublishExporter {
+	return &PublishExporter{
+		topic:   topic,
+		publish: publish,
+	}
+}
+
+// Export publishes the span.
+func (e *PublishExporter) Export(span *Span) {
+	buf, err := json.Marshal(span)
+	if err != nil {
+		log.Warnf("marshal span failed: %v", err)
+		return
+	}
+
+	if err = e.publish(e.topic, buf); err != nil {
+		log.Warnf("publish span to %s failed: %v", e.topic, err)
+	}
+}
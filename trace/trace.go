@@ -0,0 +1,342 @@
+// Package trace provides spans with W3C Trace Context propagation,
+// an in-process recorder and exporters, to reconstruct call trees
+// of requests across services without an external tracing backend.
+//
+// See https://www.w3.org/TR/trace-context/.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceParentHeader  = "traceparent" //key of the traceparent field in metadata
+	traceParentVersion = "00"
+	flagSampled        = 0x01
+)
+
+// ErrInvalidTraceParent is returned when a traceparent value is malformed.
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid returns false for the all-zero id.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid returns false for the all-zero id.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span propagated across services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid returns true if both ids are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceParent formats the context as a traceparent value, e.g.
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (sc SpanContext) TraceParent() string {
+	return traceParentVersion + "-" + sc.TraceID.String() + "-" +
+		sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceParent parses a traceparent value. Versions other than
+// 00 are accepted as long as the first four fields are well-formed.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == traceParentVersion && len(parts) != 4) {
+		return sc, ErrInvalidTraceParent
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || len(parts[1]) != 32 {
+		return sc, ErrInvalidTraceParent
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || len(parts[2]) != 16 {
+		return sc, ErrInvalidTraceParent
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceParent
+	}
+
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceParent
+	}
+
+	return sc, nil
+}
+
+// SpanKind defines the role of a span in a call.
+type SpanKind string
+
+const (
+	KindInternal SpanKind = "internal"
+	KindServer   SpanKind = "server"   //handling of an rpc
+	KindClient   SpanKind = "client"   //calling of an rpc
+	KindProducer SpanKind = "producer" //publishing of a notice
+	KindConsumer SpanKind = "consumer" //receiving of a notice
+)
+
+// Span records a timed operation within a trace.
+//
+// Fields must not be changed directly, and a span is
+// immutable once ended, when it's handed to exporters.
+type Span struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentId,omitempty"`
+	Name       string            `json:"name"`
+	Kind       SpanKind          `json:"kind"`
+	Service    string            `json:"service"`
+	StartTime  time.Time         `json:"start"`
+	EndTime    time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	mu     sync.Mutex
+	ended  bool
+	sc     SpanContext
+	tracer *Tracer
+}
+
+// Context returns the span context used to propagate the span.
+// A nil span returns the invalid context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.sc
+}
+
+// Duration returns the duration of an ended span.
+func (s *Span) Duration() time.Duration {
+	return s.EndTime.Sub(s.StartTime)
+}
+
+// SetAttribute sets an attribute of the span. Ignored if
+// the span is nil or already ended.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed if err is not nil.
+// Ignored if the span is nil or already ended.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ended {
+		s.Error = err.Error()
+	}
+}
+
+// End ends the span and hands it to the recorder and exporters
+// of the tracer. Only the first call takes effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.export(s)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemote returns a copy of ctx carrying a span
+// context received from a remote service.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContextFromContext returns context of the span carried by ctx,
+// or the remote span context, or the invalid one if there's none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context()
+	}
+
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Option customizes a Tracer.
+type Option func(*Tracer)
+
+// WithRecorderCapacity sets the number of ended spans kept
+// by the recorder of the tracer, see DefaultRecorderCapacity.
+func WithRecorderCapacity(capacity int) Option {
+	return func(t *Tracer) {
+		t.recorder = NewRecorder(capacity)
+	}
+}
+
+// WithExporter adds an exporter to the tracer.
+func WithExporter(e Exporter) Option {
+	return func(t *Tracer) {
+		t.exporters = append(t.exporters, e)
+	}
+}
+
+// Tracer creates spans of a service, and hands ended ones
+// to an in-process recorder and the exporters added.
+//
+// Note: all methods are goroutine-safe.
+type Tracer struct {
+	sync.RWMutex
+	service   string
+	recorder  *Recorder
+	exporters []Exporter
+}
+
+// NewTracer creates a tracer for the given service.
+func NewTracer(service string, opts ...Option) *Tracer {
+	t := &Tracer{service: service}
+	for _, fn := range opts {
+		fn(t)
+	}
+
+	if t.recorder == nil {
+		t.recorder = NewRecorder(DefaultRecorderCapacity)
+	}
+
+	return t
+}
+
+// Service returns name of the service traced.
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Recorder returns the in-process recorder of ended spans.
+func (t *Tracer) Recorder() *Recorder {
+	return t.recorder
+}
+
+// AddExporter adds an exporter to the tracer.
+func (t *Tracer) AddExporter(e Exporter) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.exporters = append(t.exporters, e)
+}
+
+// Start starts a span as a child of the span, or the remote
+// span context, carried by ctx, or as the root of a new trace
+// if there's none, and returns a copy of ctx carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+
+	sc := SpanContext{Flags: flagSampled}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+	} else {
+		_, _ = rand.Read(sc.TraceID[:])
+	}
+
+	_, _ = rand.Read(sc.SpanID[:])
+
+	span := &Span{
+		TraceID:   sc.TraceID.String(),
+		SpanID:    sc.SpanID.String(),
+		Name:      name,
+		Kind:      kind,
+		Service:   t.service,
+		StartTime: time.Now(),
+		sc:        sc,
+		tracer:    t,
+	}
+
+	if parent.IsValid() {
+		span.ParentID = parent.SpanID.String()
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) export(span *Span) {
+	t.recorder.Export(span)
+
+	t.RLock()
+	exporters := t.exporters
+	t.RUnlock()
+
+	for _, e := range exporters {
+		e.Export(span)
+	}
+}
@@ -0,0 +1,119 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceParent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(tp)
+	require.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.Equal(t, byte(1), sc.Flags)
+	assert.Equal(t, tp, sc.TraceParent())
+
+	// future versions may carry more fields
+	_, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.Nil(t, err)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, err = ParseTraceParent(bad)
+		assert.ErrorIs(t, err, ErrInvalidTraceParent, bad)
+	}
+}
+
+func TestTracerSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	file, err := NewFileExporter(path)
+	require.Nil(t, err)
+
+	tracer := NewTracer("svc", WithExporter(file))
+
+	ctx, root := tracer.Start(context.Background(), "root", KindInternal)
+	assert.Empty(t, root.ParentID)
+
+	_, child := tracer.Start(ctx, "child", KindClient)
+	child.SetAttribute("k", "v")
+	child.SetError(errors.New("boom"))
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+
+	// a remote parent continues the trace
+	remote := ContextWithRemote(context.Background(), child.Context())
+	_, server := tracer.Start(remote, "server", KindServer)
+	assert.Equal(t, root.TraceID, server.TraceID)
+	assert.Equal(t, child.SpanID, server.ParentID)
+
+	server.End()
+	child.End()
+	root.End()
+	root.End()
+	child.SetAttribute("late", "ignored")
+
+	spans := tracer.Recorder().Spans()
+	require.Len(t, spans, 3)
+	assert.Equal(t, []*Span{server, child, root}, spans)
+	assert.Equal(t, map[string]string{"k": "v"}, child.Attributes)
+	assert.Equal(t, "boom", child.Error)
+
+	tree := BuildTree(tracer.Recorder().Trace(root.TraceID))
+	require.Len(t, tree, 1)
+	assert.Equal(t, root, tree[0].Span)
+	require.Len(t, tree[0].Children, 1)
+	assert.Equal(t, child, tree[0].Children[0].Span)
+	require.Len(t, tree[0].Children[0].Children, 1)
+	assert.Equal(t, server, tree[0].Children[0].Children[0].Span)
+
+	// nil spans are no-ops
+	var none *Span
+	none.SetAttribute("k", "v")
+	none.End()
+	assert.False(t, none.Context().IsValid())
+
+	require.Nil(t, file.Close())
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		span := &Span{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), span))
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"server", "child", "root"}, names)
+}
+
+func TestRecorderRing(t *testing.T) {
+	r := NewRecorder(2)
+	for _, name := range []string{"a", "b", "c"} {
+		r.Export(&Span{Name: name})
+	}
+
+	spans := r.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "b", spans[0].Name)
+	assert.Equal(t, "c", spans[1].Name)
+
+	r.Reset()
+	assert.Empty(t, r.Spans())
+}